@@ -22,8 +22,14 @@ type BBR struct {
 	rcv_rate   float32
 	wait_time  time.Duration
 
+	// the datapath's delivered bytes and clock at the last report
+	lastDelivered uint64
+	lastTimestamp time.Duration
+
 	sockid uint32
 	ipc    ipc.SendOnly
+	// whose clock the flow runs on
+	dp ccpFlow.DatapathInfo
 }
 
 func (b *BBR) Name() string {
@@ -36,14 +42,16 @@ func (b *BBR) Create(
 	pktsz uint32,
 	startSeq uint32,
 	startCwnd uint32,
+	dp ccpFlow.DatapathInfo,
 ) {
 	b.sockid = socketid
+	b.dp = dp
 	b.ipc = send
 	b.pktSize = pktsz
 	b.rcv_rate = float32(b.pktSize * 100)
-	b.lastDrop = time.Now()
-	b.lastUpdate = time.Now()
-	b.rtt = time.Since(b.lastDrop)
+	b.lastDrop = b.dp.Now()
+	b.lastUpdate = b.dp.Now()
+	b.rtt = b.dp.Since(b.lastDrop)
 	if startSeq == 0 {
 		b.lastAck = startSeq
 	} else {
@@ -66,6 +74,17 @@ func (b *BBR) GotMeasurement(m ccpFlow.Measurement) {
 		b.rcv_rate = float32(m.Rout)
 	}
 
+	// delivery rate since the last report, if the datapath reports it
+	if b.lastDelivered > 0 && m.Delivered >= b.lastDelivered && m.Timestamp > b.lastTimestamp {
+		rate := float64(m.Delivered-b.lastDelivered) / (m.Timestamp - b.lastTimestamp).Seconds()
+		if b.rcv_rate < float32(rate) {
+			b.rcv_rate = float32(rate)
+		}
+	}
+
+	b.lastDelivered = m.Delivered
+	b.lastTimestamp = m.Timestamp
+
 	// Handle integer overflow / sequence wraparound
 	var newBytesAcked uint64
 	if m.Ack < b.lastAck {
@@ -77,10 +96,10 @@ func (b *BBR) GotMeasurement(m ccpFlow.Measurement) {
 	acked := newBytesAcked
 	b.rtt = m.Rtt
 
-	if time.Since(b.lastUpdate) >= b.wait_time {
+	if b.dp.Since(b.lastUpdate) >= b.wait_time {
 		b.wait_time = m.Rtt
 		b.sendPattern(0.95*b.rcv_rate, b.wait_time/8)
-		b.lastUpdate = time.Now()
+		b.lastUpdate = b.dp.Now()
 
 		log.WithFields(log.Fields{
 			"gotAck":          m.Ack,
@@ -98,17 +117,17 @@ func (b *BBR) GotMeasurement(m ccpFlow.Measurement) {
 }
 
 func (b *BBR) Drop(ev ccpFlow.DropEvent) {
-	if time.Since(b.lastDrop) <= b.rtt {
+	if b.dp.Since(b.lastDrop) <= b.rtt {
 		return
 	}
 
 	//oldRate := b.rcv_rate
 	log.WithFields(log.Fields{
-		"time since last drop": time.Since(b.lastDrop),
-		"rtt": b.rtt,
+		"time since last drop": b.dp.Since(b.lastDrop),
+		"rtt":                  b.rtt,
 	}).Info("[bbr] got drop")
 
-	b.lastDrop = time.Now()
+	b.lastDrop = b.dp.Now()
 
 	//switch ev {
 	//case ccpFlow.DupAck:
@@ -133,6 +152,26 @@ func (b *BBR) Drop(ev ccpFlow.DropEvent) {
 	//}).Info("[bbr] drop")
 }
 
+func (b *BBR) Handoff() ccpFlow.Handoff {
+	return ccpFlow.Handoff{
+		Cwnd: uint32(float64(b.rcv_rate) * b.rtt.Seconds()),
+		Rtt:  b.rtt,
+		Ack:  b.lastAck,
+	}
+}
+
+// start from the rate the carried over window was achieving,
+// rather than probing up from scratch
+func (b *BBR) Resume(h ccpFlow.Handoff) {
+	if h.Rtt <= 0 || h.Cwnd == 0 {
+		return
+	}
+
+	b.rtt = h.Rtt
+	b.rcv_rate = float32(float64(h.Cwnd) / h.Rtt.Seconds())
+	b.sendPattern(0.95*b.rcv_rate, b.wait_time/8)
+}
+
 func (b *BBR) sendPattern(rcv_rate float32, wait_time time.Duration) {
 	pattern, err := pattern.
 		NewPattern().
@@ -1,14 +1,23 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
 	"time"
 
 	"ccp/bbr"
 	"ccp/compound"
+	"ccp/ctl"
 	"ccp/cubic"
 	"ccp/ipc"
+	"ccp/ipcBackend"
 	"ccp/reno"
+	"ccp/unixsocket"
 	"ccp/vegas"
 
 	log "github.com/sirupsen/logrus"
@@ -21,23 +30,91 @@ func init() {
 	})
 }
 
-var datapath = flag.String("datapath", "udp", "which IPC backend to use (udp|kernel)")
+var datapath = flag.String("datapath", "udp", "which IPC backend to use (udp|kernel|tcp|shm)")
+var tcpAddr = flag.String("tcpAddr", ipc.TCPAddr, "address to listen on for remote datapaths with -datapath tcp")
 var overrideAlg = flag.String("congAlg", "nil", "override the datapath's requested congestion control algorithm for all flows (cubic|reno|vegas|nil)")
-var initCwnd = flag.Uint("initCwnd", 10, "override the default starting congestion window")
+var initCwnd = flag.Uint("initCwnd", 10, "starting congestion window, in packets, for datapaths which do not give their own")
+var ctlSock = flag.String("ctlSock", ctl.DefaultPath, "unix socket for control requests from ccpctl, empty to disable")
+var idleTimeout = flag.Duration("idleTimeout", time.Minute, "forget a flow after this long without messages from the datapath")
+var patternRetx = flag.Duration("patternRetx", 0, "send a pattern again after this long without an ack from the datapath, 0 to never")
+var batchInterval = flag.Duration("batchInterval", 0, "hold messages to datapaths which can parse batches for up to this long, 0 to never batch")
+var batchSize = flag.Int("batchSize", ipc.DefaultBatchSize, "send a batch once it holds this many bytes")
+var ipcDir = flag.String("ipcDir", ipcbackend.BaseDir, "directory for the udp and shm datapaths' sockets, which must match the datapaths' $CCP_IPC_DIR")
+var namespace = flag.String("namespace", ipcbackend.Namespace, "keeps this ccp's sockets apart from other ccps' on the machine, and must match its datapaths' $CCP_IPC_NAMESPACE")
+var unixMode = flag.String("unixMode", ipc.UnixMode.String(), "how the udp datapath's sockets are addressed and their kind (abstract,seqpacket), which must match the datapaths' $CCP_IPC_UNIX_MODE; empty for datagrams named by files")
+var ipcPerm = flag.String("ipcPerm", "", "octal mode of the ccp's sockets, empty to leave it to the umask")
+var measureQueue = flag.Int("measureQueue", 0, "let up to this many measurements wait for their flows, keeping only each flow's latest, 0 to hand each over as it arrives")
 
-var flows map[uint32]flowHandler
+// where the ccp's sockets go, from the flags
+func setupIpcPaths() error {
+	ipcbackend.BaseDir = *ipcDir
+	ipcbackend.Namespace = *namespace
+	m, err := unixsocket.ParseMode(*unixMode)
+	if err != nil {
+		return err
+	}
+
+	ipc.UnixMode = m
+	if *ipcPerm != "" {
+		perm, err := strconv.ParseUint(*ipcPerm, 8, 32)
+		if err != nil || perm > 0777 {
+			return fmt.Errorf("bad -ipcPerm %q: expected an octal mode", *ipcPerm)
+		}
+
+		ipcbackend.Perm = os.FileMode(perm)
+	}
+
+	// the default control socket moves with the others
+	ctlSet := false
+	flag.Visit(func(f *flag.Flag) {
+		ctlSet = ctlSet || f.Name == "ctlSock"
+	})
+
+	if !ctlSet {
+		*ctlSock = ipcbackend.AddressForSend("ctl", 0)
+	}
+
+	return nil
+}
+
+// the CCP's listening Ipc, which routes each flow's messages to its flowHandler
+var com *ipc.Ipc
 var dp ipc.Datapath
 
 func main() {
+	// exit with an error once everything else has cleaned up
+	failed := false
+	defer func() {
+		if failed {
+			os.Exit(1)
+		}
+	}()
+
 	flag.Parse()
 
+	if err := setupIpcPaths(); err != nil {
+		log.Error(err)
+		failed = true
+		return
+	}
+
 	log.WithFields(log.Fields{
-		"datapath":    *datapath,
-		"overrideAlg": *overrideAlg,
-		"startCwnd":   *initCwnd,
+		"datapath":      *datapath,
+		"tcpAddr":       *tcpAddr,
+		"overrideAlg":   *overrideAlg,
+		"startCwnd":     *initCwnd,
+		"idleTimeout":   *idleTimeout,
+		"patternRetx":   *patternRetx,
+		"batchInterval": *batchInterval,
+		"batchSize":     *batchSize,
+		"measureQueue":  *measureQueue,
+		"ipcDir":        *ipcDir,
+		"namespace":     *namespace,
+		"ipcPerm":       *ipcPerm,
+		"unixMode":      *unixMode,
+		"ctlSock":       *ctlSock,
 	}).Info("parsed flags")
 
-	flows = make(map[uint32]flowHandler)
 	bbr.Init()
 	compound.Init()
 	cubic.Init()
@@ -49,6 +126,11 @@ func main() {
 		dp = ipc.UNIX
 	case "kernel":
 		dp = ipc.NETLINK
+	case "tcp":
+		dp = ipc.TCP
+		ipc.TCPAddr = *tcpAddr
+	case "shm":
+		dp = ipc.SHM
 	default:
 		log.WithFields(log.Fields{
 			"datapath": *datapath,
@@ -56,29 +138,54 @@ func main() {
 		return
 	}
 
-	com, err := ipc.SetupCcpListen(dp)
+	var err error
+	com, err = ipc.SetupCcpListen(dp)
 	if err != nil {
 		log.Error(err)
+		failed = true
 		return
 	}
+	defer com.Close()
 
-	ackCh, err := com.ListenMeasureMsg()
-	if err != nil {
-		log.Error(err)
-		return
+	if *measureQueue > 0 {
+		err = com.SetQueue(ipc.MEASURE, ipc.QueueConfig{Len: *measureQueue, Policy: ipc.CoalesceLatest})
+		if err != nil {
+			log.Error(err)
+			return
+		}
 	}
 
-	createCh, err := com.ListenCreateMsg()
-	if err != nil {
-		log.Error(err)
-		return
-	}
+	ctx, cancel := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		log.WithFields(log.Fields{
+			"signal": sig,
+		}).Info("shutting down")
+		cancel()
+	}()
 
-	dropCh, err := com.ListenDropMsg()
-	if err != nil {
-		log.Error(err)
-		return
+	ch := newCcpHandler(ctx, cancel)
+	com.Handle(ch)
+
+	var ctlCh chan ctlCall
+	if *ctlSock != "" {
+		var srv *ctl.Server
+		ctlCh, srv, err = serveControl(ctx, *ctlSock)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"path":  *ctlSock,
+				"error": err,
+			}).Warn("could not start control socket, continuing without it")
+		} else {
+			defer srv.Close()
+		}
 	}
 
-	handleMsgs(createCh, ackCh, dropCh)
+	handleMsgs(ch, ctlCh)
+	log.Info("all flows stopped")
+	if ch.failed() != nil {
+		failed = true
+	}
 }
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+
+	"ccp/ccpFlow"
+	"ccp/ctl"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/* Control requests are served by the goroutine which owns the state they
+ * touch: the event loop for the set of flows and the defaults for new flows,
+ * and a flow's own event loop for its algorithm and state.
+ */
+
+type ctlCall struct {
+	req  ctl.Request
+	resp chan ctl.Response
+}
+
+// start the admin endpoint; requests arrive on the returned channel
+func serveControl(ctx context.Context, path string) (chan ctlCall, *ctl.Server, error) {
+	srv, err := ctl.Listen(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	calls := make(chan ctlCall)
+	go srv.Serve(func(req ctl.Request) ctl.Response {
+		call := ctlCall{req: req, resp: make(chan ctl.Response, 1)}
+		select {
+		case calls <- call:
+		case <-ctx.Done():
+			return ctl.Errorf("ccp is shutting down")
+		}
+
+		return <-call.resp
+	})
+
+	log.WithFields(log.Fields{
+		"path": path,
+	}).Info("listening for control requests")
+	return calls, srv, nil
+}
+
+// called from the CCP's event loop
+func handleCtl(call ctlCall) {
+	log.WithFields(log.Fields{
+		"cmd":  call.req.Cmd,
+		"flow": call.req.Flow,
+		"alg":  call.req.Alg,
+	}).Info("handleCtl")
+
+	switch call.req.Cmd {
+	case ctl.List:
+		var infos []ctl.FlowInfo
+		for sid, handler := range com.SocketHandlers() {
+			infos = append(infos, ctl.FlowInfo{Flow: sid, Alg: handler.(*flowHandler).alg})
+		}
+
+		call.resp <- ctl.Response{Flows: infos}
+	case ctl.Dump, ctl.Switch:
+		handler, ok := lookupFlow(call.req.Flow)
+		if !ok {
+			call.resp <- ctl.Errorf("unknown flow %d", call.req.Flow)
+			return
+		}
+
+		// the flow's event loop must not read the defaults, which this loop owns
+		if call.req.Cmd == ctl.Switch {
+			call.req.InitCwnd = uint32(*initCwnd)
+		}
+
+		// wait for the flow's answer, so the flows map knows its algorithm
+		flowCall := ctlCall{req: call.req, resp: make(chan ctl.Response, 1)}
+		select {
+		case handler.flowCtlCh <- flowCall:
+		case <-handler.done:
+			call.resp <- ctl.Errorf("flow %d is shutting down", call.req.Flow)
+			return
+		}
+
+		resp := <-flowCall.resp
+		if call.req.Cmd == ctl.Switch && resp.Err == "" {
+			handler.alg = resp.Flows[0].Alg
+		}
+
+		call.resp <- resp
+	case ctl.Defaults:
+		if call.req.Alg != "" && call.req.Alg != "nil" {
+			if _, err := ccpFlow.GetFlow(call.req.Alg); err != nil {
+				call.resp <- ctl.Errorf("%v", err)
+				return
+			}
+		}
+
+		if call.req.Alg != "" {
+			*overrideAlg = call.req.Alg
+		}
+
+		if call.req.InitCwnd != 0 {
+			*initCwnd = uint(call.req.InitCwnd)
+		}
+
+		call.resp <- ctl.Response{Defaults: &ctl.DefaultsInfo{
+			CongAlg:  *overrideAlg,
+			InitCwnd: uint32(*initCwnd),
+		}}
+	default:
+		call.resp <- ctl.Errorf("unknown command %q", call.req.Cmd)
+	}
+}
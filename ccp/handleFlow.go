@@ -1,9 +1,14 @@
 package main
 
 import (
+	"context"
+	"sync"
 	"time"
 
 	"ccp/ccpFlow"
+	"ccp/ccpFlow/pattern"
+	"ccp/ctl"
+	"ccp/ipc"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -11,13 +16,29 @@ import (
 /* The event loop for a single flow
  * Receive filtered messages from the CCP corresp
  * to this flow, and call the appropriate handling function
+ * Runs until ctx is cancelled or the flow is idle for idleTimeout.
  */
 func handleFlow(
+	ctx context.Context,
 	sockId uint32,
 	flow ccpFlow.Flow,
-	msgs flowHandler,
+	ipCh *patternLog,
+	msgs *flowHandler,
 	endFlow chan uint32,
 ) {
+	defer func() {
+		closeFlow(flow)
+		ipCh.Close()
+	}()
+
+	state := ctl.FlowState{
+		FlowInfo: ctl.FlowInfo{Flow: sockId, Alg: flow.Name()},
+		Created:  time.Now(),
+	}
+
+	idle := time.NewTimer(*idleTimeout)
+	defer idle.Stop()
+
 	for {
 		select {
 		case m := <-msgs.flowMeasureCh:
@@ -30,23 +51,170 @@ func handleFlow(
 				"rout":   m.Rout(),
 			}).Debug("handleMeasure")
 
-			flow.GotMeasurement(ccpFlow.Measurement{
-				Ack:  m.AckNo(),
-				Rtt:  m.Rtt(),
-				Loss: m.Loss(),
-				Rin:  m.Rin(),
-				Rout: m.Rout(),
-			})
+			state.LastMsg = time.Now()
+			state.Measurements++
+			meas := ccpFlow.MeasurementFromMsg(m)
+			state.Ack = meas.Ack
+			state.Rtt = meas.Rtt
+			state.Rin = meas.Rin
+			state.Rout = meas.Rout
+			state.Loss = meas.Loss
+			state.MinRtt = meas.MinRtt
+			state.Delivered = meas.Delivered
+			state.Inflight = meas.Inflight
+			state.Ecn = meas.Ecn
+			state.Sacked = meas.Sacked
+
+			flow.GotMeasurement(meas)
 		case dr := <-msgs.flowDropCh:
 			log.WithFields(log.Fields{
 				"flowid":  dr.SocketId,
 				"drEvent": dr.Event,
 			}).Debug("handleDrop")
+			state.LastMsg = time.Now()
+			state.Drops++
 			flow.Drop(ccpFlow.DropEvent(dr.Event()))
-		case <-time.After(time.Minute):
-			// garbage collect this goroutine after a minute of inactivity
-			endFlow <- sockId
+		case call := <-msgs.flowCtlCh:
+			flow = handleFlowCtl(call, flow, ipCh, msgs.dp, &state)
+		case <-ctx.Done():
+			// the datapath closed the socket, or the CCP is shutting down
+			close(msgs.done)
+			return
+		case <-idle.C:
+			// garbage collect this goroutine after a period of inactivity.
+			// control calls see done from here on, so the event loop is
+			// free to take endFlow and forget the flow.
+			close(msgs.done)
+			select {
+			case endFlow <- sockId:
+			case <-ctx.Done():
+			}
 			return
 		}
+
+		if !idle.Stop() {
+			<-idle.C
+		}
+		idle.Reset(*idleTimeout)
 	}
 }
+
+// called from the flow's event loop; returns the flow's algorithm afterwards
+func handleFlowCtl(
+	call ctlCall,
+	flow ccpFlow.Flow,
+	ipCh *patternLog,
+	dp flowDatapath,
+	state *ctl.FlowState,
+) ccpFlow.Flow {
+	switch call.req.Cmd {
+	case ctl.Dump:
+		dump := *state
+		if h, ok := flow.(ccpFlow.Handoffer); ok {
+			dump.Cwnd = h.Handoff().Cwnd
+		}
+
+		dump.Pattern = ipCh.latest()
+
+		call.resp <- ctl.Response{State: &dump}
+	case ctl.Switch:
+		next, err := ccpFlow.GetFlow(call.req.Alg)
+		if err != nil {
+			call.resp <- ctl.Errorf("%v", err)
+			return flow
+		}
+
+		initCwnd := dp.initCwnd
+		if initCwnd == 0 {
+			initCwnd = call.req.InitCwnd
+		}
+
+		h := handoff(flow, state, dp.pktSize, initCwnd)
+		log.WithFields(log.Fields{
+			"flowid": state.Flow,
+			"from":   flow.Name(),
+			"to":     next.Name(),
+			"cwnd":   h.Cwnd,
+			"rtt":    h.Rtt,
+			"ack":    h.Ack,
+		}).Info("switching algorithm")
+
+		closeFlow(flow)
+		// Create takes the first unacked sequence number and a window in packets
+		cwndPkts := (h.Cwnd + dp.pktSize - 1) / dp.pktSize
+		next.Create(state.Flow, ipCh, dp.pktSize, h.Ack+1, cwndPkts, dp.info)
+		if r, ok := next.(ccpFlow.Resumer); ok {
+			r.Resume(h)
+		}
+
+		state.Alg = next.Name()
+		call.resp <- ctl.Response{Flows: []ctl.FlowInfo{state.FlowInfo}}
+		return next
+	default:
+		call.resp <- ctl.Errorf("unknown command %q", call.req.Cmd)
+	}
+
+	return flow
+}
+
+// what to carry over to the next algorithm: the algorithm's own view of
+// the flow where it has one, otherwise the latest measurement, and the
+// initial window if the algorithm does not report its window
+func handoff(flow ccpFlow.Flow, state *ctl.FlowState, pktsz uint32, initCwnd uint32) ccpFlow.Handoff {
+	h := ccpFlow.Handoff{
+		Cwnd: initCwnd * pktsz,
+		Rtt:  state.Rtt,
+		Ack:  state.Ack,
+	}
+
+	if f, ok := flow.(ccpFlow.Handoffer); ok {
+		fh := f.Handoff()
+		if fh.Cwnd != 0 {
+			h.Cwnd = fh.Cwnd
+		}
+
+		if fh.Rtt != 0 {
+			h.Rtt = fh.Rtt
+		}
+
+		if fh.Ack != 0 {
+			h.Ack = fh.Ack
+		}
+	}
+
+	return h
+}
+
+func closeFlow(flow ccpFlow.Flow) {
+	if c, ok := flow.(ccpFlow.Closer); ok {
+		c.Close()
+	}
+}
+
+// the flow's sending side: logs each pattern the algorithm sends,
+// and keeps the latest for dumps
+type patternLog struct {
+	*ipc.Ipc
+
+	mux  sync.Mutex
+	last string
+}
+
+func (l *patternLog) SendPatternMsg(socketId uint32, p *pattern.Pattern) error {
+	s := p.String()
+	l.mux.Lock()
+	l.last = s
+	l.mux.Unlock()
+
+	log.WithFields(log.Fields{
+		"flowid":  socketId,
+		"pattern": s,
+	}).Info("sendPattern")
+	return l.Ipc.SendPatternMsg(socketId, p)
+}
+
+func (l *patternLog) latest() string {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	return l.last
+}
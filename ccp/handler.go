@@ -1,49 +1,219 @@
 package main
 
 import (
+	"context"
+	"sync"
+
 	"ccp/ccpFlow"
 	"ccp/ipc"
+	"ccp/ipcBackend"
 
 	log "github.com/sirupsen/logrus"
 )
 
+/* The CCP's Handler for sockets without a flow.
+ * CREATEs and CLOSEs go to the CCP's event loop, which owns the flows.
+ * OnCreate waits for the event loop to set up the flow, so the flow's
+ * Handler is registered before its next message arrives.
+ * A backend which stops working shuts the CCP down.
+ */
+type ccpHandler struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	creates chan createCall
+	closes  chan ipc.CloseMsg
+
+	mux sync.Mutex
+	// the error which shut the CCP down, if any
+	failure error
+}
+
+type createCall struct {
+	cr   ipc.CreateMsg
+	done chan interface{}
+}
+
+func newCcpHandler(ctx context.Context, cancel context.CancelFunc) *ccpHandler {
+	return &ccpHandler{
+		ctx:     ctx,
+		cancel:  cancel,
+		creates: make(chan createCall),
+		closes:  make(chan ipc.CloseMsg),
+	}
+}
+
+func (h *ccpHandler) OnCreate(cr ipc.CreateMsg) {
+	call := createCall{cr: cr, done: make(chan interface{})}
+	select {
+	case h.creates <- call:
+		<-call.done
+	case <-h.ctx.Done():
+	}
+}
+
+func (h *ccpHandler) OnMeasure(m ipc.MeasureMsg) {
+	log.WithFields(log.Fields{
+		"flowid": m.SocketId(),
+		"msg":    "measure",
+	}).Warn("Unknown flow")
+}
+
+func (h *ccpHandler) OnDrop(dr ipc.DropMsg) {
+	log.WithFields(log.Fields{
+		"flowid": dr.SocketId(),
+		"msg":    "drop",
+	}).Warn("Unknown flow")
+}
+
+// datapaths do not send patterns
+func (h *ccpHandler) OnPattern(ipc.PatternMsg) {}
+
+func (h *ccpHandler) OnClose(cl ipc.CloseMsg) {
+	select {
+	case h.closes <- cl:
+	case <-h.ctx.Done():
+	}
+}
+
+func (h *ccpHandler) OnError(err error) {
+	e, ok := err.(*ipcbackend.Error)
+	if !ok || !e.Fatal() {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Warn("ipc error")
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"where": e.Where,
+		"kind":  e.Kind,
+		"err":   e.Err,
+	}).Error("ipc backend failed, shutting down")
+
+	h.mux.Lock()
+	if h.failure == nil {
+		h.failure = err
+	}
+	h.mux.Unlock()
+	h.cancel()
+}
+
+// the error which shut the CCP down, if any
+func (h *ccpHandler) failed() error {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	return h.failure
+}
+
+// a flow's Handler, which hands its measurements and drops to the flow's
+// event loop, and everything else to the CCP's
 type flowHandler struct {
+	*ccpHandler
+
+	// name of the algorithm controlling the flow
+	alg           string
+	dp            flowDatapath
 	flowMeasureCh chan ipc.MeasureMsg
 	flowDropCh    chan ipc.DropMsg
+	flowCtlCh     chan ctlCall
+	// stops the flow's event loop
+	cancel context.CancelFunc
+	// closed once the flow's event loop has stopped taking messages
+	done chan interface{}
+}
+
+func (h *flowHandler) OnMeasure(m ipc.MeasureMsg) {
+	select {
+	case h.flowMeasureCh <- m:
+	case <-h.done:
+	}
+}
+
+func (h *flowHandler) OnDrop(dr ipc.DropMsg) {
+	select {
+	case h.flowDropCh <- dr:
+	case <-h.done:
+	}
+}
+
+// the flow on socket sid, if there is one
+func lookupFlow(sid uint32) (*flowHandler, bool) {
+	h, ok := com.SocketHandler(sid)
+	if !ok {
+		return nil, false
+	}
+
+	return h.(*flowHandler), true
+}
+
+// what the datapath said about a flow when creating it
+type flowDatapath struct {
+	pktSize uint32
+	// packets; 0 if the datapath did not say
+	initCwnd uint32
+	info     ccpFlow.DatapathInfo
+}
+
+// the datapath's view of the flow, with the CCP's defaults
+// for whatever it did not say
+func datapathFromMsg(cr ipc.CreateMsg) flowDatapath {
+	d := flowDatapath{
+		pktSize:  cr.Info().Mss,
+		initCwnd: cr.Info().InitCwnd,
+		info:     ccpFlow.DatapathInfoFromMsg(cr),
+	}
+
+	if d.pktSize == 0 {
+		d.pktSize = defaultPktSize()
+	}
+
+	return d
 }
 
 /* The event loop for the CCP
- * Demultiplex messages across flows, and dispatch new per-flow
- * event loops on CREATE messages.
+ * Create and close flows, whose messages the listening Ipc routes to
+ * their per-flow event loops.
+ * Returns once ctx is cancelled and every flow has shut down.
  */
-func handleMsgs(
-	createCh chan ipc.CreateMsg,
-	measureCh chan ipc.MeasureMsg,
-	dropCh chan ipc.DropMsg,
-) {
+func handleMsgs(ch *ccpHandler, ctlCh chan ctlCall) {
 	endFlow := make(chan uint32)
+	var running sync.WaitGroup
 	for {
 		select {
-		case cr := <-createCh:
-			handleCreate(cr, endFlow)
-		case m := <-measureCh:
-			handleMeasure(m)
-		case dr := <-dropCh:
-			handleDrop(dr)
+		case <-ch.ctx.Done():
+			// every flow's context derives from ctx, so they are all stopping
+			running.Wait()
+			return
+		case call := <-ch.creates:
+			handleCreate(ch, call.cr, endFlow, &running)
+			close(call.done)
+		case cl := <-ch.closes:
+			handleClose(cl)
 		case sid := <-endFlow:
 			handleFlowEnd(sid)
+		case call := <-ctlCh:
+			handleCtl(call)
 		}
 	}
 }
 
-func handleCreate(cr ipc.CreateMsg, endFlow chan uint32) {
+func handleCreate(
+	ch *ccpHandler,
+	cr ipc.CreateMsg,
+	endFlow chan uint32,
+	running *sync.WaitGroup,
+) {
 	log.WithFields(log.Fields{
 		"flowid":   cr.SocketId(),
 		"startseq": cr.StartSeq(),
 		"alg":      cr.CongAlg(),
+		"mss":      cr.Info().Mss,
+		"initcwnd": cr.Info().InitCwnd,
+		"events":   cr.Info().Events,
+		"fields":   cr.Info().Fields,
 	}).Info("handleCreate")
 
-	if _, ok := flows[cr.SocketId()]; ok {
+	if _, ok := lookupFlow(cr.SocketId()); ok {
 		log.WithFields(log.Fields{
 			"flowid": cr.SocketId(),
 		}).Error("Creating already created flow")
@@ -81,53 +251,89 @@ func handleCreate(cr ipc.CreateMsg, endFlow chan uint32) {
 	}
 
 gotFlow:
-	ipCh, err := ipc.SetupCcpSend(dp, cr.SocketId())
+	ipCh, err := ipc.SetupCcpSend(com, dp, cr.SocketId())
 	if err != nil {
 		log.WithFields(log.Fields{
 			"flowid": cr.SocketId(),
 		}).Error("Error creating ccp->socket ipc channel for flow")
+		return
 	}
 
-	switch dp {
-	case ipc.UNIX:
-		f.Create(cr.SocketId(), ipCh, 1462, cr.StartSeq(), uint32(*initCwnd))
-	case ipc.NETLINK:
-		f.Create(cr.SocketId(), ipCh, 1460, cr.StartSeq(), uint32(*initCwnd))
+	ipCh.SetPatternRetransmit(*patternRetx)
+	if err = ipCh.SetBatching(*batchInterval, *batchSize); err != nil {
+		log.WithFields(log.Fields{
+			"flowid": cr.SocketId(),
+			"err":    err,
+		}).Warn("not batching messages to flow")
+	}
+
+	out := &patternLog{Ipc: ipCh}
+	fdp := datapathFromMsg(cr)
+	startCwnd := fdp.initCwnd
+	if startCwnd == 0 {
+		startCwnd = uint32(*initCwnd)
 	}
 
-	handler := flowHandler{
+	f.Create(cr.SocketId(), out, fdp.pktSize, cr.StartSeq(), startCwnd, fdp.info)
+
+	flowCtx, cancel := context.WithCancel(ch.ctx)
+	handler := &flowHandler{
+		ccpHandler:    ch,
+		alg:           f.Name(),
+		dp:            fdp,
 		flowMeasureCh: make(chan ipc.MeasureMsg),
 		flowDropCh:    make(chan ipc.DropMsg),
+		flowCtlCh:     make(chan ctlCall),
+		cancel:        cancel,
+		done:          make(chan interface{}),
 	}
 
-	go handleFlow(cr.SocketId(), f, handler, endFlow)
-	flows[cr.SocketId()] = handler
+	running.Add(1)
+	go func() {
+		defer running.Done()
+		handleFlow(flowCtx, cr.SocketId(), f, out, handler, endFlow)
+	}()
+	com.HandleSocket(cr.SocketId(), handler)
 }
 
-func handleMeasure(m ipc.MeasureMsg) {
-	if handler, ok := flows[m.SocketId()]; !ok {
-		log.WithFields(log.Fields{
-			"flowid": m.SocketId(),
-			"msg":    "measure",
-		}).Warn("Unknown flow")
-		return
-	} else {
-		handler.flowMeasureCh <- m
+// packet size of datapaths which do not say theirs
+func defaultPktSize() uint32 {
+	switch dp {
+	case ipc.NETLINK:
+		return 1460
+	default:
+		return 1462
 	}
 }
 
-func handleDrop(dr ipc.DropMsg) {
-	if handler, ok := flows[dr.SocketId()]; !ok {
+func handleClose(cl ipc.CloseMsg) {
+	log.WithFields(log.Fields{
+		"flowid": cl.SocketId(),
+	}).Info("handleClose")
+
+	if handler, ok := lookupFlow(cl.SocketId()); !ok {
 		log.WithFields(log.Fields{
-			"flowid": dr.SocketId(),
-			"msg":    "drop",
+			"flowid": cl.SocketId(),
+			"msg":    "close",
 		}).Warn("Unknown flow")
 		return
 	} else {
-		handler.flowDropCh <- dr
+		com.HandleSocket(cl.SocketId(), nil)
+		handler.cancel()
 	}
 }
 
 func handleFlowEnd(sid uint32) {
-	delete(flows, sid)
+	handler, ok := lookupFlow(sid)
+	if !ok {
+		return
+	}
+
+	select {
+	case <-handler.done:
+		com.HandleSocket(sid, nil)
+		com.Forget(sid)
+	default:
+		// a new flow reused the socket id since this one went idle
+	}
 }
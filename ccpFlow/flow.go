@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"time"
 
+	"ccp/ccpFlow/pattern"
 	"ccp/ipc"
 )
 
@@ -19,6 +20,81 @@ type Measurement struct {
 	Rin  uint64
 	Rout uint64
 	Loss uint32
+
+	// the rest are zero if the datapath does not report them
+	// smallest rtt sample over the report interval
+	MinRtt time.Duration
+	// bytes delivered over the flow's lifetime
+	Delivered uint64
+	// bytes sent and not yet acknowledged or declared lost
+	Inflight uint64
+	// bytes delivered with an ECN mark over the flow's lifetime
+	Ecn uint64
+	// bytes selectively acknowledged above Ack
+	Sacked uint64
+	// when the datapath took the measurement, on its own clock
+	Timestamp time.Duration
+	// the statistics the flow asked the datapath to aggregate
+	// since the last measurement
+	Agg ipc.Aggregates
+}
+
+// MeasurementFromMsg unpacks a MEASURE message from the datapath
+func MeasurementFromMsg(m ipc.MeasureMsg) Measurement {
+	ext := m.Ext()
+	return Measurement{
+		Ack:       m.AckNo(),
+		Rtt:       m.Rtt(),
+		Rin:       m.Rin(),
+		Rout:      m.Rout(),
+		Loss:      m.Loss(),
+		MinRtt:    ext.MinRtt,
+		Delivered: ext.Delivered,
+		Inflight:  ext.Inflight,
+		Ecn:       ext.Ecn,
+		Sacked:    ext.Sacked,
+		Timestamp: ext.Timestamp,
+		Agg:       ext.Agg,
+	}
+}
+
+// DatapathInfo is what the datapath supports, as it said when creating the flow
+type DatapathInfo struct {
+	// the pattern events the datapath can run
+	Events pattern.EventSet
+	// the optional Measurement fields the datapath fills in
+	Fields ipc.MeasureField
+	// the time the datapath runs in, if not the wall clock's,
+	// as in the simulator
+	Clock Clock
+}
+
+// Clock tells a flow the time, so it can run in a datapath's virtual time
+type Clock interface {
+	Now() time.Time
+}
+
+// Now is the datapath's time; flows use it instead of time.Now
+func (d DatapathInfo) Now() time.Time {
+	if d.Clock == nil {
+		return time.Now()
+	}
+
+	return d.Clock.Now()
+}
+
+// Since is the datapath's time elapsed since t
+func (d DatapathInfo) Since(t time.Time) time.Duration {
+	return d.Now().Sub(t)
+}
+
+// DatapathInfoFromMsg unpacks what a CREATE message says about the datapath
+func DatapathInfoFromMsg(c ipc.CreateMsg) DatapathInfo {
+	info := c.Info()
+	return DatapathInfo{
+		Events: info.Events,
+		Fields: info.Fields,
+	}
 }
 
 type Flow interface {
@@ -31,6 +107,7 @@ type Flow interface {
 		pktsz uint32,
 		startSeq uint32,
 		initCwnd uint32,
+		dp DatapathInfo,
 	)
 	// Measurement: callback for when a specified measurement is received
 	GotMeasurement(m Measurement)
@@ -38,6 +115,36 @@ type Flow interface {
 	Drop(event DropEvent)
 }
 
+// Closer is optionally implemented by a Flow which holds state
+// to release when the datapath closes the socket.
+type Closer interface {
+	Close()
+}
+
+// Handoff is what the CCP carries over when it switches a live flow
+// from one algorithm to another.
+type Handoff struct {
+	// congestion window, bytes
+	Cwnd uint32
+	Rtt  time.Duration
+	// last acked sequence number
+	Ack uint32
+}
+
+// Handoffer is optionally implemented by a Flow which can report its
+// current window, so that switching algorithms does not reset it.
+type Handoffer interface {
+	Handoff() Handoff
+}
+
+// Resumer is optionally implemented by a Flow which can use the rest of
+// a Handoff. When switching a flow to this algorithm, the CCP calls
+// Create with the carried over window and ack number, then Resume,
+// before passing on any further measurements.
+type Resumer interface {
+	Resume(h Handoff)
+}
+
 // name of flow to function which returns blank instance
 var protocolRegistry map[string]func() Flow
 
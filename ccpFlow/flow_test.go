@@ -18,6 +18,7 @@ func (t *TestFlow) Create(
 	stSq uint32,
 	pktsz uint32,
 	startCwnd uint32,
+	dp DatapathInfo,
 ) {
 	return
 }
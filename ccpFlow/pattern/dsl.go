@@ -0,0 +1,392 @@
+package pattern
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* A textual syntax for patterns, for logs and tests:
+ *
+ *     cwnd 14600; ackincr 1460; wait 0.5rtt; report
+ *     rate 1.25e+06; repeat 4 { rate x0.75; wait 10ms }; if loss { cwnd x0.5 }
+ *
+ * Statements are separated by ';', and map to events one to one:
+ *
+ *     cwnd <bytes>          SETCWNDABS
+ *     cwnd x<factor>        SETCWNDREL
+ *     rate <bytes/s>        SETRATEABS
+ *     rate x<factor>        SETRATEREL
+ *     wait <duration>       WAITABS, in time.ParseDuration's syntax
+ *     wait <factor>rtt      WAITREL
+ *     report                REPORT
+ *     ackincr <bytes>       ACKINCR
+ *     repeat <n> { ... }    REPEAT
+ *     if loss { ... }       IF LOSS, likewise noloss
+ *     if rtt > <duration> { ... }
+ *
+ * Parse(p.String()) gives back p's events. A block whose Len runs past the
+ * end of the sequence prints with a "missing <n>" statement in place of the
+ * events it lacks, which Parse rejects rather than reading a shorter block.
+ */
+
+func (p *Pattern) String() string {
+	var b strings.Builder
+	writeSequence(&b, p.Sequence)
+	return b.String()
+}
+
+// String prints a single statement. A block's events follow it in the
+// sequence, so it prints as an empty block.
+func (ev PatternEvent) String() string {
+	var b strings.Builder
+	writeEvent(&b, ev)
+	if ev.Type == REPEAT || ev.Type == IF {
+		b.WriteString("{}")
+	}
+
+	return b.String()
+}
+
+func writeSequence(b *strings.Builder, seq []PatternEvent) {
+	for i := 0; i < len(seq); i++ {
+		if i > 0 {
+			b.WriteString("; ")
+		}
+
+		ev := seq[i]
+		writeEvent(b, ev)
+		if ev.Type != REPEAT && ev.Type != IF {
+			continue
+		}
+
+		end := i + 1 + int(ev.Len)
+		missing := 0
+		if end > len(seq) {
+			missing = end - len(seq)
+			end = len(seq)
+		}
+
+		b.WriteString("{ ")
+		writeSequence(b, seq[i+1:end])
+		if missing > 0 {
+			if end > i+1 {
+				b.WriteString("; ")
+			}
+
+			fmt.Fprintf(b, "missing %d", missing)
+		}
+
+		b.WriteString(" }")
+		i = end - 1
+	}
+}
+
+func writeEvent(b *strings.Builder, ev PatternEvent) {
+	switch ev.Type {
+	case SETCWNDABS:
+		fmt.Fprintf(b, "cwnd %d", ev.Cwnd)
+	case SETCWNDREL:
+		fmt.Fprintf(b, "cwnd x%s", formatFloat(ev.Factor))
+	case SETRATEABS:
+		fmt.Fprintf(b, "rate %s", formatFloat(ev.Rate))
+	case SETRATEREL:
+		fmt.Fprintf(b, "rate x%s", formatFloat(ev.Factor))
+	case WAITABS:
+		fmt.Fprintf(b, "wait %v", ev.Duration)
+	case WAITREL:
+		fmt.Fprintf(b, "wait %srtt", formatFloat(ev.Factor))
+	case REPORT:
+		b.WriteString("report")
+	case ACKINCR:
+		fmt.Fprintf(b, "ackincr %d", ev.Cwnd)
+	case REPEAT:
+		fmt.Fprintf(b, "repeat %d ", ev.Count)
+	case IF:
+		switch ev.Cond {
+		case LOSS:
+			b.WriteString("if loss ")
+		case NOLOSS:
+			b.WriteString("if noloss ")
+		case RTTABOVE:
+			fmt.Fprintf(b, "if rtt > %v ", ev.Duration)
+		default:
+			fmt.Fprintf(b, "if cond%d ", ev.Cond)
+		}
+	default:
+		fmt.Fprintf(b, "event%d", ev.Type)
+	}
+}
+
+// the shortest form which parses back to the same float32
+func formatFloat(f float32) string {
+	return strconv.FormatFloat(float64(f), 'g', -1, 32)
+}
+
+// Parse reads a pattern in the syntax String prints, and compiles it
+func Parse(s string) (*Pattern, error) {
+	ps := &parser{toks: tokenize(s)}
+	p, err := ps.sequence()
+	if err != nil {
+		return nil, err
+	}
+
+	if !ps.done() {
+		return nil, ps.errorf("unexpected %q", ps.peek())
+	}
+
+	return p.Compile()
+}
+
+// words, and each of ; { } > on its own
+func tokenize(s string) []string {
+	var toks []string
+	word := strings.Builder{}
+	flush := func() {
+		if word.Len() > 0 {
+			toks = append(toks, word.String())
+			word.Reset()
+		}
+	}
+
+	for _, r := range s {
+		switch {
+		case strings.ContainsRune(";{}>", r):
+			flush()
+			toks = append(toks, string(r))
+		case r == ' ' || r == '\t' || r == '\n' || r == '\r':
+			flush()
+		default:
+			word.WriteRune(r)
+		}
+	}
+
+	flush()
+	return toks
+}
+
+type parser struct {
+	toks []string
+	pos  int
+}
+
+func (ps *parser) done() bool {
+	return ps.pos >= len(ps.toks)
+}
+
+func (ps *parser) peek() string {
+	if ps.done() {
+		return ""
+	}
+
+	return ps.toks[ps.pos]
+}
+
+func (ps *parser) next() (string, error) {
+	if ps.done() {
+		return "", ps.errorf("unexpected end of pattern")
+	}
+
+	t := ps.toks[ps.pos]
+	ps.pos++
+	return t, nil
+}
+
+func (ps *parser) expect(tok string) error {
+	t, err := ps.next()
+	if err != nil {
+		return err
+	} else if t != tok {
+		return ps.errorf("expected %q, got %q", tok, t)
+	}
+
+	return nil
+}
+
+func (ps *parser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("pattern: token %d: %s", ps.pos, fmt.Sprintf(format, args...))
+}
+
+// statements up to the end of the input or of the enclosing block
+func (ps *parser) sequence() (*Pattern, error) {
+	p := NewPattern()
+	for !ps.done() && ps.peek() != "}" {
+		if ps.peek() == ";" {
+			ps.pos++
+			continue
+		}
+
+		err := ps.statement(p)
+		if err != nil {
+			return nil, err
+		}
+
+		if p.err != nil {
+			return nil, ps.errorf("%v", p.err)
+		}
+
+		switch ps.peek() {
+		case "", ";", "}":
+		default:
+			return nil, ps.errorf("expected \";\", got %q", ps.peek())
+		}
+	}
+
+	return p, nil
+}
+
+func (ps *parser) block() (*Pattern, error) {
+	if err := ps.expect("{"); err != nil {
+		return nil, err
+	}
+
+	body, err := ps.sequence()
+	if err != nil {
+		return nil, err
+	}
+
+	return body, ps.expect("}")
+}
+
+func (ps *parser) statement(p *Pattern) error {
+	kw, err := ps.next()
+	if err != nil {
+		return err
+	}
+
+	if kw == "report" {
+		p.Report()
+		return nil
+	}
+
+	arg, err := ps.next()
+	if err != nil {
+		return err
+	}
+
+	switch kw {
+	case "cwnd":
+		if strings.HasPrefix(arg, "x") {
+			f, err := ps.float(arg[1:])
+			p.RelativeCwnd(f)
+			return err
+		}
+
+		c, err := ps.uint(arg)
+		p.Cwnd(c)
+		return err
+	case "rate":
+		if strings.HasPrefix(arg, "x") {
+			f, err := ps.float(arg[1:])
+			p.RelativeRate(f)
+			return err
+		}
+
+		r, err := ps.float(arg)
+		p.Rate(r)
+		return err
+	case "wait":
+		if strings.HasSuffix(arg, "rtt") {
+			f, err := ps.float(strings.TrimSuffix(arg, "rtt"))
+			p.WaitRtts(f)
+			return err
+		}
+
+		d, err := ps.duration(arg)
+		p.Wait(d)
+		return err
+	case "ackincr":
+		inc, err := ps.uint(arg)
+		p.AckIncrease(inc)
+		return err
+	case "repeat":
+		n, err := ps.uint(arg)
+		if err != nil {
+			return err
+		}
+
+		body, err := ps.block()
+		if err != nil {
+			return err
+		}
+
+		p.Repeat(n, body)
+		return nil
+	case "if":
+		return ps.cond(p, arg)
+	case "missing":
+		return ps.errorf("block is missing %s events", arg)
+	default:
+		return ps.errorf("unknown statement %q", kw)
+	}
+}
+
+func (ps *parser) cond(p *Pattern, arg string) error {
+	var cond Condition
+	var threshold time.Duration
+	switch arg {
+	case "loss":
+		cond = LOSS
+	case "noloss":
+		cond = NOLOSS
+	case "rtt":
+		if err := ps.expect(">"); err != nil {
+			return err
+		}
+
+		t, err := ps.next()
+		if err != nil {
+			return err
+		}
+
+		threshold, err = ps.duration(t)
+		if err != nil {
+			return err
+		}
+
+		cond = RTTABOVE
+	default:
+		return ps.errorf("unknown condition %q", arg)
+	}
+
+	body, err := ps.block()
+	if err != nil {
+		return err
+	}
+
+	if cond == RTTABOVE {
+		p.IfRttAbove(threshold, body)
+	} else {
+		p.If(cond, body)
+	}
+
+	return nil
+}
+
+func (ps *parser) uint(s string) (uint32, error) {
+	v, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return 0, ps.errorf("bad number %q", s)
+	}
+
+	return uint32(v), nil
+}
+
+func (ps *parser) float(s string) (float32, error) {
+	v, err := strconv.ParseFloat(s, 32)
+	if err != nil {
+		return 0, ps.errorf("bad number %q", s)
+	}
+
+	return float32(v), nil
+}
+
+func (ps *parser) duration(s string) (time.Duration, error) {
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, ps.errorf("bad duration %q", s)
+	}
+
+	return d, nil
+}
@@ -0,0 +1,107 @@
+package pattern
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPrintParse(t *testing.T) {
+	for _, c := range []struct {
+		p   *Pattern
+		str string
+	}{
+		{
+			NewPattern().Cwnd(14600).WaitRtts(0.5).Report(),
+			"cwnd 14600; wait 0.5rtt; report",
+		},
+		{
+			NewPattern().Rate(1.25e6).Wait(10 * time.Millisecond).RelativeRate(0.75).Wait(1500 * time.Microsecond).Report(),
+			"rate 1.25e+06; wait 10ms; rate x0.75; wait 1.5ms; report",
+		},
+		{
+			NewPattern().
+				Cwnd(2920).
+				AckIncrease(1460).
+				Repeat(4, NewPattern().
+					If(LOSS, NewPattern().RelativeCwnd(0.5).AckIncrease(0)).
+					IfRttAbove(50*time.Millisecond, NewPattern().Cwnd(14600)).
+					WaitRtts(1.0)).
+				If(NOLOSS, NewPattern().Report()).
+				Wait(time.Hour),
+			"cwnd 2920; ackincr 1460; repeat 4 { if loss { cwnd x0.5; ackincr 0 }; if rtt > 50ms { cwnd 14600 }; wait 1rtt }; if noloss { report }; wait 1h0m0s",
+		},
+	} {
+		p, err := c.p.Compile()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if s := p.String(); s != c.str {
+			t.Errorf("printed\n%s\nexpected\n%s", s, c.str)
+			continue
+		}
+
+		parsed, err := Parse(c.str)
+		if err != nil {
+			t.Errorf("%s: %v", c.str, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(parsed.Sequence, p.Sequence) {
+			t.Errorf("%s: parsed\n%v\nexpected\n%v", c.str, parsed.Sequence, p.Sequence)
+		}
+	}
+}
+
+func TestPrintShortBlock(t *testing.T) {
+	p := &Pattern{Sequence: []PatternEvent{
+		{Type: SETCWNDABS, Cwnd: 14600},
+		{Type: REPEAT, Count: 2, Len: 3},
+		{Type: WAITREL, Factor: 1},
+	}}
+
+	s := p.String()
+	if s != "cwnd 14600; repeat 2 { wait 1rtt; missing 2 }" {
+		t.Errorf("got %q", s)
+	}
+
+	if _, err := Parse(s); err == nil {
+		t.Errorf("%q: expected an error", s)
+	}
+
+	p.Sequence = p.Sequence[:2]
+	if s := p.String(); s != "cwnd 14600; repeat 2 { missing 3 }" {
+		t.Errorf("got %q", s)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, s := range []string{
+		"cwnd",
+		"cwnd many; wait 1rtt",
+		"fly 3; wait 1rtt",
+		"cwnd 14600 wait 1rtt",
+		"repeat 2 { wait 1rtt",
+		"cwnd 14600; if maybe { report }",
+		"wait 1rtt; cwnd 14600 }",
+		// parses, but does not validate
+		"cwnd 14600; rate 0; wait 1rtt",
+	} {
+		if _, err := Parse(s); err == nil {
+			t.Errorf("%q: expected an error", s)
+		}
+	}
+
+	// extra whitespace and separators are fine
+	p, err := Parse(" cwnd 14600 ;; wait 0.5rtt;\n\treport; ")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if s := p.String(); s != "cwnd 14600; wait 0.5rtt; report" {
+		t.Errorf("got %q", s)
+	}
+}
@@ -19,14 +19,79 @@ const (
 	WAITABS
 	WAITREL
 	REPORT
+	// scale the congestion window by Factor
+	SETCWNDREL
+	// from now on, grow the congestion window by Cwnd bytes
+	// on every ack which acknowledges new data
+	ACKINCR
+	// run the Len events which follow Count times
+	REPEAT
+	// run the Len events which follow only if Cond holds
+	IF
 )
 
+// EventSet is a set of event types, such as those a datapath can run
+type EventSet uint32
+
+const (
+	// the events every datapath can run
+	BasicEvents EventSet = 1<<SETRATEABS | 1<<SETCWNDABS | 1<<SETRATEREL | 1<<WAITABS | 1<<WAITREL | 1<<REPORT
+	// the events of datapaths which can run control flow
+	ControlEvents EventSet = 1<<SETCWNDREL | 1<<ACKINCR | 1<<REPEAT | 1<<IF
+	AllEvents              = BasicEvents | ControlEvents
+)
+
+func Events(types ...PatternEventType) EventSet {
+	var s EventSet
+	for _, t := range types {
+		s |= 1 << t
+	}
+
+	return s
+}
+
+func (s EventSet) Has(t PatternEventType) bool {
+	return s&(1<<t) != 0
+}
+
+// Runs is whether every event in p is in the set
+func (s EventSet) Runs(p *Pattern) bool {
+	for _, ev := range p.Sequence {
+		if !s.Has(ev.Type) {
+			return false
+		}
+	}
+
+	return true
+}
+
+/* Conditions an IF can branch on, evaluated against what the datapath
+ * measured since it last reported.
+ */
+type Condition uint8
+
+const (
+	// a packet was lost
+	LOSS Condition = iota
+	// no packet was lost
+	NOLOSS
+	// the latest rtt sample is above Duration
+	RTTABOVE
+)
+
+/* REPEAT and IF open a block made of the Len events after them, so that
+ * a Sequence stays flat: blocks nest, and a block's Len counts the events
+ * of the blocks it contains.
+ */
 type PatternEvent struct {
 	Type     PatternEventType
 	Duration time.Duration
 	Cwnd     uint32
 	Rate     float32
 	Factor   float32
+	Count    uint32
+	Len      uint32
+	Cond     Condition
 }
 
 func NewPattern() *Pattern {
@@ -105,6 +170,87 @@ func (p *Pattern) WaitRtts(factor float32) *Pattern {
 	return p
 }
 
+func (p *Pattern) RelativeCwnd(factor float32) *Pattern {
+	if p.err != nil {
+		return p
+	}
+
+	p.Sequence = append(p.Sequence, PatternEvent{
+		Type:   SETCWNDREL,
+		Factor: factor,
+	})
+
+	return p
+}
+
+// AckIncrease grows the window by inc bytes per new ack, until another
+// AckIncrease changes it or the pattern is replaced.
+// Slow start is AckIncrease(mss).
+func (p *Pattern) AckIncrease(inc uint32) *Pattern {
+	if p.err != nil {
+		return p
+	}
+
+	p.Sequence = append(p.Sequence, PatternEvent{
+		Type: ACKINCR,
+		Cwnd: inc,
+	})
+
+	return p
+}
+
+// Repeat runs body's events count times
+func (p *Pattern) Repeat(count uint32, body *Pattern) *Pattern {
+	return p.block(PatternEvent{
+		Type:  REPEAT,
+		Count: count,
+	}, body)
+}
+
+// If runs body's events only when cond holds.
+// Use IfRttAbove for RTTABOVE.
+func (p *Pattern) If(cond Condition, body *Pattern) *Pattern {
+	if p.err == nil && cond == RTTABOVE {
+		p.err = fmt.Errorf("RTTABOVE needs a threshold, use IfRttAbove")
+		return p
+	}
+
+	return p.block(PatternEvent{
+		Type: IF,
+		Cond: cond,
+	}, body)
+}
+
+// IfRttAbove runs body's events only when the latest rtt is above rtt
+func (p *Pattern) IfRttAbove(rtt time.Duration, body *Pattern) *Pattern {
+	return p.block(PatternEvent{
+		Type:     IF,
+		Cond:     RTTABOVE,
+		Duration: rtt,
+	}, body)
+}
+
+func (p *Pattern) block(head PatternEvent, body *Pattern) *Pattern {
+	if p.err != nil {
+		return p
+	}
+
+	if body.err != nil {
+		p.err = body.err
+		return p
+	}
+
+	if len(body.Sequence) == 0 {
+		p.err = fmt.Errorf("empty block")
+		return p
+	}
+
+	head.Len = uint32(len(body.Sequence))
+	p.Sequence = append(p.Sequence, head)
+	p.Sequence = append(p.Sequence, body.Sequence...)
+	return p
+}
+
 func (p *Pattern) Report() *Pattern {
 	if p.err != nil {
 		return p
@@ -128,5 +274,9 @@ func (p *Pattern) Compile() (*Pattern, error) {
 		return nil, p.err
 	}
 
+	if err := p.Validate(0, 0); err != nil {
+		return nil, err
+	}
+
 	return p, nil
 }
@@ -18,3 +18,45 @@ func TestFactor(t *testing.T) {
         t.Errorf("incorrect pattern length %d", sqlen)
     }
 }
+
+func TestBlocks(t *testing.T) {
+    p, err := NewPattern().
+        Repeat(2, NewPattern().
+            If(LOSS, NewPattern().RelativeCwnd(0.5)).
+            WaitRtts(1.0)).
+        Report().
+        Compile()
+    if err != nil {
+        t.Error(err)
+        return
+    }
+
+    if sqlen := len(p.Sequence); sqlen != 5 {
+        t.Errorf("incorrect pattern length %d", sqlen)
+        return
+    }
+
+    if rep, cond := p.Sequence[0], p.Sequence[1]; rep.Len != 3 || cond.Len != 1 {
+        t.Errorf("incorrect block lengths %d, %d", rep.Len, cond.Len)
+        return
+    }
+
+    // a block running past the end of the sequence
+    p = NewPattern().Cwnd(42).WaitRtts(1.0)
+    p.Sequence = append(p.Sequence, PatternEvent{Type: REPEAT, Count: 2, Len: 3})
+    if _, err := p.Compile(); err == nil {
+        t.Error("expected error for an overrunning block")
+    }
+}
+
+func TestEventSet(t *testing.T) {
+    p := NewPattern().Cwnd(14600).AckIncrease(1460).WaitRtts(1.0)
+    if !AllEvents.Runs(p) || BasicEvents.Runs(p) {
+        t.Error("only datapaths with control events can run ACKINCR")
+    }
+
+    s := Events(SETCWNDABS, ACKINCR, WAITREL)
+    if !s.Runs(p) || s.Has(REPORT) || s|BasicEvents == BasicEvents {
+        t.Errorf("wrong event set %b", s)
+    }
+}
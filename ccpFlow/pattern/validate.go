@@ -0,0 +1,244 @@
+package pattern
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// Pattern validation, so that a pattern the datapath cannot encode or run
+// is rejected when it is compiled rather than misbehaving on the datapath.
+
+type Reason uint8
+
+const (
+	// the pattern never waits, so the datapath would spin running it
+	NoWait Reason = iota
+	// a rate, or a relative rate, of zero or less
+	BadRate
+	// a window below one packet
+	SmallCwnd
+	// a value which does not fit its unsigned 32 bit wire field
+	Overflow
+	// a rate or factor the legacy fixed-point encoding would change
+	Imprecise
+	// the encoded pattern does not fit in a message
+	TooLong
+	// a block which overruns its sequence, or its enclosing block
+	BadBlock
+	// an IF on an unknown condition
+	BadCondition
+	// a negative or infinite factor
+	BadFactor
+)
+
+func (r Reason) String() string {
+	switch r {
+	case NoWait:
+		return "pattern never waits"
+	case BadRate:
+		return "rate must be positive"
+	case SmallCwnd:
+		return "cwnd below one packet"
+	case Overflow:
+		return "value overflows its wire field"
+	case Imprecise:
+		return "value loses precision on the wire"
+	case TooLong:
+		return "pattern too long for a message"
+	case BadBlock:
+		return "block overruns its sequence"
+	case BadCondition:
+		return "unknown condition"
+	case BadFactor:
+		return "factor must be finite and not negative"
+	default:
+		return fmt.Sprintf("unknown reason %d", uint8(r))
+	}
+}
+
+// ValidationError says which event made a pattern invalid, and why.
+// Index is -1 when the pattern as a whole is at fault.
+type ValidationError struct {
+	Index  int
+	Event  PatternEvent
+	Reason Reason
+}
+
+func (e *ValidationError) Error() string {
+	if e.Index < 0 {
+		return e.Reason.String()
+	}
+
+	return fmt.Sprintf("event %d (%v): %v", e.Index, e.Event, e.Reason)
+}
+
+/* Validate checks that the datapath can encode and run the pattern,
+ * returning a *ValidationError for the first problem found.
+ * mss is the flow's packet size; with mss 0 only a zero window counts
+ * as below one packet. maxSize is the most bytes of events a message to
+ * the datapath carries, which depends on the framing it speaks; 0 if
+ * that is not known yet.
+ */
+func (p *Pattern) Validate(mss uint32, maxSize int) error {
+	if mss == 0 {
+		mss = 1
+	}
+
+	if err := checkBlocks(p.Sequence); err != nil {
+		return err
+	}
+
+	for i, ev := range p.Sequence {
+		if r, ok := checkEvent(ev, mss); !ok {
+			return &ValidationError{Index: i, Event: ev, Reason: r}
+		}
+	}
+
+	if !waits(p.Sequence) {
+		return &ValidationError{Index: -1, Reason: NoWait}
+	}
+
+	if maxSize > 0 && p.EncodedSize() > maxSize {
+		return &ValidationError{Index: -1, Reason: TooLong}
+	}
+
+	return nil
+}
+
+func checkEvent(ev PatternEvent, mss uint32) (Reason, bool) {
+	switch ev.Type {
+	case SETRATEABS:
+		if !(ev.Rate > 0) || math.IsInf(float64(ev.Rate), 1) {
+			return BadRate, false
+		}
+	case SETCWNDABS:
+		if ev.Cwnd < mss {
+			return SmallCwnd, false
+		}
+	case SETRATEREL:
+		if !(ev.Factor > 0) {
+			return BadRate, false
+		}
+
+		return checkFactor(ev.Factor)
+	case SETCWNDREL, WAITREL:
+		return checkFactor(ev.Factor)
+	case WAITABS:
+		return checkMicros(ev.Duration)
+	case IF:
+		switch ev.Cond {
+		case LOSS, NOLOSS:
+		case RTTABOVE:
+			return checkMicros(ev.Duration)
+		default:
+			return BadCondition, false
+		}
+	}
+
+	return 0, true
+}
+
+func checkFactor(f float32) (Reason, bool) {
+	if !(f >= 0) || math.IsInf(float64(f), 1) {
+		return BadFactor, false
+	}
+
+	return 0, true
+}
+
+func checkMicros(d time.Duration) (Reason, bool) {
+	if d < 0 || d/time.Microsecond > math.MaxUint32 {
+		return Overflow, false
+	}
+
+	return 0, true
+}
+
+// every block must end within the sequence, and within its enclosing block.
+// one pass, keeping the ends of the blocks around the current event.
+func checkBlocks(seq []PatternEvent) error {
+	var ends []int
+	for i, ev := range seq {
+		for len(ends) > 0 && ends[len(ends)-1] <= i {
+			ends = ends[:len(ends)-1]
+		}
+
+		if ev.Type != REPEAT && ev.Type != IF {
+			continue
+		}
+
+		limit := len(seq)
+		if len(ends) > 0 {
+			limit = ends[len(ends)-1]
+		}
+
+		end := i + 1 + int(ev.Len)
+		if ev.Len == 0 || end > limit {
+			return &ValidationError{Index: i, Event: ev, Reason: BadBlock}
+		}
+
+		ends = append(ends, end)
+	}
+
+	return nil
+}
+
+// whether every pass through seq is sure to wait:
+// waits inside an IF, or a REPEAT which runs no times, do not count
+func waits(seq []PatternEvent) bool {
+	for i := 0; i < len(seq); i++ {
+		ev := seq[i]
+		switch ev.Type {
+		case WAITABS:
+			if ev.Duration > 0 {
+				return true
+			}
+		case WAITREL:
+			if ev.Factor > 0 {
+				return true
+			}
+		case REPORT:
+			return true
+		case REPEAT:
+			if ev.Count > 0 && waits(seq[i+1:i+1+int(ev.Len)]) {
+				return true
+			}
+
+			i += int(ev.Len)
+		case IF:
+			i += int(ev.Len)
+		}
+	}
+
+	return false
+}
+
+// WireValues is how many 32 bit values an event of type t carries in a
+// PATTERN message, after its type and length bytes
+func WireValues(t PatternEventType) (int, bool) {
+	switch t {
+	case REPORT:
+		return 0, true
+	case SETRATEABS, SETCWNDABS, SETRATEREL, WAITABS, WAITREL, SETCWNDREL, ACKINCR:
+		return 1, true
+	case REPEAT:
+		return 2, true
+	case IF:
+		return 3, true
+	default:
+		return 0, false
+	}
+}
+
+// EncodedSize is the number of bytes the pattern's events take in a
+// PATTERN message
+func (p *Pattern) EncodedSize() int {
+	size := 0
+	for _, ev := range p.Sequence {
+		n, _ := WireValues(ev.Type)
+		size += 2 + 4*n
+	}
+
+	return size
+}
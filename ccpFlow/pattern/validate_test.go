@@ -0,0 +1,78 @@
+package pattern
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// bytes of events a message carries
+const testMaxSize = 2048
+
+func TestValidate(t *testing.T) {
+	long := NewPattern()
+	for k := 0; k < testMaxSize/12+1; k++ {
+		long = long.Cwnd(14600).Wait(time.Millisecond)
+	}
+
+	for _, c := range []struct {
+		name   string
+		p      *Pattern
+		index  int
+		reason Reason
+	}{
+		{"no wait", NewPattern().Cwnd(14600).Rate(1e6), -1, NoWait},
+		{"zero wait", NewPattern().Cwnd(14600).WaitRtts(0), -1, NoWait},
+		{"wait only in a branch", NewPattern().Cwnd(14600).If(LOSS, NewPattern().WaitRtts(1.0)), -1, NoWait},
+		{"zero rate", NewPattern().Rate(0).WaitRtts(1.0), 0, BadRate},
+		{"negative relative rate", NewPattern().Cwnd(14600).RelativeRate(-1).WaitRtts(1.0), 1, BadRate},
+		{"small cwnd", NewPattern().Cwnd(1000).WaitRtts(1.0), 0, SmallCwnd},
+		{"infinite rate", NewPattern().Rate(float32(math.Inf(1))).WaitRtts(1.0), 0, BadRate},
+		{"wait overflow", NewPattern().Cwnd(14600).Wait(2 * time.Hour), 1, Overflow},
+		{"negative factor", NewPattern().Cwnd(14600).RelativeCwnd(-0.5).WaitRtts(1.0), 1, BadFactor},
+		{"infinite factor", NewPattern().Cwnd(14600).WaitRtts(float32(math.Inf(1))), 1, BadFactor},
+		{"too long", long, -1, TooLong},
+		{"bad condition", NewPattern().Cwnd(14600).If(Condition(42), NewPattern().RelativeCwnd(0.5)).WaitRtts(1.0), 1, BadCondition},
+		{"block past its enclosing block", &Pattern{Sequence: []PatternEvent{
+			{Type: REPEAT, Count: 2, Len: 1},
+			{Type: REPEAT, Count: 2, Len: 1},
+			{Type: WAITREL, Factor: 1},
+		}}, 1, BadBlock},
+		{"block past the end", &Pattern{Sequence: []PatternEvent{
+			{Type: WAITREL, Factor: 1},
+			{Type: IF, Cond: LOSS, Len: 2},
+			{Type: REPORT},
+		}}, 1, BadBlock},
+	} {
+		err := c.p.Validate(1460, testMaxSize)
+		verr, ok := err.(*ValidationError)
+		if !ok {
+			t.Errorf("%s: expected a validation error, got %v", c.name, err)
+			continue
+		}
+
+		if verr.Index != c.index || verr.Reason != c.reason {
+			t.Errorf("%s: expected event %d: %v, got %v", c.name, c.index, c.reason, verr)
+		}
+	}
+
+	p := NewPattern().
+		Cwnd(14600).
+		Repeat(2, NewPattern().RelativeCwnd(0.5).WaitRtts(0.1)).
+		Report()
+	if err := p.Validate(1460, testMaxSize); err != nil {
+		t.Error(err)
+	}
+}
+
+// checking blocks must not take time exponential in how deeply they nest
+func TestValidateDeep(t *testing.T) {
+	p := NewPattern().Cwnd(14600).WaitRtts(1.0)
+	for k := 0; k < 100; k++ {
+		p = NewPattern().Repeat(1, p)
+	}
+
+	if err := p.Validate(1460, testMaxSize); err != nil {
+		t.Error(err)
+	}
+}
@@ -36,6 +36,7 @@ type Compound struct {
 
 	sockid     uint32
 	ipc        ipc.SendOnly
+	dp         ccpFlow.DatapathInfo // whose clock the flow runs on
 	baseRTT    float32
 	alpha      float32
 	beta       float32
@@ -58,8 +59,10 @@ func (c *Compound) Create(
 	pktsz uint32,
 	startSeq uint32,
 	startCwnd uint32,
+	dp ccpFlow.DatapathInfo,
 ) {
 	c.sockid = socketid
+	c.dp = dp
 	c.ipc = send
 	c.pktSize = pktsz
 	c.initCwnd = float32(pktsz * 10)
@@ -82,7 +85,7 @@ func (c *Compound) Create(
 	c.gamma_low = 5
 	c.gamma_high = 30
 	c.diff_reno = -1
-	c.lastDrop = time.Now()
+	c.lastDrop = c.dp.Now()
 	c.newPattern()
 }
 
@@ -232,6 +235,18 @@ func (c *Compound) newPattern() {
 	}
 }
 
+func (c *Compound) Handoff() ccpFlow.Handoff {
+	return ccpFlow.Handoff{
+		Cwnd: uint32(c.wnd),
+		Ack:  c.lastAck,
+	}
+}
+
+// the carried over rtt bounds the base rtt until compound measures a lower one
+func (c *Compound) Resume(h ccpFlow.Handoff) {
+	c.baseRTT = float32(h.Rtt.Seconds())
+}
+
 func Init() {
 	ccpFlow.Register("compound", func() ccpFlow.Flow {
 		return &Compound{}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+
+	"ccp/ctl"
+)
+
+const usage = `usage: ccpctl [-sock path] <command>
+
+commands:
+  list                        list active flows and their algorithms
+  dump <flow>                 show the state of a flow
+  switch <flow> <alg>         switch a flow to another registered algorithm
+  defaults [-congAlg alg] [-initCwnd pkts]
+                              show or change the defaults for new flows
+`
+
+var sock = flag.String("sock", ctl.DefaultPath, "the ccp's control socket")
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+	}
+	flag.Parse()
+
+	req, err := parseRequest(flag.Args())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	resp, err := ctl.Call(*sock, req)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if resp.Err != "" {
+		fmt.Fprintln(os.Stderr, resp.Err)
+		os.Exit(1)
+	}
+
+	printResponse(req, resp)
+}
+
+func parseRequest(args []string) (req ctl.Request, err error) {
+	if len(args) == 0 {
+		return req, fmt.Errorf("missing command")
+	}
+
+	req.Cmd = ctl.Command(args[0])
+	args = args[1:]
+	switch req.Cmd {
+	case ctl.List:
+		if len(args) != 0 {
+			return req, fmt.Errorf("list takes no arguments")
+		}
+	case ctl.Dump:
+		if len(args) != 1 {
+			return req, fmt.Errorf("dump takes a flow id")
+		}
+
+		req.Flow, err = parseFlow(args[0])
+	case ctl.Switch:
+		if len(args) != 2 {
+			return req, fmt.Errorf("switch takes a flow id and an algorithm")
+		}
+
+		req.Flow, err = parseFlow(args[0])
+		req.Alg = args[1]
+	case ctl.Defaults:
+		fs := flag.NewFlagSet("defaults", flag.ContinueOnError)
+		alg := fs.String("congAlg", "", "algorithm overriding the datapath's request, or nil to stop overriding")
+		cwnd := fs.Uint("initCwnd", 0, "initial congestion window in packets")
+		err = fs.Parse(args)
+		req.Alg = *alg
+		req.InitCwnd = uint32(*cwnd)
+	default:
+		return req, fmt.Errorf("unknown command %q", req.Cmd)
+	}
+
+	return
+}
+
+func parseFlow(s string) (uint32, error) {
+	sid, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("bad flow id %q: %v", s, err)
+	}
+
+	return uint32(sid), nil
+}
+
+func printResponse(req ctl.Request, resp ctl.Response) {
+	switch req.Cmd {
+	case ctl.List, ctl.Switch:
+		for _, f := range resp.Flows {
+			fmt.Printf("%d\t%s\n", f.Flow, f.Alg)
+		}
+	case ctl.Dump:
+		out, _ := json.MarshalIndent(resp.State, "", "  ")
+		fmt.Println(string(out))
+	case ctl.Defaults:
+		fmt.Printf("congAlg\t%s\ninitCwnd\t%d\n", resp.Defaults.CongAlg, resp.Defaults.InitCwnd)
+	}
+}
@@ -0,0 +1,220 @@
+package ctl
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"ccp/ipcBackend"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/* Admin protocol for a running CCP.
+ * A client connects to the CCP's unix stream socket and writes one JSON
+ * Request per line; the CCP answers each with one JSON Response per line.
+ */
+
+// beside the CCP's ipc sockets, so each namespace has its own
+var DefaultPath = ipcbackend.AddressForSend("ctl", 0)
+
+type Command string
+
+const (
+	// list active flows and their algorithms
+	List Command = "list"
+	// dump the state of one flow
+	Dump Command = "dump"
+	// switch one flow to another registered algorithm
+	Switch Command = "switch"
+	// show, and optionally change, the defaults for new flows
+	Defaults Command = "defaults"
+)
+
+type Request struct {
+	Cmd  Command `json:"cmd"`
+	Flow uint32  `json:"flow,omitempty"`
+	// Switch: the algorithm to switch to
+	// Defaults: the algorithm overriding the datapath's request,
+	// "nil" to stop overriding, or empty to leave unchanged
+	Alg string `json:"alg,omitempty"`
+	// Defaults: initial congestion window in packets, or 0 to leave unchanged
+	InitCwnd uint32 `json:"initCwnd,omitempty"`
+}
+
+type FlowInfo struct {
+	Flow uint32 `json:"flow"`
+	Alg  string `json:"alg"`
+}
+
+type FlowState struct {
+	FlowInfo
+	Created time.Time `json:"created"`
+	// when the datapath last sent a measurement or drop for this flow
+	LastMsg      time.Time `json:"lastMsg"`
+	Measurements uint64    `json:"measurements"`
+	Drops        uint64    `json:"drops"`
+
+	// the most recent measurement
+	Ack  uint32        `json:"ack"`
+	Rtt  time.Duration `json:"rtt"`
+	Rin  uint64        `json:"rin"`
+	Rout uint64        `json:"rout"`
+	Loss uint32        `json:"loss"`
+
+	// extended fields, zero if the datapath does not report them
+	MinRtt    time.Duration `json:"minRtt,omitempty"`
+	Delivered uint64        `json:"delivered,omitempty"`
+	Inflight  uint64        `json:"inflight,omitempty"`
+	Ecn       uint64        `json:"ecn,omitempty"`
+	Sacked    uint64        `json:"sacked,omitempty"`
+
+	// the algorithm's congestion window in bytes, if it reports one
+	Cwnd uint32 `json:"cwnd,omitempty"`
+	// the latest pattern the algorithm sent, in pattern.Parse's syntax
+	Pattern string `json:"pattern,omitempty"`
+}
+
+type DefaultsInfo struct {
+	CongAlg  string `json:"congAlg"`
+	InitCwnd uint32 `json:"initCwnd"`
+}
+
+type Response struct {
+	Err      string        `json:"err,omitempty"`
+	Flows    []FlowInfo    `json:"flows,omitempty"`
+	State    *FlowState    `json:"state,omitempty"`
+	Defaults *DefaultsInfo `json:"defaults,omitempty"`
+}
+
+func Errorf(format string, a ...interface{}) Response {
+	return Response{Err: fmt.Sprintf(format, a...)}
+}
+
+type Server struct {
+	path string
+	ln   net.Listener
+
+	mux    sync.Mutex
+	closed bool
+	conns  map[net.Conn]struct{}
+	wg     sync.WaitGroup
+}
+
+// Listen replaces any stale socket file at path and listens on it
+func Listen(path string) (*Server, error) {
+	if err := ipcbackend.Claim(path); err != nil {
+		return nil, err
+	}
+
+	os.RemoveAll(path)
+	ln, err := net.Listen("unix", path)
+	if err == nil {
+		err = ipcbackend.SetPerm(path)
+	}
+
+	if err != nil {
+		if ln != nil {
+			ln.Close()
+		}
+
+		ipcbackend.ReleaseListen(path)
+		return nil, err
+	}
+
+	return &Server{
+		path:  path,
+		ln:    ln,
+		conns: make(map[net.Conn]struct{}),
+	}, nil
+}
+
+// Serve answers requests with handle until Close.
+// handle is called from one goroutine per client connection.
+func (s *Server) Serve(handle func(Request) Response) {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+
+		s.mux.Lock()
+		if s.closed {
+			s.mux.Unlock()
+			conn.Close()
+			return
+		}
+
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.mux.Unlock()
+
+		go s.serveConn(conn, handle)
+	}
+}
+
+func (s *Server) serveConn(conn net.Conn, handle func(Request) Response) {
+	defer func() {
+		s.mux.Lock()
+		delete(s.conns, conn)
+		s.mux.Unlock()
+		conn.Close()
+		s.wg.Done()
+	}()
+
+	dec := json.NewDecoder(bufio.NewReader(conn))
+	enc := json.NewEncoder(conn)
+	for {
+		var req Request
+		err := dec.Decode(&req)
+		if err != nil {
+			return
+		}
+
+		err = enc.Encode(handle(req))
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Warn("failed to write control response")
+			return
+		}
+	}
+}
+
+// Close stops accepting, disconnects clients and removes the socket file
+func (s *Server) Close() error {
+	err := s.ln.Close()
+
+	s.mux.Lock()
+	s.closed = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mux.Unlock()
+
+	s.wg.Wait()
+	ipcbackend.ReleaseListen(s.path)
+	return err
+}
+
+// Call sends one request to the CCP listening at path
+func Call(path string, req Request) (Response, error) {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return Response{}, err
+	}
+	defer conn.Close()
+
+	err = json.NewEncoder(conn).Encode(req)
+	if err != nil {
+		return Response{}, err
+	}
+
+	var resp Response
+	err = json.NewDecoder(conn).Decode(&resp)
+	return resp, err
+}
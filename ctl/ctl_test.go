@@ -0,0 +1,57 @@
+package ctl
+
+import (
+	"os"
+	"testing"
+)
+
+const testPath = "/tmp/ccp-ctl-test"
+
+func TestCall(t *testing.T) {
+	srv, err := Listen(testPath)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	go srv.Serve(func(req Request) Response {
+		if req.Cmd != Switch {
+			return Errorf("unexpected command %q", req.Cmd)
+		}
+
+		return Response{Flows: []FlowInfo{{Flow: req.Flow, Alg: req.Alg}}}
+	})
+
+	resp, err := Call(testPath, Request{Cmd: Switch, Flow: 4, Alg: "vegas"})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if resp.Err != "" || len(resp.Flows) != 1 || resp.Flows[0] != (FlowInfo{Flow: 4, Alg: "vegas"}) {
+		t.Error("wrong response", resp)
+	}
+
+	resp, err = Call(testPath, Request{Cmd: List})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if resp.Err != `unexpected command "list"` {
+		t.Error("wrong error", resp.Err)
+	}
+
+	err = srv.Close()
+	if err != nil {
+		t.Error(err)
+	}
+
+	if _, err := os.Stat(testPath); !os.IsNotExist(err) {
+		t.Error("socket file left behind", err)
+	}
+
+	if _, err := Call(testPath, Request{Cmd: List}); err == nil {
+		t.Error("expected error calling a closed server")
+	}
+}
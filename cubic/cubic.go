@@ -24,6 +24,8 @@ type Cubic struct {
 	rtt      time.Duration
 	sockid   uint32
 	ipc      ipc.SendOnly
+	// whose clock the flow runs on
+	dp ccpFlow.DatapathInfo
 
 	//state for cubic
 	ssthresh         float64
@@ -52,8 +54,10 @@ func (c *Cubic) Create(
 	pktsz uint32,
 	startSeq uint32,
 	startCwnd uint32,
+	dp ccpFlow.DatapathInfo,
 ) {
 	c.sockid = socketid
+	c.dp = dp
 	c.pktSize = pktsz
 	c.lastAck = 0
 	c.ipc = send
@@ -62,7 +66,7 @@ func (c *Cubic) Create(
 	c.initCwnd = float64(10)
 	c.cwnd = float64(startCwnd)
 	c.ssthresh = (0x7fffffff / float64(pktsz))
-	c.lastDrop = time.Now()
+	c.lastDrop = c.dp.Now()
 	c.rtt = time.Duration(0)
 	// not sure about what this value should be
 	c.cwnd_cnt = 0
@@ -174,11 +178,11 @@ func (c *Cubic) GotMeasurement(m ccpFlow.Measurement) {
 }
 
 func (c *Cubic) Drop(ev ccpFlow.DropEvent) {
-	if time.Since(c.lastDrop) <= c.rtt {
+	if c.dp.Since(c.lastDrop) <= c.rtt {
 		return
 	}
 
-	c.lastDrop = time.Now()
+	c.lastDrop = c.dp.Now()
 
 	switch ev {
 	case ccpFlow.DupAck:
@@ -226,7 +230,7 @@ func (c *Cubic) Drop(ev ccpFlow.DropEvent) {
 func (c *Cubic) cubic_update() {
 	c.ack_cnt = c.ack_cnt + 1
 	if c.epoch_start <= 0 {
-		c.epoch_start = float64(time.Now().UnixNano() / 1e9)
+		c.epoch_start = float64(c.dp.Now().UnixNano() / 1e9)
 		if c.cwnd < c.Wlast_max {
 			c.K = math.Pow(math.Max(0.0, ((c.Wlast_max-c.cwnd)/c.C)), 1.0/3.0)
 			c.origin_point = c.Wlast_max
@@ -239,7 +243,7 @@ func (c *Cubic) cubic_update() {
 		c.Wtcp = c.cwnd
 	}
 
-	t := float64(time.Now().UnixNano()/1e9) + c.dMin - c.epoch_start
+	t := float64(c.dp.Now().UnixNano()/1e9) + c.dMin - c.epoch_start
 	target := c.origin_point + c.C*((t-c.K)*(t-c.K)*(t-c.K))
 	if target > c.cwnd {
 		c.cnt = c.cwnd / (target - c.cwnd)
@@ -273,6 +277,18 @@ func (c *Cubic) sendPattern(pattern *pattern.Pattern) {
 	}
 }
 
+func (c *Cubic) Handoff() ccpFlow.Handoff {
+	return ccpFlow.Handoff{
+		Cwnd: uint32(c.cwnd * float64(c.pktSize)),
+		Rtt:  c.rtt,
+		Ack:  c.lastAck,
+	}
+}
+
+func (c *Cubic) Resume(h ccpFlow.Handoff) {
+	c.rtt = h.Rtt
+}
+
 func Init() {
 	ccpFlow.Register("cubic", func() ccpFlow.Flow {
 		return &Cubic{}
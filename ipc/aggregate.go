@@ -0,0 +1,209 @@
+package ipc
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+/* Datapath-side aggregation.
+ * A flow's algorithm declares, with an AGGREGATE message, which statistics
+ * it wants folded over every ack between two reports. The datapath keeps
+ * them in an Aggregator and sends them with each MEASURE, so the algorithm
+ * can report rarely without losing what happened in between.
+ */
+
+type AggStat uint32
+
+const (
+	// moving average of the rtt samples, with the configured gain
+	AggEwmaRtt AggStat = 1 << iota
+	AggMinRtt
+	AggMaxRtt
+	// acks which acknowledged new data
+	AggAcks
+	AggBytesAcked
+	// packets detected lost
+	AggLost
+	// bytes acked with an ECN mark
+	AggEcn
+)
+
+// the ewma gain when a flow does not pick one
+const defaultEwmaGain = 0.125
+
+type AggregateConfig struct {
+	Stats AggStat
+	// weight of each new rtt sample in EwmaRtt; 0 means 1/8
+	Gain float32
+}
+
+// Aggregates over the acks since the previous report.
+// Only the statistics in Stats are filled in.
+type Aggregates struct {
+	Stats      AggStat
+	EwmaRtt    time.Duration
+	MinRtt     time.Duration
+	MaxRtt     time.Duration
+	Acks       uint32
+	BytesAcked uint64
+	Lost       uint32
+	Ecn        uint64
+}
+
+// Aggregating is implemented by SendOnlys whose datapath can aggregate
+type Aggregating interface {
+	SendAggregateMsg(socketId uint32, cfg AggregateConfig) error
+}
+
+// Aggregator folds a flow's acks on the datapath.
+// The zero value aggregates nothing.
+type Aggregator struct {
+	cfg AggregateConfig
+	cur Aggregates
+	// the average carries over from one report to the next
+	ewma time.Duration
+}
+
+func (a *Aggregator) Configure(cfg AggregateConfig) {
+	if !(cfg.Gain > 0 && cfg.Gain <= 1) {
+		cfg.Gain = defaultEwmaGain
+	}
+
+	a.cfg = cfg
+	a.cur = Aggregates{}
+}
+
+// Ack folds in an ack of bytes new bytes, with an rtt sample if rtt > 0
+func (a *Aggregator) Ack(rtt time.Duration, bytes uint64) {
+	if a.cfg.Stats == 0 {
+		return
+	}
+
+	if bytes > 0 {
+		a.cur.Acks++
+		a.cur.BytesAcked += bytes
+	}
+
+	if rtt <= 0 {
+		return
+	}
+
+	if a.ewma == 0 {
+		a.ewma = rtt
+	} else {
+		a.ewma += time.Duration(float64(a.cfg.Gain) * float64(rtt-a.ewma))
+	}
+
+	if a.cur.MinRtt == 0 || rtt < a.cur.MinRtt {
+		a.cur.MinRtt = rtt
+	}
+
+	if rtt > a.cur.MaxRtt {
+		a.cur.MaxRtt = rtt
+	}
+}
+
+func (a *Aggregator) Lost(pkts uint32) {
+	a.cur.Lost += pkts
+}
+
+func (a *Aggregator) Ecn(bytes uint64) {
+	a.cur.Ecn += bytes
+}
+
+// Report returns the statistics the flow asked for, and starts a new interval
+func (a *Aggregator) Report() Aggregates {
+	cur := a.cur
+	a.cur = Aggregates{}
+	if a.cfg.Stats == 0 {
+		return Aggregates{}
+	}
+
+	cur.EwmaRtt = a.ewma
+	return cur.only(a.cfg.Stats)
+}
+
+// zero all but the statistics in s
+func (g Aggregates) only(s AggStat) Aggregates {
+	out := Aggregates{Stats: s}
+	if s&AggEwmaRtt != 0 {
+		out.EwmaRtt = g.EwmaRtt
+	}
+
+	if s&AggMinRtt != 0 {
+		out.MinRtt = g.MinRtt
+	}
+
+	if s&AggMaxRtt != 0 {
+		out.MaxRtt = g.MaxRtt
+	}
+
+	if s&AggAcks != 0 {
+		out.Acks = g.Acks
+	}
+
+	if s&AggBytesAcked != 0 {
+		out.BytesAcked = g.BytesAcked
+	}
+
+	if s&AggLost != 0 {
+		out.Lost = g.Lost
+	}
+
+	if s&AggEcn != 0 {
+		out.Ecn = g.Ecn
+	}
+
+	return out
+}
+
+// AggregateMsg tells the datapath which statistics a flow wants
+type AggregateMsg struct {
+	proto    peerProto
+	socketId uint32
+	seq      uint32
+	cfg      AggregateConfig
+}
+
+func (a *AggregateMsg) New(sid uint32, cfg AggregateConfig) {
+	a.socketId = sid
+	a.cfg = cfg
+}
+
+func (a *AggregateMsg) SocketId() uint32 {
+	return a.socketId
+}
+
+func (a *AggregateMsg) Config() AggregateConfig {
+	return a.cfg
+}
+
+func (a *AggregateMsg) Serialize() ([]byte, error) {
+	return msgWriter(ipcMsg{
+		typ:      AGGREGATE,
+		proto:    a.proto,
+		socketId: a.socketId,
+		seq:      a.seq,
+		u32s:     []uint32{uint32(a.cfg.Stats), math.Float32bits(a.cfg.Gain)},
+	})
+}
+
+// SendAggregateMsg fails if the datapath cannot aggregate
+func (i *Ipc) SendAggregateMsg(socketId uint32, cfg AggregateConfig) error {
+	if i.peerProto(socketId).caps&CapAggregate == 0 {
+		return fmt.Errorf("datapath for %d cannot aggregate", socketId)
+	}
+
+	proto, seq := i.wire(socketId)
+	return i.sendMsg(socketId, &AggregateMsg{
+		proto:    proto,
+		socketId: socketId,
+		seq:      seq,
+		cfg:      cfg,
+	})
+}
+
+func (i *Ipc) ListenAggregateMsg() (chan AggregateMsg, error) {
+	return i.AggregateNotify, nil
+}
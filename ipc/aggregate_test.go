@@ -0,0 +1,54 @@
+package ipc
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAggregator(t *testing.T) {
+	var a Aggregator
+
+	// nothing configured, nothing reported
+	a.Ack(10*time.Millisecond, 1460)
+	a.Lost(1)
+	if g := a.Report(); g != (Aggregates{}) {
+		t.Errorf("expected no aggregates before Configure, got %v", g)
+	}
+
+	a.Configure(AggregateConfig{Stats: AggEwmaRtt | AggMinRtt | AggMaxRtt | AggAcks | AggBytesAcked | AggLost, Gain: 0.5})
+	a.Ack(10*time.Millisecond, 1460)
+	a.Ack(20*time.Millisecond, 2920)
+	// a duplicate ack: an rtt sample, but no new data
+	a.Ack(30*time.Millisecond, 0)
+	a.Lost(2)
+	a.Ecn(1460)
+
+	expected := Aggregates{
+		Stats:      AggEwmaRtt | AggMinRtt | AggMaxRtt | AggAcks | AggBytesAcked | AggLost,
+		EwmaRtt:    22500 * time.Microsecond,
+		MinRtt:     10 * time.Millisecond,
+		MaxRtt:     30 * time.Millisecond,
+		Acks:       2,
+		BytesAcked: 3 * 1460,
+		Lost:       2,
+	}
+
+	if g := a.Report(); g != expected {
+		t.Errorf("got\n%v\nexpected\n%v", g, expected)
+	}
+
+	// the next interval starts afresh, but the average carries over
+	a.Ack(30*time.Millisecond, 1460)
+	expected = Aggregates{
+		Stats:      expected.Stats,
+		EwmaRtt:    26250 * time.Microsecond,
+		MinRtt:     30 * time.Millisecond,
+		MaxRtt:     30 * time.Millisecond,
+		Acks:       1,
+		BytesAcked: 1460,
+	}
+
+	if g := a.Report(); g != expected {
+		t.Errorf("got\n%v\nexpected\n%v", g, expected)
+	}
+}
@@ -0,0 +1,283 @@
+package ipc
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"ccp/ipcBackend"
+	"ccp/tcpipc"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/* Batching.
+ * Every message otherwise costs its backend a datagram, or a netlink
+ * message, and so a system call. An Ipc with batching on instead holds
+ * messages for peers which advertise CapBatch, and sends them together in
+ * one BATCH message once the batch is full or the flush interval passes.
+ * A BATCH is a framed header with socket id 0 followed by the messages,
+ * each with its own header, so demux splits it back up.
+ *
+ * Ipcs which send to the same place share their batches: every flow of a
+ * datapath sending to the CCP, and the CCP's per-flow Ipcs on the netlink
+ * datapath, whose one socket reaches every flow. On the unix and shm
+ * datapaths each flow listens on a socket of its own, so the CCP's
+ * per-flow Ipcs each batch only their own flow's messages.
+ * The tcp backend cannot batch in either direction: it routes each
+ * message by the socket id in its header, and a BATCH's is 0.
+ */
+
+// DefaultBatchSize fits the read buffer of the unix socket backend
+const DefaultBatchSize = 2048
+
+// a BATCH's header is always a short one
+const maxBatchSize = math.MaxUint16
+
+// rawMsg is a message already serialized
+type rawMsg []byte
+
+func (r rawMsg) Serialize() ([]byte, error) {
+	return r, nil
+}
+
+type batchQueue struct {
+	mux      sync.Mutex
+	dest     string
+	members  map[*Ipc]bool
+	interval time.Duration
+	size     int
+
+	pending    [][]byte
+	pendingLen int
+	// the Ipc whose backend sends the pending batch
+	via   *Ipc
+	timer *time.Timer
+}
+
+// the shared batches, by destination
+var batches = struct {
+	sync.Mutex
+	byDest map[string]*batchQueue
+}{byDest: make(map[string]*batchQueue)}
+
+/* SetBatching holds messages to peers which advertise CapBatch for up to
+ * interval, sending them together once size bytes are waiting.
+ * An interval of 0 turns batching off, sending whatever was waiting.
+ */
+func (i *Ipc) SetBatching(interval time.Duration, size int) error {
+	if interval > 0 {
+		switch i.backend.(type) {
+		case *tcpipc.TcpIpc, *tcpipc.Client:
+			return fmt.Errorf("the tcp backend cannot batch")
+		}
+
+		if size > maxBatchSize {
+			return fmt.Errorf("batch size %d exceeds limit of %d", size, maxBatchSize)
+		}
+	}
+
+	i.batchMux.Lock()
+	defer i.batchMux.Unlock()
+	if i.batch != nil {
+		i.batch.leave(i)
+		i.batch = nil
+	}
+
+	if interval <= 0 {
+		return nil
+	}
+
+	i.batch = joinBatch(i, interval, size)
+	return nil
+}
+
+func joinBatch(i *Ipc, interval time.Duration, size int) *batchQueue {
+	batches.Lock()
+	defer batches.Unlock()
+
+	q, ok := batches.byDest[i.dest]
+	if !ok || i.dest == "" {
+		q = &batchQueue{dest: i.dest, members: make(map[*Ipc]bool)}
+		if i.dest != "" {
+			batches.byDest[i.dest] = q
+		}
+	}
+
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	q.members[i] = true
+	q.interval = interval
+	q.size = size
+	return q
+}
+
+// leave sends what i's backend was about to, since it is going away
+func (q *batchQueue) leave(i *Ipc) {
+	batches.Lock()
+	defer batches.Unlock()
+
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	if q.via == i {
+		q.logFlush(q.flush())
+	}
+
+	delete(q.members, i)
+	if len(q.members) == 0 && q.dest != "" {
+		delete(batches.byDest, q.dest)
+	}
+}
+
+// sendMsg sends msg to socketId, in a batch if the peer can parse one
+func (i *Ipc) sendMsg(socketId uint32, msg ipcbackend.Msg) error {
+	i.batchMux.Lock()
+	q := i.batch
+	i.batchMux.Unlock()
+	if q == nil || i.peerProto(socketId).caps&CapBatch == 0 {
+		return i.backend.SendMsg(msg)
+	}
+
+	buf, err := msg.Serialize()
+	if err != nil {
+		return err
+	}
+
+	return q.add(i, buf)
+}
+
+func (q *batchQueue) add(i *Ipc, buf []byte) error {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	if shortHeaderLen+q.pendingLen+len(buf) > q.size {
+		if err := q.flush(); err != nil {
+			return err
+		}
+	}
+
+	// too big for a batch of its own: send it as it is,
+	// after the messages before it
+	if shortHeaderLen+len(buf) > q.size {
+		return i.backend.SendMsg(rawMsg(buf))
+	}
+
+	if len(q.pending) == 0 {
+		q.via = i
+		q.timer = time.AfterFunc(q.interval, q.flushLater)
+	}
+
+	q.pending = append(q.pending, buf)
+	q.pendingLen += len(buf)
+	return nil
+}
+
+func (q *batchQueue) flushLater() {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	q.logFlush(q.flush())
+}
+
+func (q *batchQueue) logFlush(err error) {
+	if err != nil {
+		log.WithFields(log.Fields{
+			"dest": q.dest,
+			"err":  err,
+		}).Warn("failed to send batch")
+	}
+}
+
+// flush sends the pending messages. q.mux must be held.
+func (q *batchQueue) flush() error {
+	if len(q.pending) == 0 {
+		return nil
+	}
+
+	q.timer.Stop()
+	msgs, via := q.pending, q.via
+	q.pending, q.pendingLen, q.via = nil, 0, nil
+
+	// a batch of one is just the message
+	if len(msgs) == 1 {
+		return via.backend.SendMsg(rawMsg(msgs[0]))
+	}
+
+	buf, err := writeBatch(msgs)
+	if err != nil {
+		return err
+	}
+
+	return via.backend.SendMsg(rawMsg(buf))
+}
+
+// Flush sends any messages i is holding for a batch, without waiting for
+// the flush interval
+func (i *Ipc) Flush() error {
+	i.batchMux.Lock()
+	q := i.batch
+	i.batchMux.Unlock()
+	if q == nil {
+		return nil
+	}
+
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	return q.flush()
+}
+
+func writeBatch(msgs [][]byte) ([]byte, error) {
+	bodyLen := 0
+	for _, m := range msgs {
+		bodyLen += len(m)
+	}
+
+	hdr, _, err := writeHeader(BATCH, peerProto{version: ProtoVersion}, bodyLen, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := bytes.NewBuffer(hdr)
+	for _, m := range msgs {
+		buf.Write(m)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// splitBatch returns the messages in buf: those of a BATCH,
+// or else just buf
+func splitBatch(buf []byte) ([][]byte, error) {
+	typ, version, l, _, _, _, hdrLen, err := readHeader(buf)
+	if err != nil || version == legacyVersion || typ != BATCH {
+		// msgReader will complain, if there is anything to complain about
+		return [][]byte{buf}, nil
+	}
+
+	if int(l) > len(buf) || int(l) < hdrLen {
+		return nil, fmt.Errorf("batch length %d does not match buffer of %d bytes", l, len(buf))
+	}
+
+	msgs := make([][]byte, 0)
+	body := buf[hdrLen:l]
+	for len(body) > 0 {
+		typ, version, l, _, _, _, hdrLen, err := readHeader(body)
+		if err != nil {
+			return nil, err
+		}
+
+		if version != legacyVersion && typ == BATCH {
+			return nil, fmt.Errorf("batch within a batch")
+		}
+
+		if int(l) > len(body) || int(l) < hdrLen {
+			return nil, fmt.Errorf("message length %d overruns batch with %d bytes left", l, len(body))
+		}
+
+		msgs = append(msgs, body[:l])
+		body = body[l:]
+	}
+
+	return msgs, nil
+}
@@ -0,0 +1,217 @@
+package ipc
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"ccp/ipcBackend"
+	"ccp/tcpipc"
+)
+
+// counts what reaches the backend
+type countingBackend struct {
+	*MockBackend
+
+	mux   sync.Mutex
+	sends int
+}
+
+func (c *countingBackend) SendMsg(msg ipcbackend.Msg) error {
+	c.mux.Lock()
+	c.sends++
+	c.mux.Unlock()
+	return c.MockBackend.SendMsg(msg)
+}
+
+func (c *countingBackend) count() int {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.sends
+}
+
+func batchSetup(t *testing.T) (*Ipc, *countingBackend) {
+	back := &countingBackend{MockBackend: NewMockBackend(false).(*MockBackend)}
+	i, err := SetupWithBackend(back)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return i, back
+}
+
+func TestBatch(t *testing.T) {
+	i, back := batchSetup(t)
+	defer i.Close()
+
+	sids := []uint32{testNum + 18, testNum + 19, testNum + 20}
+	for _, sid := range sids {
+		i.peers.set(sid, peerProto{version: ProtoVersion, caps: CapBatch})
+	}
+
+	if err := i.SetBatching(time.Hour, DefaultBatchSize); err != nil {
+		t.Fatal(err)
+	}
+
+	outMsgCh, _ := i.ListenMeasureMsg()
+	for k, sid := range sids {
+		err := i.SendMeasureMsg(sid, uint32(k), testDuration, testNum, testBigNum, testBigNum)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := back.count(); n != 0 {
+		t.Fatalf("expected messages to wait for the flush, %d sent", n)
+	}
+
+	if err := i.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := back.count(); n != 1 {
+		t.Fatalf("expected 1 batch, %d sent", n)
+	}
+
+	// the batch arrives as its messages, in order
+	for k, sid := range sids {
+		select {
+		case out := <-outMsgCh:
+			if out.SocketId() != sid || out.AckNo() != uint32(k) {
+				t.Errorf("got (%d, %d), expected (%d, %d)", out.SocketId(), out.AckNo(), sid, k)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timed out")
+		}
+	}
+
+	// a peer without CapBatch gets its message at once
+	if err := i.SendMeasureMsg(testNum+21, 0, testDuration, testNum, testBigNum, testBigNum); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := back.count(); n != 2 {
+		t.Errorf("expected an unbatched message, %d sent", n)
+	}
+
+	select {
+	case <-outMsgCh:
+	case <-time.After(time.Second):
+		t.Fatal("timed out")
+	}
+}
+
+func TestBatchInterval(t *testing.T) {
+	i, back := batchSetup(t)
+	defer i.Close()
+
+	sid := testNum + 18
+	i.peers.set(sid, peerProto{version: ProtoVersion, caps: CapBatch})
+
+	// room for two of these DROPs, but not three
+	if err := i.SetBatching(5*time.Millisecond, shortHeaderLen+40); err != nil {
+		t.Fatal(err)
+	}
+
+	outMsgCh, _ := i.ListenDropMsg()
+	for _, ev := range []string{"timeout", "dupack00", "ecn00000"} {
+		if err := i.SendDropMsg(sid, ev); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the third message did not fit, so the first two went at once
+	if n := back.count(); n != 1 {
+		t.Errorf("expected a full batch to be sent, %d sent", n)
+	}
+
+	// and the third after the interval
+	for k := 0; k < 3; k++ {
+		select {
+		case <-outMsgCh:
+		case <-time.After(time.Second):
+			t.Fatalf("timed out after %d messages", k)
+		}
+	}
+
+	if n := back.count(); n != 2 {
+		t.Errorf("expected 2 sends, got %d", n)
+	}
+}
+
+func TestSplitBatch(t *testing.T) {
+	m1 := []byte{framedFlag | uint8(CLOSE), ProtoVersion, shortHeaderLen, 0, 1, 0, 0, 0}
+	m2 := []byte{framedFlag | uint8(CLOSE), ProtoVersion, shortHeaderLen, 0, 2, 0, 0, 0}
+
+	batch, err := writeBatch([][]byte{m1, m2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msgs, err := splitBatch(batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(msgs) != 2 || string(msgs[0]) != string(m1) || string(msgs[1]) != string(m2) {
+		t.Errorf("split into %v", msgs)
+	}
+
+	// anything else is its own message
+	if msgs, err = splitBatch(m1); err != nil || len(msgs) != 1 {
+		t.Errorf("expected a lone message, got %v, %v", msgs, err)
+	}
+
+	nested, _ := writeBatch([][]byte{batch, m1})
+	if _, err = splitBatch(nested); err == nil {
+		t.Error("expected a batch within a batch to be refused")
+	}
+
+	// the second message claims more than is left
+	batch[len(batch)-6] = shortHeaderLen + 1
+	if _, err = splitBatch(batch); err == nil {
+		t.Error("expected an overrunning message to be refused")
+	}
+}
+
+func TestBatchDest(t *testing.T) {
+	ccp, _ := batchSetup(t)
+	defer ccp.Close()
+
+	// the CCP's per-flow Ipcs, as SetupCcpSend makes them
+	sendIpc := func(datapath Datapath, sid uint32) *Ipc {
+		i := setup(&countingBackend{MockBackend: NewMockBackend(false).(*MockBackend)}, ccp.peers, ccp.retx)
+		i.dest = ccpSendDest(datapath, sid)
+		if err := i.SetBatching(time.Hour, DefaultBatchSize); err != nil {
+			t.Fatal(err)
+		}
+
+		return i
+	}
+
+	for _, c := range []struct {
+		datapath Datapath
+		shared   bool
+	}{
+		// one socket reaches every flow
+		{NETLINK, true},
+		// a socket per flow, which a batch for another flow cannot go to
+		{UNIX, false},
+		{SHM, false},
+	} {
+		a, b := sendIpc(c.datapath, testNum+31), sendIpc(c.datapath, testNum+32)
+		if shared := a.batch == b.batch; shared != c.shared {
+			t.Errorf("datapath %v: shared batch %v, expected %v", c.datapath, shared, c.shared)
+		}
+
+		a.Close()
+		b.Close()
+	}
+
+	// the tcp backend routes by the header's socket id, so cannot batch
+	tcp := setup(tcpipc.New(socketIdOffset), newPeerTable(), newRetxTable())
+	defer tcp.Close()
+	if err := tcp.SetBatching(time.Hour, DefaultBatchSize); err == nil {
+		t.Error("expected the tcp backend to refuse batching")
+	}
+}
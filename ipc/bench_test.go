@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"ccp/ccpFlow/pattern"
+	"ccp/unixsocket"
 )
 
 func BenchmarkEncodeCreateMsg(b *testing.B) {
@@ -53,6 +54,7 @@ func BenchmarkMeasureMsg(b *testing.B) {
 			testNum,
 			testNum,
 			testDuration,
+			testNum,
 			testBigNum,
 			testBigNum,
 		)
@@ -123,3 +125,70 @@ func BenchmarkEncodePatternMsg(t *testing.B) {
 		}
 	}
 }
+
+// MEASUREs for many flows, from one datapath Ipc to one CCP Ipc over a
+// unix socket, batched if interval is not 0
+func benchUnixMeasure(b *testing.B, interval time.Duration) {
+	const flows = 100
+
+	back, err := unixsocket.New().SetupListen("ipc-bench", 0).SetupFinish()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	ccp, _ := SetupWithBackend(back)
+	defer ccp.Close()
+
+	back, err = unixsocket.New().SetupSend("ipc-bench", 0).SetupFinish()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	dp, _ := SetupWithBackend(back)
+	defer dp.Close()
+
+	for sid := uint32(1); sid <= flows; sid++ {
+		dp.peers.set(testNum+100+sid, peerProto{version: ProtoVersion, caps: localCaps})
+	}
+
+	if err = dp.SetBatching(interval, DefaultBatchSize); err != nil {
+		b.Fatal(err)
+	}
+
+	outMsgCh, _ := ccp.ListenMeasureMsg()
+	done := make(chan interface{})
+	go func() {
+		defer close(done)
+		for k := 0; k < b.N; k++ {
+			select {
+			case <-outMsgCh:
+			case <-time.After(time.Second):
+				b.Error("timed out")
+				return
+			}
+		}
+	}()
+
+	b.ResetTimer()
+	for k := 0; k < b.N; k++ {
+		dp.SendMeasureMsg(
+			testNum+100+uint32(k%flows)+1,
+			testNum,
+			testDuration,
+			testNum,
+			testBigNum,
+			testBigNum,
+		)
+	}
+
+	dp.Flush()
+	<-done
+}
+
+func BenchmarkUnixMeasureMsgs(b *testing.B) {
+	benchUnixMeasure(b, 0)
+}
+
+func BenchmarkUnixMeasureMsgsBatched(b *testing.B) {
+	benchUnixMeasure(b, time.Millisecond)
+}
@@ -0,0 +1,209 @@
+package ipc
+
+import (
+	"sync"
+)
+
+/* Handlers.
+ * Instead of pulling from the Notify channels, a consumer can register a
+ * Handler for the messages of each socket, and a default Handler for
+ * sockets without their own, like the CCP's flows and the CCP itself.
+ * A message goes to its socket's Handler, else to the default Handler,
+ * else, if there is neither, to its Notify channel.
+ *
+ * Handlers are called from the goroutines delivering the Ipc's messages,
+ * one call at a time for each socket, in the order the socket's messages
+ * arrive unless SetQueue lets one type overtake another. Calls for
+ * different sockets may run at once, so a Handler registered for more
+ * than one socket, like the default Handler, must be safe for that.
+ * A Handler which blocks holds up every message behind it, so hand slow
+ * work off.
+ */
+
+type Handler interface {
+	OnCreate(CreateMsg)
+	OnMeasure(MeasureMsg)
+	OnDrop(DropMsg)
+	OnPattern(PatternMsg)
+	OnClose(CloseMsg)
+	// messages which could not be parsed, and the backend's errors,
+	// as *ipcbackend.Error
+	OnError(error)
+}
+
+// AggregateHandler is a Handler which also takes AGGREGATE messages.
+// Handlers which are not ignore them.
+type AggregateHandler interface {
+	Handler
+	OnAggregate(AggregateMsg)
+}
+
+// NopHandler ignores every message; embed it to handle only some
+type NopHandler struct{}
+
+func (NopHandler) OnCreate(CreateMsg)   {}
+func (NopHandler) OnMeasure(MeasureMsg) {}
+func (NopHandler) OnDrop(DropMsg)       {}
+func (NopHandler) OnPattern(PatternMsg) {}
+func (NopHandler) OnClose(CloseMsg)     {}
+func (NopHandler) OnError(error)        {}
+
+type router struct {
+	mux      sync.RWMutex
+	fallback Handler
+	sockets  map[uint32]Handler
+	// closed, and replaced, whenever a Handler is registered
+	added chan interface{}
+
+	// one call at a time for each socket
+	callMux sync.Mutex
+	calls   map[uint32]*socketCalls
+}
+
+// the calls into Handlers for one socket
+type socketCalls struct {
+	sync.Mutex
+	// calls running or waiting
+	users int
+}
+
+// Handle registers h for the messages of sockets without a Handler of
+// their own. A nil h sends them to the Notify channels again.
+func (i *Ipc) Handle(h Handler) {
+	i.router.mux.Lock()
+	defer i.router.mux.Unlock()
+	i.router.fallback = h
+	if h != nil {
+		i.router.notifyAdded()
+	}
+}
+
+// HandleSocket registers h for the messages of socketId.
+// A nil h removes the socket's Handler.
+func (i *Ipc) HandleSocket(socketId uint32, h Handler) {
+	i.router.mux.Lock()
+	defer i.router.mux.Unlock()
+	if h == nil {
+		delete(i.router.sockets, socketId)
+		return
+	}
+
+	i.router.sockets[socketId] = h
+	i.router.notifyAdded()
+}
+
+// r.mux must be held
+func (r *router) notifyAdded() {
+	close(r.added)
+	r.added = make(chan interface{})
+}
+
+// call runs f once no other call for socketId is running
+func (r *router) call(socketId uint32, f func()) {
+	r.callMux.Lock()
+	c, ok := r.calls[socketId]
+	if !ok {
+		c = &socketCalls{}
+		r.calls[socketId] = c
+	}
+	c.users++
+	r.callMux.Unlock()
+
+	c.Lock()
+	defer func() {
+		c.Unlock()
+		r.callMux.Lock()
+		if c.users--; c.users == 0 {
+			delete(r.calls, socketId)
+		}
+		r.callMux.Unlock()
+	}()
+
+	f()
+}
+
+// handled closes once a Handler is registered
+func (r *router) handled() <-chan interface{} {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+	return r.added
+}
+
+// SocketHandler returns the Handler registered for socketId, if any
+func (i *Ipc) SocketHandler(socketId uint32) (Handler, bool) {
+	i.router.mux.RLock()
+	defer i.router.mux.RUnlock()
+	h, ok := i.router.sockets[socketId]
+	return h, ok
+}
+
+// SocketHandlers returns the Handler registered for each socket
+func (i *Ipc) SocketHandlers() map[uint32]Handler {
+	i.router.mux.RLock()
+	defer i.router.mux.RUnlock()
+	hs := make(map[uint32]Handler, len(i.router.sockets))
+	for sid, h := range i.router.sockets {
+		hs[sid] = h
+	}
+
+	return hs
+}
+
+func (i *Ipc) handlerFor(socketId uint32) Handler {
+	i.router.mux.RLock()
+	defer i.router.mux.RUnlock()
+	if h, ok := i.router.sockets[socketId]; ok {
+		return h
+	}
+
+	return i.router.fallback
+}
+
+// dispatch hands msg, for socketId, to its Handler,
+// returning false if there is none
+func (i *Ipc) dispatch(socketId uint32, msg interface{}) bool {
+	h := i.handlerFor(socketId)
+	if h == nil {
+		return false
+	}
+
+	i.router.call(socketId, func() {
+		switch m := msg.(type) {
+		case CreateMsg:
+			h.OnCreate(m)
+		case MeasureMsg:
+			h.OnMeasure(m)
+		case DropMsg:
+			h.OnDrop(m)
+		case PatternMsg:
+			h.OnPattern(m)
+		case CloseMsg:
+			h.OnClose(m)
+		case AggregateMsg:
+			if a, ok := h.(AggregateHandler); ok {
+				a.OnAggregate(m)
+			}
+		}
+	})
+
+	return true
+}
+
+// reportError tells the Handler for socketId about err.
+// errors not about any one socket go to the default Handler.
+func (i *Ipc) reportError(socketId uint32, err error) {
+	var h Handler
+	if socketId == 0 {
+		i.router.mux.RLock()
+		h = i.router.fallback
+		i.router.mux.RUnlock()
+	} else {
+		h = i.handlerFor(socketId)
+	}
+
+	if h == nil {
+		return
+	}
+
+	i.router.call(socketId, func() { h.OnError(err) })
+}
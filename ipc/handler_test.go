@@ -0,0 +1,165 @@
+package ipc
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"ccp/ipcBackend"
+)
+
+// passes on whatever it is handed
+type recordingHandler struct {
+	msgs chan interface{}
+}
+
+func newRecordingHandler() *recordingHandler {
+	return &recordingHandler{msgs: make(chan interface{}, 10)}
+}
+
+func (r *recordingHandler) OnCreate(m CreateMsg)   { r.msgs <- m }
+func (r *recordingHandler) OnMeasure(m MeasureMsg) { r.msgs <- m }
+func (r *recordingHandler) OnDrop(m DropMsg)       { r.msgs <- m }
+func (r *recordingHandler) OnPattern(m PatternMsg) { r.msgs <- m }
+func (r *recordingHandler) OnClose(m CloseMsg)     { r.msgs <- m }
+func (r *recordingHandler) OnError(err error)      { r.msgs <- err }
+
+func (r *recordingHandler) next(t *testing.T) interface{} {
+	select {
+	case m := <-r.msgs:
+		return m
+	case <-time.After(time.Second):
+		t.Fatal("timed out")
+		return nil
+	}
+}
+
+func TestHandleSocket(t *testing.T) {
+	back := NewMockBackend(false).(*MockBackend)
+	i, err := SetupWithBackend(back)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer i.Close()
+
+	fallback, flow := newRecordingHandler(), newRecordingHandler()
+	i.Handle(fallback)
+
+	sid, other := testNum+24, testNum+25
+	i.HandleSocket(sid, flow)
+	if h, ok := i.SocketHandler(sid); !ok || h != flow {
+		t.Fatal("expected the socket's handler to be registered")
+	}
+
+	if err = i.SendCreateMsg(other, testNum, testString); err != nil {
+		t.Fatal(err)
+	}
+
+	if m, ok := fallback.next(t).(CreateMsg); !ok || m.SocketId() != other {
+		t.Errorf("expected a CREATE for %d, got %v", other, m)
+	}
+
+	if err = i.SendMeasureMsg(sid, testNum, testDuration, testNum, testBigNum, testBigNum); err != nil {
+		t.Fatal(err)
+	}
+
+	if m, ok := flow.next(t).(MeasureMsg); !ok || m.SocketId() != sid {
+		t.Errorf("expected a MEASURE for %d, got %v", sid, m)
+	}
+
+	// without its handler, the socket's messages go to the default one
+	i.HandleSocket(sid, nil)
+	if len(i.SocketHandlers()) != 0 {
+		t.Fatal("expected no socket handlers")
+	}
+
+	if err = i.SendDropMsg(sid, testString); err != nil {
+		t.Fatal(err)
+	}
+
+	if m, ok := fallback.next(t).(DropMsg); !ok || m.SocketId() != sid {
+		t.Errorf("expected a DROP for %d, got %v", sid, m)
+	}
+
+	// which also hears about messages it could not parse
+	back.ch <- []byte{0xff}
+	if m, ok := fallback.next(t).(*ipcbackend.Error); !ok || m.Kind != ipcbackend.ErrParse {
+		t.Errorf("expected a parse failure, got %v", m)
+	}
+
+	// and about the backend's errors
+	back.Report(&ipcbackend.Error{Kind: ipcbackend.ErrOverrun, Where: "test", Err: io.ErrShortBuffer})
+	if m, ok := fallback.next(t).(*ipcbackend.Error); !ok || m.Kind != ipcbackend.ErrOverrun {
+		t.Errorf("expected an overrun, got %v", m)
+	}
+
+	select {
+	case m := <-flow.msgs:
+		t.Errorf("unexpected message for the socket's old handler: %v", m)
+	default:
+	}
+}
+
+func TestHandleLate(t *testing.T) {
+	i, err := testSetup(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer i.Close()
+
+	// with no handler, a message waits for its Notify channel...
+	sid := testNum + 24
+	delivered := make(chan interface{})
+	go func() {
+		i.notify(CLOSE, sid, CloseMsg{socketId: sid})
+		close(delivered)
+	}()
+
+	select {
+	case <-delivered:
+		t.Fatal("expected the message to wait for a consumer")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	// ...until a handler takes it instead
+	h := newRecordingHandler()
+	i.HandleSocket(sid, h)
+	if m, ok := h.next(t).(CloseMsg); !ok || m.SocketId() != sid {
+		t.Errorf("expected a CLOSE for %d, got %v", sid, m)
+	}
+
+	<-delivered
+}
+
+func TestHandleConcurrently(t *testing.T) {
+	i, err := testSetup(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer i.Close()
+
+	for _, typ := range []msgType{CREATE, MEASURE} {
+		if err = i.SetQueue(typ, QueueConfig{Len: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a's handler takes nothing until asked
+	a, b := testNum+24, testNum+25
+	stuck, h := &recordingHandler{msgs: make(chan interface{})}, newRecordingHandler()
+	i.HandleSocket(a, stuck)
+	i.HandleSocket(b, h)
+
+	i.notify(CREATE, a, CreateMsg{socketId: a})
+	waitQueued(t, i, CREATE, 0)
+
+	// which holds up nobody else
+	i.notify(MEASURE, b, MeasureMsg{socketId: b})
+	if m, ok := h.next(t).(MeasureMsg); !ok || m.SocketId() != b {
+		t.Errorf("expected a MEASURE for %d, got %v", b, m)
+	}
+
+	if m, ok := stuck.next(t).(CreateMsg); !ok || m.SocketId() != a {
+		t.Errorf("expected a CREATE for %d, got %v", a, m)
+	}
+}
@@ -2,11 +2,17 @@ package ipc
 
 import (
 	"fmt"
+	"os"
+	"sync"
 
 	flowPattern "ccp/ccpFlow/pattern"
 	"ccp/ipcBackend"
 	"ccp/netlinkipc"
+	"ccp/shmipc"
+	"ccp/tcpipc"
 	"ccp/unixsocket"
+
+	log "github.com/sirupsen/logrus"
 )
 
 // setup and teardown logic
@@ -16,15 +22,53 @@ type Datapath int
 const (
 	UNIX Datapath = iota
 	NETLINK
+	TCP
+	SHM
 )
 
+// TCPAddr is where the CCP listens for TCP datapaths
+var TCPAddr = "127.0.0.1:4242"
+
+// UnixMode is how the UNIX datapath's sockets are addressed, and their
+// kind. A CCP and its datapaths must agree, so it defaults to
+// $CCP_IPC_UNIX_MODE.
+var UnixMode = unixModeFromEnv()
+
+func unixModeFromEnv() unixsocket.Mode {
+	m, err := unixsocket.ParseMode(os.Getenv("CCP_IPC_UNIX_MODE"))
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Warn("ignoring CCP_IPC_UNIX_MODE")
+	}
+
+	return m
+}
+
 type Ipc struct {
 	CreateNotify  chan CreateMsg
 	MeasureNotify chan MeasureMsg
 	DropNotify    chan DropMsg
 	PatternNotify chan PatternMsg
+	CloseNotify   chan CloseMsg
+	// AGGREGATE messages, for datapaths
+	AggregateNotify chan AggregateMsg
 
 	backend ipcbackend.Backend
+	peers   *peerTable
+	// what this Ipc advertised on each socket it sent a HELLO on
+	announced *peerTable
+	seq       *seqState
+	// the PATTERNs awaiting an ack, shared like peers
+	retx *retxTable
+	// where the backend sends, so Ipcs sending to the same place can
+	// share batches; empty if unknown
+	dest     string
+	batchMux sync.Mutex
+	batch    *batchQueue
+	// between demux and each Notify channel
+	queues map[msgType]*notifyQueue
+	router router
 }
 
 // handle of IPC to pass to CC implementations
@@ -38,9 +82,13 @@ func SetupCcpListen(datapath Datapath) (*Ipc, error) {
 
 	switch datapath {
 	case UNIX:
-		back, err = unixsocket.New().SetupListen("ccp-in", 0).SetupFinish()
+		back, err = unixsocket.New().SetupListen(unixsocket.Loc("ccp-in", UnixMode), 0).SetupFinish()
 	case NETLINK:
 		back, err = netlinkipc.New().SetupListen("", 0).SetupFinish()
+	case TCP:
+		back, err = tcpipc.New(socketIdOffset).SetupListen(TCPAddr, 0).SetupFinish()
+	case SHM:
+		back, err = shmipc.New().SetupListen("ccp-in", 0).SetupFinish()
 	default:
 		return nil, fmt.Errorf("unknown datapath")
 	}
@@ -52,15 +100,36 @@ func SetupCcpListen(datapath Datapath) (*Ipc, error) {
 	return SetupWithBackend(back)
 }
 
-func SetupCcpSend(datapath Datapath, sockid uint32) (SendOnly, error) {
+// where the CCP's sending Ipc for the flow on sockid sends: one socket per
+// flow, except on netlink, whose one socket reaches every flow
+func ccpSendDest(datapath Datapath, sockid uint32) string {
+	switch datapath {
+	case UNIX:
+		return "unix:" + ipcbackend.AddressForSend("ccp-out", sockid)
+	case NETLINK:
+		return "netlink"
+	case SHM:
+		return "shm:" + ipcbackend.AddressForSend("ccp-out", sockid)
+	default:
+		return ""
+	}
+}
+
+// SetupCcpSend sets up the CCP's sending Ipc for the flow on sockid, which
+// uses what the listening Ipc listen learned about the flow's datapath
+func SetupCcpSend(listen *Ipc, datapath Datapath, sockid uint32) (*Ipc, error) {
 	var back ipcbackend.Backend
 	var err error
 
 	switch datapath {
 	case UNIX:
-		back, err = unixsocket.New().SetupSend("ccp-out", sockid).SetupFinish()
+		back, err = unixsocket.New().SetupSend(unixsocket.Loc("ccp-out", UnixMode), sockid).SetupFinish()
 	case NETLINK:
 		back, err = netlinkipc.New().SetupSend("", 0).SetupFinish()
+	case TCP:
+		back, err = tcpipc.New(socketIdOffset).SetupSend(TCPAddr, sockid).SetupFinish()
+	case SHM:
+		back, err = shmipc.New().SetupSend("ccp-out", sockid).SetupFinish()
 	default:
 		return nil, fmt.Errorf("unknown datapath")
 	}
@@ -69,34 +138,119 @@ func SetupCcpSend(datapath Datapath, sockid uint32) (SendOnly, error) {
 		return nil, err
 	}
 
-	return SetupWithBackend(back)
+	i := setup(back, listen.peers, listen.retx)
+	i.dest = ccpSendDest(datapath, sockid)
+
+	// answer the datapath's HELLO, if it sent one.
+	// datapaths which never did only speak the legacy format.
+	if p, ok := i.peers.get(sockid); ok && p.version >= ProtoVersion {
+		err = i.SendHelloMsg(sockid)
+		if err != nil {
+			i.Close()
+			return nil, err
+		}
+	}
+
+	return i, nil
 }
 
 // Setup both sending and receiving
 // Only useful for UDP datapath
 func SetupCli(sockid uint32) (*Ipc, error) {
-	back, err := unixsocket.New().SetupSend("ccp-in", 0).SetupListen("ccp-out", sockid).SetupFinish()
+	back, err := unixsocket.New().
+		SetupSend(unixsocket.Loc("ccp-in", UnixMode), 0).
+		SetupListen(unixsocket.Loc("ccp-out", UnixMode), sockid).
+		SetupFinish()
 	if err != nil {
 		return nil, err
 	}
 
-	return SetupWithBackend(back)
+	return setupCli(back, sockid, "unix:"+ipcbackend.AddressForSend("ccp-in", 0))
+}
+
+// SetupCliTCP is SetupCli for a datapath whose CCP listens on the TCP
+// address addr, possibly on another host
+func SetupCliTCP(addr string, sockid uint32) (*Ipc, error) {
+	back, err := tcpipc.NewClient().SetupSend(addr, sockid).SetupListen(addr, sockid).SetupFinish()
+	if err != nil {
+		return nil, err
+	}
+
+	return setupCli(back, sockid, "")
+}
+
+// SetupCliShm is SetupCli for a CCP run with the SHM datapath
+func SetupCliShm(sockid uint32) (*Ipc, error) {
+	back, err := shmipc.New().SetupSend("ccp-in", 0).SetupListen("ccp-out", sockid).SetupFinish()
+	if err != nil {
+		return nil, err
+	}
+
+	return setupCli(back, sockid, "shm:"+ipcbackend.AddressForSend("ccp-in", 0))
+}
+
+func setupCli(back ipcbackend.Backend, sockid uint32, dest string) (*Ipc, error) {
+	i, err := SetupWithBackend(back)
+	if err != nil {
+		return nil, err
+	}
+
+	i.dest = dest
+
+	// announce our wire protocol to the CCP.
+	// if this fails we just keep speaking the legacy format.
+	err = i.SendHelloMsg(sockid)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"sockid": sockid,
+			"err":    err,
+		}).Warn("failed to send hello")
+	}
+
+	return i, nil
 }
 
 func SetupWithBackend(back ipcbackend.Backend) (*Ipc, error) {
+	return setup(back, newPeerTable(), newRetxTable()), nil
+}
+
+func setup(back ipcbackend.Backend, peers *peerTable, retx *retxTable) *Ipc {
 	i := &Ipc{
-		CreateNotify:  make(chan CreateMsg),
-		MeasureNotify: make(chan MeasureMsg),
-		DropNotify:    make(chan DropMsg),
-		PatternNotify: make(chan PatternMsg),
-		backend:       back,
+		CreateNotify:    make(chan CreateMsg),
+		MeasureNotify:   make(chan MeasureMsg),
+		DropNotify:      make(chan DropMsg),
+		PatternNotify:   make(chan PatternMsg),
+		CloseNotify:     make(chan CloseMsg),
+		AggregateNotify: make(chan AggregateMsg),
+		backend:         back,
+		peers:           peers,
+		announced:       newPeerTable(),
+		seq:             newSeqState(),
+		retx:            retx,
+		router: router{
+			sockets: make(map[uint32]Handler),
+			added:   make(chan interface{}),
+			calls:   make(map[uint32]*socketCalls),
+		},
 	}
 
+	i.setupQueues()
 	ch := i.backend.Listen()
 	go i.demux(ch)
-	return i, nil
+	go i.watch(i.backend.Errors())
+	return i
+}
+
+// watch passes the backend's errors to the default Handler,
+// until the backend closes
+func (i *Ipc) watch(errs chan error) {
+	for err := range errs {
+		i.reportError(0, err)
+	}
 }
 
 func (i *Ipc) Close() error {
+	i.retx.forget(i)
+	i.SetBatching(0, 0)
 	return i.backend.Close()
 }
@@ -1,19 +1,59 @@
 package ipc
 
 import (
+	"fmt"
 	"time"
 
 	flowPattern "ccp/ccpFlow/pattern"
+
+	log "github.com/sirupsen/logrus"
 )
 
 // the external serialization interface
 
 type CreateMsg struct {
+	proto    peerProto
 	socketId uint32
+	seq      uint32
 	startSeq uint32
 	congAlg  string
+	// whether the sender announced CapCreateInfo, and so sends info
+	withInfo bool
+	info     CreateInfo
+}
+
+// MeasureField is a set of the optional MEASURE fields
+type MeasureField uint32
+
+const (
+	FieldMinRtt MeasureField = 1 << iota
+	FieldDelivered
+	FieldInflight
+	FieldEcn
+	FieldSacked
+	FieldTimestamp
+	// the statistics of AGGREGATE messages
+	FieldAggregates
+)
+
+/* CreateInfo is what a datapath says about a new flow.
+ * Datapaths which do not announce CapCreateInfo leave Mss and InitCwnd
+ * zero, and Fields empty, and get the events their capabilities imply.
+ */
+type CreateInfo struct {
+	// bytes per packet
+	Mss uint32
+	// initial congestion window, packets
+	InitCwnd uint32
+	// the pattern events the datapath can run
+	Events flowPattern.EventSet
+	// the optional measurement fields the datapath fills in
+	Fields MeasureField
 }
 
+// fields a CREATE carries after the start sequence when it has info
+const createInfoU32s = 4
+
 func (c *CreateMsg) New(sid uint32, startSeq uint32, alg string) {
 	c.socketId = sid
 	c.startSeq = startSeq
@@ -32,22 +72,65 @@ func (c *CreateMsg) CongAlg() string {
 	return c.congAlg
 }
 
+func (c *CreateMsg) Info() CreateInfo {
+	return c.info
+}
+
 func (c *CreateMsg) Serialize() ([]byte, error) {
-	return msgWriter(ipcMsg{
+	msg := ipcMsg{
 		typ:      CREATE,
+		proto:    c.proto,
 		socketId: c.socketId,
+		seq:      c.seq,
 		u32s:     []uint32{c.startSeq},
 		str:      c.congAlg,
-	})
+	}
+
+	if c.withInfo {
+		msg.u32s = append(msg.u32s,
+			c.info.Mss,
+			c.info.InitCwnd,
+			uint32(c.info.Events),
+			uint32(c.info.Fields),
+		)
+	}
+
+	return msgWriter(msg)
 }
 
 type MeasureMsg struct {
+	proto    peerProto
 	socketId uint32
+	seq      uint32
 	ackNo    uint32
 	rtt      time.Duration
 	loss     uint32
 	rin      uint64
 	rout     uint64
+	ext      MeasureExt
+}
+
+/* MeasureExt holds the measurement fields beyond ack, rtt, loss and rates.
+ * They are only sent to peers which advertise CapExtMeasure;
+ * measurements from datapaths which do not fill them in read as zero.
+ */
+type MeasureExt struct {
+	// smallest rtt sample over the report interval
+	MinRtt time.Duration
+	// bytes delivered over the flow's lifetime
+	Delivered uint64
+	// bytes sent and not yet acknowledged or declared lost
+	Inflight uint64
+	// bytes delivered with an ECN mark over the flow's lifetime
+	Ecn uint64
+	// bytes selectively acknowledged above the cumulative ack
+	Sacked uint64
+	// when the datapath took the measurement, on its own clock.
+	// only differences between a flow's reports are meaningful.
+	Timestamp time.Duration
+	// what the datapath aggregated since the last report, if the flow
+	// asked it to and the peer advertises CapAggregate
+	Agg Aggregates
 }
 
 func (m *MeasureMsg) New(
@@ -90,17 +173,50 @@ func (m *MeasureMsg) Rout() uint64 {
 	return m.rout
 }
 
+func (m *MeasureMsg) Ext() MeasureExt {
+	return m.ext
+}
+
 func (m *MeasureMsg) Serialize() ([]byte, error) {
-	return msgWriter(ipcMsg{
+	msg := ipcMsg{
 		typ:      MEASURE,
+		proto:    m.proto,
 		socketId: m.socketId,
+		seq:      m.seq,
 		u32s:     []uint32{m.ackNo, uint32(m.rtt.Nanoseconds() / 1000), m.loss}, // microseconds
 		u64s:     []uint64{m.rin, m.rout},
-	})
+	}
+
+	if m.proto.caps&CapExtMeasure != 0 {
+		msg.u32s = append(msg.u32s, uint32(m.ext.MinRtt.Nanoseconds()/1000)) // microseconds
+		msg.u64s = append(msg.u64s,
+			m.ext.Delivered,
+			m.ext.Inflight,
+			m.ext.Ecn,
+			m.ext.Sacked,
+			uint64(m.ext.Timestamp.Nanoseconds()),
+		)
+
+		if agg := m.ext.Agg; m.proto.caps&CapAggregate != 0 && agg.Stats != 0 {
+			msg.u32s = append(msg.u32s,
+				uint32(agg.Stats),
+				uint32(agg.EwmaRtt.Nanoseconds()/1000), // microseconds
+				uint32(agg.MinRtt.Nanoseconds()/1000),
+				uint32(agg.MaxRtt.Nanoseconds()/1000),
+				agg.Acks,
+				agg.Lost,
+			)
+			msg.u64s = append(msg.u64s, agg.BytesAcked, agg.Ecn)
+		}
+	}
+
+	return msgWriter(msg)
 }
 
 type DropMsg struct {
+	proto    peerProto
 	socketId uint32
+	seq      uint32
 	event    string
 }
 
@@ -120,13 +236,17 @@ func (d *DropMsg) Event() string {
 func (d *DropMsg) Serialize() ([]byte, error) {
 	return msgWriter(ipcMsg{
 		typ:      DROP,
+		proto:    d.proto,
 		socketId: d.socketId,
+		seq:      d.seq,
 		str:      d.event,
 	})
 }
 
 type PatternMsg struct {
+	proto    peerProto
 	socketId uint32
+	seq      uint32
 	pattern  *flowPattern.Pattern
 }
 
@@ -143,29 +263,160 @@ func (p *PatternMsg) Pattern() *flowPattern.Pattern {
 	return p.pattern
 }
 
+// check that the peer can parse and run the pattern
+func (p *PatternMsg) check() error {
+	if p.proto.caps&CapPatternCtl == 0 && !flowPattern.BasicEvents.Runs(p.pattern) {
+		return fmt.Errorf("peer %d cannot run patterns with control flow", p.socketId)
+	}
+
+	// Compile could not know the flow's packet size, nor its framing
+	err := p.pattern.Validate(p.proto.mss, maxPatternSize(p.proto))
+	if err != nil || p.proto.caps&CapFloatPattern != 0 {
+		return err
+	}
+
+	// nor whether the peer's fixed-point encoding carries its values
+	_, err = serializeSequence(p.pattern.Sequence, false)
+	return err
+}
+
 func (p *PatternMsg) Serialize() ([]byte, error) {
-	s, err := serializeSequence(p.pattern.Sequence)
+	if err := p.check(); err != nil {
+		return nil, err
+	}
+
+	floats := p.proto.caps&CapFloatPattern != 0
+	s, err := serializeSequence(p.pattern.Sequence, floats)
 	if err != nil {
 		return nil, err
 	}
 
+	numEvents := uint32(len(p.pattern.Sequence))
+	if floats {
+		numEvents |= patternFloats
+	}
+
 	return msgWriter(ipcMsg{
 		typ:      PATTERN,
+		proto:    p.proto,
 		socketId: p.socketId,
-		u32s:     []uint32{uint32(len(p.pattern.Sequence))},
+		seq:      p.seq,
+		u32s:     []uint32{numEvents},
 		str:      string(s),
 	})
 }
 
+// CloseMsg tells the CCP the datapath closed a socket
+type CloseMsg struct {
+	proto    peerProto
+	socketId uint32
+	seq      uint32
+}
+
+func (c *CloseMsg) New(sid uint32) {
+	c.socketId = sid
+}
+
+func (c *CloseMsg) SocketId() uint32 {
+	return c.socketId
+}
+
+func (c *CloseMsg) Serialize() ([]byte, error) {
+	return msgWriter(ipcMsg{
+		typ:      CLOSE,
+		proto:    c.proto,
+		socketId: c.socketId,
+		seq:      c.seq,
+	})
+}
+
+// PatternAckMsg tells the CCP the datapath received a PATTERN
+type PatternAckMsg struct {
+	proto    peerProto
+	socketId uint32
+	seq      uint32
+	acked    uint32
+}
+
+func (a *PatternAckMsg) SocketId() uint32 {
+	return a.socketId
+}
+
+// Acked is the PATTERN's sequence number
+func (a *PatternAckMsg) Acked() uint32 {
+	return a.acked
+}
+
+func (a *PatternAckMsg) Serialize() ([]byte, error) {
+	return msgWriter(ipcMsg{
+		typ:      PATTERNACK,
+		proto:    a.proto,
+		socketId: a.socketId,
+		seq:      a.seq,
+		u32s:     []uint32{a.acked},
+	})
+}
+
+// HelloMsg announces the wire protocol a peer speaks.
+// It is always sent in the legacy format so any peer can parse it.
+type HelloMsg struct {
+	socketId uint32
+	version  uint8
+	caps     uint32
+}
+
+func (h *HelloMsg) New(sid uint32, version uint8, caps uint32) {
+	h.socketId = sid
+	h.version = version
+	h.caps = caps
+}
+
+func (h *HelloMsg) SocketId() uint32 {
+	return h.socketId
+}
+
+func (h *HelloMsg) Version() uint8 {
+	return h.version
+}
+
+func (h *HelloMsg) Caps() uint32 {
+	return h.caps
+}
+
+func (h *HelloMsg) Serialize() ([]byte, error) {
+	return msgWriter(ipcMsg{
+		typ:      HELLO,
+		socketId: h.socketId,
+		u32s:     []uint32{uint32(h.version), h.caps},
+	})
+}
+
 func (i *Ipc) SendCreateMsg(
 	socketId uint32,
 	startSeq uint32,
 	alg string,
 ) error {
-	return i.backend.SendMsg(&CreateMsg{
+	return i.SendCreateMsgInfo(socketId, startSeq, alg, CreateInfo{})
+}
+
+// SendCreateMsgInfo also describes the datapath,
+// if this Ipc announced CapCreateInfo on the socket
+func (i *Ipc) SendCreateMsgInfo(
+	socketId uint32,
+	startSeq uint32,
+	alg string,
+	info CreateInfo,
+) error {
+	a, ok := i.announced.get(socketId)
+	proto, seq := i.wire(socketId)
+	return i.sendMsg(socketId, &CreateMsg{
+		proto:    proto,
 		socketId: socketId,
+		seq:      seq,
 		startSeq: startSeq,
 		congAlg:  alg,
+		withInfo: ok && a.caps&CapCreateInfo != 0,
+		info:     info,
 	})
 }
 
@@ -177,28 +428,115 @@ func (i *Ipc) SendMeasureMsg(
 	rin uint64,
 	rout uint64,
 ) error {
-	return i.backend.SendMsg(&MeasureMsg{
+	return i.SendMeasureMsgExt(socketId, ack, rtt, loss, rin, rout, MeasureExt{})
+}
+
+// SendMeasureMsgExt also sends the extended fields, if the peer can parse them
+func (i *Ipc) SendMeasureMsgExt(
+	socketId uint32,
+	ack uint32,
+	rtt time.Duration,
+	loss uint32,
+	rin uint64,
+	rout uint64,
+	ext MeasureExt,
+) error {
+	proto, seq := i.wire(socketId)
+	return i.sendMsg(socketId, &MeasureMsg{
+		proto:    proto,
 		socketId: socketId,
+		seq:      seq,
 		ackNo:    ack,
 		rtt:      rtt,
 		loss:     loss,
 		rin:      rin,
 		rout:     rout,
+		ext:      ext,
 	})
 }
 
 func (i *Ipc) SendDropMsg(socketId uint32, ev string) error {
-	return i.backend.SendMsg(&DropMsg{
+	proto, seq := i.wire(socketId)
+	return i.sendMsg(socketId, &DropMsg{
+		proto:    proto,
 		socketId: socketId,
+		seq:      seq,
 		event:    ev,
 	})
 }
 
+// SendPatternMsg retransmits the pattern until it is acknowledged,
+// if SetPatternRetransmit turned that on and the peer acknowledges patterns
 func (i *Ipc) SendPatternMsg(socketId uint32, pattern *flowPattern.Pattern) error {
-	return i.backend.SendMsg(&PatternMsg{
+	msg := &PatternMsg{
+		proto:    i.peerProto(socketId),
 		socketId: socketId,
 		pattern:  pattern,
+	}
+
+	// a pattern which is never sent takes no sequence number
+	err := msg.check()
+	if err != nil {
+		return err
+	}
+
+	proto, seq := i.wire(socketId)
+	msg.proto, msg.seq = proto, seq
+	err = i.sendMsg(socketId, msg)
+	if err != nil {
+		return err
+	}
+
+	i.seq.mux.Lock()
+	timeout := i.seq.retxTimeout
+	i.seq.mux.Unlock()
+	if timeout > 0 && proto.caps&CapSeqNo != 0 {
+		i.retx.track(i, msg, timeout)
+	}
+
+	return nil
+}
+
+func (i *Ipc) SendCloseMsg(socketId uint32) error {
+	proto, seq := i.wire(socketId)
+	return i.sendMsg(socketId, &CloseMsg{
+		proto:    proto,
+		socketId: socketId,
+		seq:      seq,
+	})
+}
+
+// acknowledge the PATTERN with sequence number acked
+func (i *Ipc) ackPattern(socketId uint32, acked uint32) {
+	proto, seq := i.wire(socketId)
+	err := i.sendMsg(socketId, &PatternAckMsg{
+		proto:    proto,
+		socketId: socketId,
+		seq:      seq,
+		acked:    acked,
+	})
+	if err != nil {
+		log.WithFields(log.Fields{
+			"sockid": socketId,
+			"seq":    acked,
+			"err":    err,
+		}).Warn("failed to acknowledge pattern")
+	}
+}
+
+func (i *Ipc) SendHelloMsg(socketId uint32) error {
+	// never batched, so negotiation is not held up
+	err := i.backend.SendMsg(&HelloMsg{
+		socketId: socketId,
+		version:  ProtoVersion,
+		caps:     localCaps,
 	})
+	if err != nil {
+		return err
+	}
+
+	i.announced.set(socketId, peerProto{version: ProtoVersion, caps: localCaps})
+	return nil
 }
 
 func (i *Ipc) ListenCreateMsg() (chan CreateMsg, error) {
@@ -216,3 +554,7 @@ func (i *Ipc) ListenMeasureMsg() (chan MeasureMsg, error) {
 func (i *Ipc) ListenPatternMsg() (chan PatternMsg, error) {
 	return i.PatternNotify, nil
 }
+
+func (i *Ipc) ListenCloseMsg() (chan CloseMsg, error) {
+	return i.CloseNotify, nil
+}
@@ -0,0 +1,124 @@
+package ipc
+
+import (
+	"sync"
+
+	flowPattern "ccp/ccpFlow/pattern"
+)
+
+// wire protocol negotiation
+
+// capabilities a peer advertises in its HELLO message
+const (
+	// peer can parse framed headers with a 32 bit length
+	CapLongLen uint32 = 1 << iota
+	// peer can parse MEASURE messages carrying the extended fields
+	CapExtMeasure
+	// peer can run patterns with SETCWNDREL, ACKINCR, REPEAT and IF events
+	CapPatternCtl
+	// peer can parse PATTERN rates and factors as IEEE 754 float32s
+	CapFloatPattern
+	// peer can aggregate acks for AGGREGATE messages, and parse MEASURE
+	// messages carrying the aggregates after the extended fields
+	CapAggregate
+	// peer's CREATE messages describe what its datapath supports.
+	// unlike the others, this says how the peer writes rather than what
+	// it can parse, so a reader knows which CREATE layout to expect.
+	CapCreateInfo
+	// peer can parse headers carrying a sequence number,
+	// and acknowledges every PATTERN which carries one
+	CapSeqNo
+	// peer can parse BATCH messages
+	CapBatch
+)
+
+// the capabilities this implementation advertises
+const localCaps = CapLongLen | CapExtMeasure | CapPatternCtl | CapFloatPattern | CapAggregate | CapCreateInfo | CapSeqNo | CapBatch
+
+type peerProto struct {
+	version uint8
+	caps    uint32
+	// the flow's packet size, if its CREATE said
+	mss uint32
+}
+
+/* The protocol spoken by the peer on each socket.
+ * Peers that never sent a HELLO are assumed to only speak the legacy
+ * format. The CCP learns about a peer on its listening Ipc but talks to
+ * it on a separate per-flow sending Ipc, so SetupCcpSend hands the
+ * listening Ipc's table to the sending ones.
+ */
+type peerTable struct {
+	mux   sync.RWMutex
+	peers map[uint32]peerProto
+}
+
+func newPeerTable() *peerTable {
+	return &peerTable{peers: make(map[uint32]peerProto)}
+}
+
+func (t *peerTable) set(socketId uint32, p peerProto) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	t.peers[socketId] = p
+}
+
+func (t *peerTable) get(socketId uint32) (p peerProto, ok bool) {
+	t.mux.RLock()
+	defer t.mux.RUnlock()
+	p, ok = t.peers[socketId]
+	return
+}
+
+// setMss records the packet size from socketId's CREATE. Only peers
+// which sent a HELLO say what it is.
+func (t *peerTable) setMss(socketId uint32, mss uint32) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	if p, ok := t.peers[socketId]; ok {
+		p.mss = mss
+		t.peers[socketId] = p
+	}
+}
+
+func (t *peerTable) forget(socketId uint32) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	delete(t.peers, socketId)
+}
+
+// the protocol to use when writing to socketId:
+// the newest version both sides speak, and the peer's capabilities
+func (i *Ipc) peerProto(socketId uint32) peerProto {
+	p, ok := i.peers.get(socketId)
+	if !ok {
+		return peerProto{version: legacyVersion}
+	}
+
+	if p.version > ProtoVersion {
+		p.version = ProtoVersion
+	}
+
+	return p
+}
+
+// the pattern events a peer which does not list them can run
+func (i *Ipc) impliedEvents(socketId uint32) flowPattern.EventSet {
+	if i.peerProto(socketId).caps&CapPatternCtl != 0 {
+		return flowPattern.AllEvents
+	}
+
+	return flowPattern.BasicEvents
+}
+
+// PeerVersion returns the wire protocol version negotiated with socketId
+func (i *Ipc) PeerVersion(socketId uint32) uint8 {
+	return i.peerProto(socketId).version
+}
+
+// Forget drops what the Ipc learned about socketId's peer, for flows which
+// end without a CLOSE, so the next flow on the socket id starts afresh
+func (i *Ipc) Forget(socketId uint32) {
+	i.peers.forget(socketId)
+	i.seq.reset(socketId)
+}
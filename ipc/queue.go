@@ -0,0 +1,314 @@
+package ipc
+
+import (
+	"fmt"
+	"sync"
+)
+
+/* Notify queues.
+ * By default demux hands each message to its Notify channel and waits for
+ * the consumer to take it, so one slow consumer holds up every message
+ * behind it, for every socket. A queue lets demux move on: up to Len
+ * messages of a type wait for the consumer, and the policy says what
+ * happens to the next one once they are full.
+ *
+ * Queued types no longer wait for each other: a MEASURE may be delivered
+ * before the CREATE ahead of it has been taken. Nor do sockets: each
+ * socket's messages are delivered in order, but a socket whose Handler is
+ * slow only holds up its own.
+ */
+
+type QueuePolicy int
+
+const (
+	// demux waits for room
+	Block QueuePolicy = iota
+	// the oldest waiting message makes room
+	DropOldest
+	// a MEASURE replaces any still waiting for the same socket,
+	// else the oldest waiting message makes room
+	CoalesceLatest
+)
+
+func (p QueuePolicy) String() string {
+	switch p {
+	case Block:
+		return "block"
+	case DropOldest:
+		return "drop-oldest"
+	case CoalesceLatest:
+		return "coalesce-latest"
+	default:
+		return fmt.Sprintf("QueuePolicy(%d)", int(p))
+	}
+}
+
+// QueueConfig bounds the messages of one type waiting for their consumer.
+// The zero value hands each message over as it arrives.
+type QueueConfig struct {
+	Len    int
+	Policy QueuePolicy
+}
+
+// QueueStats counts what a queue did to keep within its bounds
+type QueueStats struct {
+	// messages waiting now
+	Queued int
+	// messages discarded to make room
+	Dropped uint64
+	// messages replaced by a later one for the same socket
+	Coalesced uint64
+}
+
+type queuedMsg struct {
+	socketId uint32
+	msg      interface{}
+	// closed once msg is delivered or dropped, if push waits for it
+	done chan interface{}
+}
+
+type notifyQueue struct {
+	mux sync.Mutex
+	// signalled whenever items changes
+	cond *sync.Cond
+	cfg  QueueConfig
+	// waiting messages, oldest first
+	items []queuedMsg
+	stats QueueStats
+	// the sockets a pump is delivering to
+	pumping map[uint32]bool
+	deliver func(uint32, interface{})
+}
+
+func newNotifyQueue(deliver func(uint32, interface{})) *notifyQueue {
+	q := &notifyQueue{
+		pumping: make(map[uint32]bool),
+		deliver: deliver,
+	}
+	q.cond = sync.NewCond(&q.mux)
+	return q
+}
+
+// the queued message types, and where each is delivered
+// if no Handler takes it
+func (i *Ipc) setupQueues() {
+	i.queues = map[msgType]*notifyQueue{
+		CREATE: i.newNotifyQueue(func(m interface{}, handled <-chan interface{}) bool {
+			select {
+			case i.CreateNotify <- m.(CreateMsg):
+				return true
+			case <-handled:
+				return false
+			}
+		}),
+		MEASURE: i.newNotifyQueue(func(m interface{}, handled <-chan interface{}) bool {
+			select {
+			case i.MeasureNotify <- m.(MeasureMsg):
+				return true
+			case <-handled:
+				return false
+			}
+		}),
+		DROP: i.newNotifyQueue(func(m interface{}, handled <-chan interface{}) bool {
+			select {
+			case i.DropNotify <- m.(DropMsg):
+				return true
+			case <-handled:
+				return false
+			}
+		}),
+		PATTERN: i.newNotifyQueue(func(m interface{}, handled <-chan interface{}) bool {
+			select {
+			case i.PatternNotify <- m.(PatternMsg):
+				return true
+			case <-handled:
+				return false
+			}
+		}),
+		CLOSE: i.newNotifyQueue(func(m interface{}, handled <-chan interface{}) bool {
+			select {
+			case i.CloseNotify <- m.(CloseMsg):
+				return true
+			case <-handled:
+				return false
+			}
+		}),
+		AGGREGATE: i.newNotifyQueue(func(m interface{}, handled <-chan interface{}) bool {
+			select {
+			case i.AggregateNotify <- m.(AggregateMsg):
+				return true
+			case <-handled:
+				return false
+			}
+		}),
+	}
+}
+
+// a queue which delivers to the message's Handler, else with notify to its
+// Notify channel. notify gives up once handled closes, since a Handler
+// registered while it waited takes the message instead.
+func (i *Ipc) newNotifyQueue(notify func(m interface{}, handled <-chan interface{}) bool) *notifyQueue {
+	return newNotifyQueue(func(socketId uint32, m interface{}) {
+		for !i.dispatch(socketId, m) {
+			if notify(m, i.router.handled()) {
+				return
+			}
+		}
+	})
+}
+
+/* SetQueue bounds how many messages of type typ (CREATE, MEASURE, DROP,
+ * PATTERN, CLOSE or AGGREGATE) wait for their consumer, and what happens
+ * to the next one once that many are waiting. Only MEASUREs coalesce.
+ */
+func (i *Ipc) SetQueue(typ msgType, cfg QueueConfig) error {
+	q, ok := i.queues[typ]
+	if !ok {
+		return fmt.Errorf("message type %d is not queued", typ)
+	}
+
+	if cfg.Len < 0 {
+		return fmt.Errorf("negative queue length %d", cfg.Len)
+	}
+
+	if cfg.Policy == CoalesceLatest && typ != MEASURE {
+		return fmt.Errorf("only MEASURE messages coalesce")
+	}
+
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	q.cfg = cfg
+	if cfg.Len > 0 && cfg.Policy != Block {
+		for len(q.items) > cfg.Len {
+			q.dropOldest()
+		}
+	}
+
+	q.cond.Broadcast()
+	return nil
+}
+
+// QueueStats returns the counters of the queue for type typ
+func (i *Ipc) QueueStats(typ msgType) QueueStats {
+	q, ok := i.queues[typ]
+	if !ok {
+		return QueueStats{}
+	}
+
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	st := q.stats
+	st.Queued = len(q.items)
+	return st
+}
+
+// notify delivers msg, of type typ, to its consumer, or queues it
+func (i *Ipc) notify(typ msgType, socketId uint32, msg interface{}) {
+	i.queues[typ].push(socketId, msg)
+}
+
+// push is only called from demux, so there is one producer
+func (q *notifyQueue) push(socketId uint32, msg interface{}) {
+	q.mux.Lock()
+	if q.cfg.Len == 0 && !q.pumping[socketId] {
+		// nothing ahead of msg: hand it over directly
+		q.mux.Unlock()
+		q.deliver(socketId, msg)
+		return
+	}
+
+	if limit, policy := q.bounds(); policy == CoalesceLatest {
+		for k := range q.items {
+			if q.items[k].socketId == socketId {
+				q.items[k].msg = msg
+				q.stats.Coalesced++
+				q.mux.Unlock()
+				return
+			}
+		}
+	} else if policy == Block {
+		for len(q.items) >= limit {
+			q.cond.Wait()
+			limit, _ = q.bounds()
+		}
+	}
+
+	// make room
+	for limit, policy := q.bounds(); len(q.items) >= limit && policy != Block; {
+		q.dropOldest()
+	}
+
+	m := queuedMsg{socketId: socketId, msg: msg}
+	if q.cfg.Len == 0 {
+		// unqueued: wait for the consumer, as if handing it over directly
+		m.done = make(chan interface{})
+	}
+
+	q.items = append(q.items, m)
+	if !q.pumping[socketId] {
+		q.pumping[socketId] = true
+		go q.pump(socketId)
+	}
+
+	q.cond.Broadcast()
+	q.mux.Unlock()
+
+	if m.done != nil {
+		<-m.done
+	}
+}
+
+// how many messages may wait, and the policy once they do.
+// an unqueued type being drained after reconfiguring keeps to one at a time.
+func (q *notifyQueue) bounds() (int, QueuePolicy) {
+	if q.cfg.Len == 0 {
+		return 1, Block
+	}
+
+	return q.cfg.Len, q.cfg.Policy
+}
+
+func (q *notifyQueue) dropOldest() {
+	if done := q.items[0].done; done != nil {
+		close(done)
+	}
+
+	q.items = q.items[1:]
+	q.stats.Dropped++
+}
+
+// take the oldest message waiting for socketId, if any
+func (q *notifyQueue) take(socketId uint32) (queuedMsg, bool) {
+	for k, m := range q.items {
+		if m.socketId == socketId {
+			copy(q.items[k:], q.items[k+1:])
+			q.items = q.items[:len(q.items)-1]
+			q.cond.Broadcast()
+			return m, true
+		}
+	}
+
+	return queuedMsg{}, false
+}
+
+// pump delivers socketId's queued messages in order, until there are none
+func (q *notifyQueue) pump(socketId uint32) {
+	q.mux.Lock()
+	for {
+		m, ok := q.take(socketId)
+		if !ok {
+			break
+		}
+
+		q.mux.Unlock()
+		q.deliver(m.socketId, m.msg)
+		if m.done != nil {
+			close(m.done)
+		}
+
+		q.mux.Lock()
+	}
+
+	delete(q.pumping, socketId)
+	q.mux.Unlock()
+}
@@ -0,0 +1,201 @@
+package ipc
+
+import (
+	"testing"
+	"time"
+)
+
+// wait until the queue for typ holds n messages
+func waitQueued(t *testing.T, i *Ipc, typ msgType, n int) {
+	deadline := time.Now().Add(time.Second)
+	for i.QueueStats(typ).Queued != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d queued, got %+v", n, i.QueueStats(typ))
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestQueueCoalesce(t *testing.T) {
+	i, err := testSetup(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer i.Close()
+
+	if err = i.SetQueue(MEASURE, QueueConfig{Len: 4, Policy: CoalesceLatest}); err != nil {
+		t.Fatal(err)
+	}
+
+	a, b := testNum+22, testNum+23
+
+	// the first is on its way to the consumer, so never coalesces
+	i.notify(MEASURE, a, MeasureMsg{socketId: a, ackNo: 1})
+	waitQueued(t, i, MEASURE, 0)
+	i.notify(MEASURE, a, MeasureMsg{socketId: a, ackNo: 2})
+	i.notify(MEASURE, a, MeasureMsg{socketId: a, ackNo: 3})
+
+	if st := i.QueueStats(MEASURE); st.Queued != 1 || st.Coalesced != 1 || st.Dropped != 0 {
+		t.Errorf("expected 1 queued and 1 coalesced, got %+v", st)
+	}
+
+	// b's messages are not held up behind a's
+	i.notify(MEASURE, b, MeasureMsg{socketId: b, ackNo: 1})
+
+	outMsgCh, _ := i.ListenMeasureMsg()
+	expected := map[uint32][]uint32{a: {1, 3}, b: {1}}
+	for k := 0; k < 3; k++ {
+		select {
+		case out := <-outMsgCh:
+			acks := expected[out.SocketId()]
+			if len(acks) == 0 || out.AckNo() != acks[0] {
+				t.Errorf("got (%d, %d), expected one of %v", out.SocketId(), out.AckNo(), expected)
+				continue
+			}
+
+			expected[out.SocketId()] = acks[1:]
+		case <-time.After(time.Second):
+			t.Fatal("timed out")
+		}
+	}
+}
+
+func TestQueuePerSocket(t *testing.T) {
+	i, err := testSetup(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer i.Close()
+
+	if err = i.SetQueue(MEASURE, QueueConfig{Len: 4, Policy: CoalesceLatest}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a's handler takes nothing
+	a, b := testNum+22, testNum+23
+	stuck, h := &recordingHandler{msgs: make(chan interface{})}, newRecordingHandler()
+	i.HandleSocket(a, stuck)
+	i.HandleSocket(b, h)
+
+	i.notify(MEASURE, a, MeasureMsg{socketId: a, ackNo: 1})
+	waitQueued(t, i, MEASURE, 0)
+	i.notify(MEASURE, a, MeasureMsg{socketId: a, ackNo: 2})
+	for ack := uint32(1); ack <= 3; ack++ {
+		i.notify(MEASURE, b, MeasureMsg{socketId: b, ackNo: ack})
+		if m, ok := h.next(t).(MeasureMsg); !ok || m.AckNo() != ack {
+			t.Errorf("expected ack %d for %d, got %v", ack, b, m)
+		}
+	}
+
+	if m, ok := (<-stuck.msgs).(MeasureMsg); !ok || m.AckNo() != 1 {
+		t.Errorf("expected ack 1 for %d, got %v", a, m)
+	}
+
+	if m, ok := stuck.next(t).(MeasureMsg); !ok || m.AckNo() != 2 {
+		t.Errorf("expected ack 2 for %d, got %v", a, m)
+	}
+}
+
+func TestQueueDropOldest(t *testing.T) {
+	i, err := testSetup(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer i.Close()
+
+	if err = i.SetQueue(DROP, QueueConfig{Len: 2, Policy: DropOldest}); err != nil {
+		t.Fatal(err)
+	}
+
+	sid := testNum + 22
+	i.notify(DROP, sid, DropMsg{socketId: sid, event: "0"})
+	waitQueued(t, i, DROP, 0)
+	for _, ev := range []string{"1", "2", "3"} {
+		i.notify(DROP, sid, DropMsg{socketId: sid, event: ev})
+	}
+
+	if st := i.QueueStats(DROP); st.Queued != 2 || st.Dropped != 1 {
+		t.Errorf("expected 2 queued and 1 dropped, got %+v", st)
+	}
+
+	outMsgCh, _ := i.ListenDropMsg()
+	for _, expected := range []string{"0", "2", "3"} {
+		select {
+		case out := <-outMsgCh:
+			if out.Event() != expected {
+				t.Errorf("got %s, expected %s", out.Event(), expected)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timed out")
+		}
+	}
+}
+
+func TestQueueBlock(t *testing.T) {
+	i, err := testSetup(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer i.Close()
+
+	if err = i.SetQueue(DROP, QueueConfig{Len: 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	sid := testNum + 22
+	i.notify(DROP, sid, DropMsg{socketId: sid, event: "0"})
+	waitQueued(t, i, DROP, 0)
+	i.notify(DROP, sid, DropMsg{socketId: sid, event: "1"})
+	i.notify(DROP, sid, DropMsg{socketId: sid, event: "2"})
+
+	// the queue is full, so the next waits for room
+	pushed := make(chan interface{})
+	go func() {
+		i.notify(DROP, sid, DropMsg{socketId: sid, event: "3"})
+		close(pushed)
+	}()
+
+	select {
+	case <-pushed:
+		t.Fatal("expected a full queue to block")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	outMsgCh, _ := i.ListenDropMsg()
+	for _, expected := range []string{"0", "1", "2", "3"} {
+		select {
+		case out := <-outMsgCh:
+			if out.Event() != expected {
+				t.Errorf("got %s, expected %s", out.Event(), expected)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timed out")
+		}
+	}
+
+	<-pushed
+	if st := i.QueueStats(DROP); st.Dropped != 0 {
+		t.Errorf("expected nothing dropped, got %+v", st)
+	}
+}
+
+func TestSetQueue(t *testing.T) {
+	i, err := testSetup(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer i.Close()
+
+	if err = i.SetQueue(DROP, QueueConfig{Len: 1, Policy: CoalesceLatest}); err == nil {
+		t.Error("expected only MEASUREs to coalesce")
+	}
+
+	if err = i.SetQueue(HELLO, QueueConfig{Len: 1}); err == nil {
+		t.Error("expected HELLOs not to be queued")
+	}
+
+	if err = i.SetQueue(MEASURE, QueueConfig{Len: -1}); err == nil {
+		t.Error("expected a negative length to be refused")
+	}
+}
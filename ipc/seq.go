@@ -0,0 +1,248 @@
+package ipc
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/* Sequence numbers and PATTERN retransmission.
+ * Both backends can lose messages, and unix datagrams can arrive out of
+ * order. Messages to peers which advertise CapSeqNo carry a per-socket
+ * sequence number, so the receiving demux can count gaps and reordering,
+ * and discard PATTERNs a newer one has already superseded.
+ * Such peers also acknowledge every PATTERN, so the sender can optionally
+ * retransmit a flow's latest pattern until it arrives.
+ */
+
+// the most times a PATTERN is retransmitted before giving up on it
+const maxPatternRetries = 5
+
+// SeqStats counts what sequence numbers revealed on one Ipc
+type SeqStats struct {
+	// messages missing from a sequence when a later one arrived.
+	// they may still arrive, out of order.
+	Gaps uint64
+	// messages which arrived after a later one, or twice
+	Reordered uint64
+	// PATTERNs sent again for want of an ack
+	Retransmits uint64
+	// PATTERNs given up on after maxPatternRetries
+	Unacked uint64
+}
+
+type seqState struct {
+	mux sync.Mutex
+	// the next sequence number to send, and to receive, on each socket
+	tx map[uint32]uint32
+	rx map[uint32]uint32
+	// the newest PATTERN delivered on each socket
+	pattern map[uint32]uint32
+	stats   SeqStats
+	// how long to wait for a PATTERN's ack; 0 to never retransmit
+	retxTimeout time.Duration
+}
+
+func newSeqState() *seqState {
+	return &seqState{
+		tx:      make(map[uint32]uint32),
+		rx:      make(map[uint32]uint32),
+		pattern: make(map[uint32]uint32),
+	}
+}
+
+// the protocol to write to socketId with, and the message's sequence number
+func (i *Ipc) wire(socketId uint32) (peerProto, uint32) {
+	proto := i.peerProto(socketId)
+	if proto.caps&CapSeqNo == 0 {
+		return proto, 0
+	}
+
+	s := i.seq
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	seq := s.tx[socketId]
+	s.tx[socketId] = seq + 1
+	return proto, seq
+}
+
+// received checks a sequenced message against those before it,
+// returning whether a later message already arrived
+func (s *seqState) received(socketId uint32, seq uint32) (late bool) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	expected, ok := s.rx[socketId]
+	if !ok {
+		s.rx[socketId] = seq + 1
+		return false
+	}
+
+	switch d := int32(seq - expected); {
+	case d == 0:
+		s.rx[socketId] = seq + 1
+	case d > 0:
+		s.stats.Gaps += uint64(d)
+		s.rx[socketId] = seq + 1
+		log.WithFields(log.Fields{
+			"sockid":   socketId,
+			"seq":      seq,
+			"expected": expected,
+		}).Warn("messages missing")
+	default:
+		s.stats.Reordered++
+		log.WithFields(log.Fields{
+			"sockid":   socketId,
+			"seq":      seq,
+			"expected": expected,
+		}).Warn("message out of order")
+		return true
+	}
+
+	return false
+}
+
+// a HELLO or CLOSE ends the socket's sequence; the next message starts anew
+func (s *seqState) reset(socketId uint32) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	delete(s.rx, socketId)
+	delete(s.pattern, socketId)
+}
+
+// newPattern reports whether the PATTERN numbered seq is newer than every
+// one delivered on socketId so far, and if so records it as delivered.
+// Other messages arriving first do not make a PATTERN stale.
+func (s *seqState) newPattern(socketId uint32, seq uint32) bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if last, ok := s.pattern[socketId]; ok && int32(seq-last) <= 0 {
+		return false
+	}
+
+	s.pattern[socketId] = seq
+	return true
+}
+
+// SeqStats returns what sequence numbers revealed so far
+func (i *Ipc) SeqStats() SeqStats {
+	i.seq.mux.Lock()
+	defer i.seq.mux.Unlock()
+	return i.seq.stats
+}
+
+/* SetPatternRetransmit makes the Ipc send each flow's latest PATTERN again
+ * every timeout until the datapath acknowledges it, up to
+ * maxPatternRetries times. Only datapaths which advertise CapSeqNo
+ * acknowledge patterns. A timeout of 0 turns retransmission off.
+ */
+func (i *Ipc) SetPatternRetransmit(timeout time.Duration) {
+	i.seq.mux.Lock()
+	defer i.seq.mux.Unlock()
+	i.seq.retxTimeout = timeout
+}
+
+type unackedPattern struct {
+	ipc   *Ipc
+	msg   *PatternMsg
+	tries int
+	timer *time.Timer
+}
+
+/* The latest unacknowledged PATTERN on each socket.
+ * Like the peer table, a listening Ipc shares its table with the Ipcs
+ * SetupCcpSend makes from it: the CCP sends a flow's patterns on its
+ * per-flow Ipc, but the acks arrive on its listening one.
+ * Sending a newer pattern replaces the entry, since only the latest
+ * pattern matters.
+ */
+type retxTable struct {
+	mux     sync.Mutex
+	pending map[uint32]*unackedPattern
+}
+
+func newRetxTable() *retxTable {
+	return &retxTable{pending: make(map[uint32]*unackedPattern)}
+}
+
+func (t *retxTable) track(i *Ipc, msg *PatternMsg, timeout time.Duration) {
+	u := &unackedPattern{ipc: i, msg: msg}
+
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	if old, ok := t.pending[msg.socketId]; ok {
+		old.timer.Stop()
+	}
+
+	u.timer = time.AfterFunc(timeout, func() { t.expire(u, timeout) })
+	t.pending[msg.socketId] = u
+}
+
+func (t *retxTable) expire(u *unackedPattern, timeout time.Duration) {
+	t.mux.Lock()
+	if t.pending[u.msg.socketId] != u {
+		// acked, or superseded
+		t.mux.Unlock()
+		return
+	}
+
+	s := u.ipc.seq
+	if u.tries >= maxPatternRetries {
+		delete(t.pending, u.msg.socketId)
+		t.mux.Unlock()
+		s.mux.Lock()
+		s.stats.Unacked++
+		s.mux.Unlock()
+		log.WithFields(log.Fields{
+			"sockid":  u.msg.socketId,
+			"seq":     u.msg.seq,
+			"pattern": u.msg.pattern,
+		}).Warn("pattern never acknowledged")
+		return
+	}
+
+	u.tries++
+	t.mux.Unlock()
+
+	// a send may block, and acks must not wait behind it
+	s.mux.Lock()
+	s.stats.Retransmits++
+	s.mux.Unlock()
+	err := u.ipc.sendMsg(u.msg.socketId, u.msg)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"sockid": u.msg.socketId,
+			"seq":    u.msg.seq,
+			"err":    err,
+		}).Warn("failed to retransmit pattern")
+	}
+
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	if t.pending[u.msg.socketId] == u {
+		u.timer.Reset(timeout)
+	}
+}
+
+func (t *retxTable) acked(socketId uint32, seq uint32) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	if u, ok := t.pending[socketId]; ok && u.msg.seq == seq {
+		u.timer.Stop()
+		delete(t.pending, socketId)
+	}
+}
+
+// stop retransmitting what i sent, once it is closed
+func (t *retxTable) forget(i *Ipc) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	for sid, u := range t.pending {
+		if u.ipc == i {
+			u.timer.Stop()
+			delete(t.pending, sid)
+		}
+	}
+}
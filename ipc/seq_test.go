@@ -0,0 +1,232 @@
+package ipc
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"ccp/ccpFlow/pattern"
+	"ccp/ipcBackend"
+)
+
+func TestSeqReceived(t *testing.T) {
+	s := newSeqState()
+	for _, c := range []struct {
+		seq  uint32
+		late bool
+	}{
+		// the first message starts the sequence wherever it is
+		{seq: 7},
+		{seq: 8},
+		{seq: 10},
+		{seq: 9, late: true},
+		{seq: 10, late: true},
+		{seq: 11},
+	} {
+		if late := s.received(testNum, c.seq); late != c.late {
+			t.Errorf("seq %d: late %v, expected %v", c.seq, late, c.late)
+		}
+	}
+
+	if s.stats.Gaps != 1 || s.stats.Reordered != 2 {
+		t.Errorf("expected 1 gap and 2 reordered, got %+v", s.stats)
+	}
+
+	// a new session may start anywhere
+	s.reset(testNum)
+	if s.received(testNum, 0) {
+		t.Error("expected the first message after a reset to be in order")
+	}
+
+	// sequence numbers wrap
+	s.received(testNum+1, ^uint32(0))
+	if s.received(testNum+1, 0) || s.stats.Gaps != 1 {
+		t.Errorf("expected wrapping to be in order, got %+v", s.stats)
+	}
+}
+
+func TestSeqNewPattern(t *testing.T) {
+	s := newSeqState()
+	if !s.newPattern(testNum, 4) {
+		t.Error("expected the first pattern to be delivered")
+	}
+
+	// a PATTERN delayed behind another message still arrives first
+	// among PATTERNs, so it is delivered
+	s.received(testNum, 4)
+	s.received(testNum, 6)
+	if !s.received(testNum, 5) {
+		t.Error("expected seq 5 to arrive late")
+	}
+
+	if !s.newPattern(testNum, 5) {
+		t.Error("expected a late pattern with no newer one to be delivered")
+	}
+
+	// but not once a newer one has been, nor twice
+	for _, seq := range []uint32{3, 5} {
+		if s.newPattern(testNum, seq) {
+			t.Errorf("expected pattern %d to be stale", seq)
+		}
+	}
+
+	s.reset(testNum)
+	if !s.newPattern(testNum, 0) {
+		t.Error("expected the first pattern after a reset to be delivered")
+	}
+}
+
+// a pattern the peer cannot take leaves no gap in the sequence
+func TestRejectedPatternSeq(t *testing.T) {
+	i, err := testSetup(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer i.Close()
+
+	sid := testNum + 29
+	i.peers.set(sid, peerProto{version: ProtoVersion, caps: CapSeqNo})
+	p, err := pattern.NewPattern().Repeat(2, pattern.NewPattern().WaitRtts(1.0)).Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = i.SendPatternMsg(sid, p); err == nil {
+		t.Fatal("expected a peer without CapPatternCtl to refuse a REPEAT")
+	}
+
+	i.seq.mux.Lock()
+	next := i.seq.tx[sid]
+	i.seq.mux.Unlock()
+	if next != 0 {
+		t.Errorf("expected no sequence number taken, next is %d", next)
+	}
+}
+
+// drops the first PATTERNs it is asked to send
+type lossyBackend struct {
+	*MockBackend
+
+	mux  sync.Mutex
+	drop int
+}
+
+func (l *lossyBackend) SendMsg(msg ipcbackend.Msg) error {
+	if _, ok := msg.(*PatternMsg); ok {
+		l.mux.Lock()
+		lose := l.drop > 0
+		if lose {
+			l.drop--
+		}
+		l.mux.Unlock()
+
+		if lose {
+			return nil
+		}
+	}
+
+	return l.MockBackend.SendMsg(msg)
+}
+
+func TestPatternRetransmit(t *testing.T) {
+	back := &lossyBackend{MockBackend: NewMockBackend(false).(*MockBackend), drop: 2}
+	i, err := SetupWithBackend(back)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer i.Close()
+
+	sid := testNum + 17
+	i.peers.set(sid, peerProto{version: ProtoVersion, caps: CapSeqNo})
+	i.SetPatternRetransmit(5 * time.Millisecond)
+
+	p, err := pattern.NewPattern().Cwnd(testNum).WaitRtts(1.0).Report().Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	outMsgCh, _ := i.ListenPatternMsg()
+	if err = i.SendPatternMsg(sid, p); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case out := <-outMsgCh:
+		if out.SocketId() != sid || len(out.Pattern().Sequence) != 3 {
+			t.Errorf("wrong pattern %v", out.Pattern())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("pattern never arrived")
+	}
+
+	// once acked, the pattern is not sent again
+	deadline := time.Now().Add(time.Second)
+	for {
+		i.retx.mux.Lock()
+		_, pending := i.retx.pending[sid]
+		i.retx.mux.Unlock()
+		if !pending {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("pattern never acknowledged")
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	sent := i.SeqStats().Retransmits
+	time.Sleep(20 * time.Millisecond)
+	if st := i.SeqStats(); st.Retransmits != sent || sent < 2 || st.Unacked != 0 {
+		t.Errorf("expected 2 retransmissions before the ack and none after, got %+v", st)
+	}
+
+	select {
+	case out := <-outMsgCh:
+		t.Errorf("pattern delivered twice: %v", out.Pattern())
+	default:
+	}
+}
+
+func TestRetxPerIpc(t *testing.T) {
+	sid := testNum + 29
+	p, err := pattern.NewPattern().Cwnd(testNum).WaitRtts(1.0).Report().Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ipcs []*Ipc
+	for k := 0; k < 2; k++ {
+		// a peer which never acks
+		back := &lossyBackend{MockBackend: NewMockBackend(false).(*MockBackend), drop: 1000}
+		i, err := SetupWithBackend(back)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer i.Close()
+
+		i.peers.set(sid, peerProto{version: ProtoVersion, caps: CapSeqNo})
+		i.SetPatternRetransmit(time.Hour)
+		if err = i.SendPatternMsg(sid, p); err != nil {
+			t.Fatal(err)
+		}
+
+		ipcs = append(ipcs, i)
+	}
+
+	// both sent the same sequence number on the same socket id; an ack
+	// for one leaves the other waiting
+	ipcs[0].retx.mux.Lock()
+	seq := ipcs[0].retx.pending[sid].msg.seq
+	ipcs[0].retx.mux.Unlock()
+	ipcs[0].retx.acked(sid, seq)
+	for k, i := range ipcs {
+		i.retx.mux.Lock()
+		_, pending := i.retx.pending[sid]
+		i.retx.mux.Unlock()
+		if pending != (k == 1) {
+			t.Errorf("ipc %d: pending %v", k, pending)
+		}
+	}
+}
@@ -4,9 +4,11 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"math"
 	"time"
 
 	flowPattern "ccp/ccpFlow/pattern"
+	"ccp/ipcBackend"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -20,72 +22,261 @@ const (
 	MEASURE
 	DROP
 	PATTERN
+	HELLO
+	CLOSE
+	AGGREGATE
+	PATTERNACK
+	BATCH
+)
+
+// wire protocol versions
+const (
+	// the original (type, len, socket_id) framing with a 1 byte length
+	legacyVersion uint8 = 0
+	// framed header with a version byte and a 16 or 32 bit length
+	ProtoVersion uint8 = 1
+)
+
+// flags carried in the top bits of the type byte of a framed header
+const (
+	framedFlag  uint8 = 0x80
+	longLenFlag uint8 = 0x40
+	seqFlag     uint8 = 0x20
+	typeMask    uint8 = 0x1f
+)
+
+// fields an extended MEASURE carries after the basic ones
+const (
+	extMeasureU32s = 1
+	extMeasureU64s = 5
+)
+
+// fields a MEASURE with aggregates carries after the extended ones
+const (
+	aggMeasureU32s = 6
+	aggMeasureU64s = 2
+)
+
+const (
+	legacyHeaderLen = 6
+	shortHeaderLen  = 8
+	longHeaderLen   = 10
+	// a framed header with seqFlag set is this much longer
+	seqLen = 4
 )
 
 /* Messages: header followed by 0+ uint32s, then 0+ uint64s, then 0-1 strings
  */
 type ipcMsg struct {
 	typ      msgType
-	len      uint8
+	proto    peerProto
+	len      uint32
 	socketId uint32
-	u32s     []uint32
-	u64s     []uint64
-	str      string
+	// written if the peer advertises CapSeqNo
+	seq uint32
+	// whether the message read carried seq
+	sequenced bool
+	u32s      []uint32
+	u64s      []uint64
+	str       string
 }
 
-/* (type, len, socket_id) header
+/* legacy (type, len, socket_id) header
  * -----------------------------------
  * | Msg Type | Len (B)  | Uint32    |
  * | (1 B)    | (1 B)    | (32 bits) |
  * -----------------------------------
  * total: 6 Bytes
+ *
+ * framed (flags|type, version, len, socket_id) header
+ * ---------------------------------------------------------
+ * | Flags|Type | Version | Len (B)         | Uint32    |
+ * | (1 B)      | (1 B)   | (16 || 32 bits) | (32 bits) |
+ * ---------------------------------------------------------
+ * total: 8 || 10 Bytes
+ *
+ * The top bit of the first byte marks a framed header, so a reader can
+ * always tell the two apart: legacy message types never set it.
+ * The second-highest bit selects the 32 bit length, and the third a
+ * 32 bit sequence number after the socket id.
  */
 func readHeader(b []byte) (
 	typ msgType,
-	l uint8,
+	version uint8,
+	l uint32,
 	socketId uint32,
+	seq uint32,
+	sequenced bool,
+	hdrLen int,
 	err error,
 ) {
-	err = nil
-	if len(b) < 6 {
+	if len(b) < legacyHeaderLen {
+		err = fmt.Errorf("unable to read header")
+		return
+	}
+
+	if b[0]&framedFlag == 0 {
+		typ = msgType(b[0])
+		version = legacyVersion
+		l = uint32(b[1])
+		socketId = binary.LittleEndian.Uint32(b[2:6])
+		hdrLen = legacyHeaderLen
+		return
+	}
+
+	typ = msgType(b[0] & typeMask)
+	version = b[1]
+	if version > ProtoVersion {
+		err = fmt.Errorf("unsupported protocol version %d", version)
+		return
+	}
+
+	if b[0]&longLenFlag == 0 {
+		hdrLen = shortHeaderLen
+	} else {
+		hdrLen = longHeaderLen
+	}
+
+	sidEnd := hdrLen
+	sequenced = b[0]&seqFlag != 0
+	if sequenced {
+		hdrLen += seqLen
+	}
+
+	if len(b) < hdrLen {
 		err = fmt.Errorf("unable to read header")
 		return
 	}
 
-	hdr := bytes.NewBuffer(b[:6])
-	err = binary.Read(hdr, binary.LittleEndian, &typ)
-	err = binary.Read(hdr, binary.LittleEndian, &l)
-	err = binary.Read(hdr, binary.LittleEndian, &socketId)
+	if b[0]&longLenFlag == 0 {
+		l = uint32(binary.LittleEndian.Uint16(b[2:4]))
+	} else {
+		l = binary.LittleEndian.Uint32(b[2:6])
+	}
+
+	socketId = binary.LittleEndian.Uint32(b[sidEnd-4 : sidEnd])
+	if sequenced {
+		seq = binary.LittleEndian.Uint32(b[sidEnd:hdrLen])
+	}
+
 	return
 }
 
+// socketIdOffset is where b's header keeps its socket id,
+// for backends which route messages by it
+func socketIdOffset(b []byte) (int, error) {
+	if len(b) < legacyHeaderLen {
+		return 0, fmt.Errorf("unable to read header")
+	}
+
+	switch {
+	case b[0]&framedFlag == 0:
+		return 2, nil
+	case b[0]&longLenFlag == 0:
+		return shortHeaderLen - 4, nil
+	default:
+		return longHeaderLen - 4, nil
+	}
+}
+
+// the most bytes of events a PATTERN to a peer speaking proto carries,
+// after the header and the event count
+func maxPatternSize(proto peerProto) int {
+	body := -4
+	if proto.caps&CapSeqNo != 0 {
+		body -= seqLen
+	}
+
+	switch {
+	case proto.version == legacyVersion:
+		return math.MaxUint8 - legacyHeaderLen - 4
+	case proto.caps&CapLongLen != 0:
+		return math.MaxInt32 - longHeaderLen + body
+	default:
+		return math.MaxUint16 - shortHeaderLen + body
+	}
+}
+
+// writeHeader picks the smallest header the peer can parse which is able
+// to describe a message with a payload of bodyLen bytes, with seq if the
+// peer advertises CapSeqNo.
+// The returned total length includes the header.
 func writeHeader(
 	typ msgType,
-	len uint8,
+	proto peerProto,
+	bodyLen int,
 	socketId uint32,
-) (b []byte) {
+	seq uint32,
+) (b []byte, total uint32, err error) {
+	version := proto.version
+	flags := framedFlag
+	if version != legacyVersion && proto.caps&CapSeqNo != 0 {
+		flags |= seqFlag
+		bodyLen += seqLen
+	}
+
 	buf := new(bytes.Buffer)
+	switch {
+	case version == legacyVersion:
+		if legacyHeaderLen+bodyLen > math.MaxUint8 {
+			err = fmt.Errorf("message of %d bytes exceeds legacy limit of %d", legacyHeaderLen+bodyLen, math.MaxUint8)
+			return
+		}
+
+		total = uint32(legacyHeaderLen + bodyLen)
+		binary.Write(buf, binary.LittleEndian, uint8(typ))
+		binary.Write(buf, binary.LittleEndian, uint8(total))
+	case version > ProtoVersion:
+		err = fmt.Errorf("unsupported protocol version %d", version)
+		return
+	case shortHeaderLen+bodyLen <= math.MaxUint16:
+		total = uint32(shortHeaderLen + bodyLen)
+		binary.Write(buf, binary.LittleEndian, flags|uint8(typ))
+		binary.Write(buf, binary.LittleEndian, version)
+		binary.Write(buf, binary.LittleEndian, uint16(total))
+	case proto.caps&CapLongLen == 0:
+		err = fmt.Errorf("message of %d bytes needs a 32 bit length, which the peer does not support", shortHeaderLen+bodyLen)
+		return
+	case int64(longHeaderLen+bodyLen) <= math.MaxUint32:
+		total = uint32(longHeaderLen + bodyLen)
+		binary.Write(buf, binary.LittleEndian, flags|longLenFlag|uint8(typ))
+		binary.Write(buf, binary.LittleEndian, version)
+		binary.Write(buf, binary.LittleEndian, total)
+	default:
+		err = fmt.Errorf("message of %d bytes too long", bodyLen)
+		return
+	}
 
-	binary.Write(buf, binary.LittleEndian, uint8(typ))
-	binary.Write(buf, binary.LittleEndian, len)
 	binary.Write(buf, binary.LittleEndian, socketId)
+	if flags&seqFlag != 0 {
+		binary.Write(buf, binary.LittleEndian, seq)
+	}
 
-	return buf.Bytes()
+	b = buf.Bytes()
+	return
 }
 
-func msgReader(buf []byte) (msg ipcMsg, err error) {
-	typ, l, socketId, err := readHeader(buf)
+// peers holds what each sender announced, which decides the CREATE layout
+func msgReader(buf []byte, peers *peerTable) (msg ipcMsg, err error) {
+	typ, version, l, socketId, seq, sequenced, hdrLen, err := readHeader(buf)
 	if err != nil {
 		return ipcMsg{}, err
 	}
 
+	if int(l) > len(buf) || int(l) < hdrLen {
+		return ipcMsg{}, fmt.Errorf("message length %d does not match buffer of %d bytes", l, len(buf))
+	}
+
 	msg = ipcMsg{
-		typ:      typ,
-		len:      l,
-		socketId: socketId,
-		u32s:     make([]uint32, 0),
-		u64s:     make([]uint64, 0),
-		str:      "",
+		typ:       typ,
+		proto:     peerProto{version: version},
+		len:       l,
+		socketId:  socketId,
+		seq:       seq,
+		sequenced: sequenced,
+		u32s:      make([]uint32, 0),
+		u64s:      make([]uint64, 0),
+		str:       "",
 	}
 
 	var numU32, numU64 int
@@ -95,6 +286,11 @@ func msgReader(buf []byte) (msg ipcMsg, err error) {
 		numU32 = 1
 		numU64 = 0
 		hasStr = true
+
+		// a sender which announced CapCreateInfo always includes it
+		if p, ok := peers.get(socketId); ok && p.caps&CapCreateInfo != 0 {
+			numU32 += createInfoU32s
+		}
 	case DROP:
 		numU32 = 0
 		numU64 = 0
@@ -103,15 +299,46 @@ func msgReader(buf []byte) (msg ipcMsg, err error) {
 		numU32 = 3
 		numU64 = 2
 		hasStr = false
+
+		// the extended fields, and the aggregates, if the sender included them
+		switch int(l) - hdrLen {
+		case 4*(numU32+extMeasureU32s) + 8*(numU64+extMeasureU64s):
+			numU32 += extMeasureU32s
+			numU64 += extMeasureU64s
+		case 4*(numU32+extMeasureU32s+aggMeasureU32s) + 8*(numU64+extMeasureU64s+aggMeasureU64s):
+			numU32 += extMeasureU32s + aggMeasureU32s
+			numU64 += extMeasureU64s + aggMeasureU64s
+		}
 	case PATTERN:
 		numU32 = 1
 		numU64 = 0
 		hasStr = true
+	case HELLO:
+		numU32 = 2
+		numU64 = 0
+		hasStr = false
+	case CLOSE:
+		numU32 = 0
+		numU64 = 0
+		hasStr = false
+	case AGGREGATE:
+		numU32 = 2
+		numU64 = 0
+		hasStr = false
+	case PATTERNACK:
+		numU32 = 1
+		numU64 = 0
+		hasStr = false
 	default:
 		return ipcMsg{}, fmt.Errorf("malformed message")
 	}
 
-	payload := bytes.NewBuffer(buf[6:])
+	strLen := int(msg.len) - hdrLen - numU32*4 - numU64*8
+	if strLen < 0 || (hasStr && strLen == 0) {
+		return ipcMsg{}, fmt.Errorf("malformed message")
+	}
+
+	payload := bytes.NewBuffer(buf[hdrLen:msg.len])
 	for i := 0; i < numU32; i++ {
 		var u uint32
 		binary.Read(payload, binary.LittleEndian, &u)
@@ -125,7 +352,7 @@ func msgReader(buf []byte) (msg ipcMsg, err error) {
 	}
 
 	if hasStr {
-		s := make([]byte, int(msg.len)-6-numU32*4-numU64*8)
+		s := make([]byte, strLen)
 		binary.Read(payload, binary.LittleEndian, &s)
 
 		// remove null terminator
@@ -140,74 +367,185 @@ func msgReader(buf []byte) (msg ipcMsg, err error) {
 
 func (i *Ipc) demux(ch chan []byte) {
 	for buf := range ch {
-		ipcm, err := msgReader(buf)
+		msgs, err := splitBatch(buf)
 		if err != nil {
 			log.WithFields(log.Fields{
 				"err": err,
 				"buf": buf,
-			}).Warn("failed to parse message")
+			}).Warn("failed to parse batch")
+			i.reportError(0, &ipcbackend.Error{Kind: ipcbackend.ErrParse, Where: "ipc.demux", Err: err})
 			continue
 		}
-		switch ipcm.typ {
-		case MEASURE:
-			i.MeasureNotify <- MeasureMsg{
-				socketId: ipcm.socketId,
-				ackNo:    ipcm.u32s[0],
-				rtt:      time.Duration(ipcm.u32s[1]) * time.Microsecond,
-				loss:     ipcm.u32s[2],
-				rin:      ipcm.u64s[0],
-				rout:     ipcm.u64s[1],
-			}
-		case DROP:
-			i.DropNotify <- DropMsg{
-				socketId: ipcm.socketId,
-				event:    ipcm.str,
-			}
-		case CREATE:
-			i.CreateNotify <- CreateMsg{
-				socketId: ipcm.socketId,
-				startSeq: ipcm.u32s[0],
-				congAlg:  ipcm.str,
+
+		for _, m := range msgs {
+			i.demuxMsg(m)
+		}
+	}
+}
+
+func (i *Ipc) demuxMsg(buf []byte) {
+	ipcm, err := msgReader(buf, i.peers)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+			"buf": buf,
+		}).Warn("failed to parse message")
+		i.reportError(0, &ipcbackend.Error{Kind: ipcbackend.ErrParse, Where: "ipc.demuxMsg", Err: err})
+		return
+	}
+
+	// a message older than one already received is delivered anyway,
+	// except for a PATTERN older than one already delivered
+	if ipcm.sequenced {
+		i.seq.received(ipcm.socketId, ipcm.seq)
+	}
+	switch ipcm.typ {
+	case MEASURE:
+		m := MeasureMsg{
+			socketId: ipcm.socketId,
+			ackNo:    ipcm.u32s[0],
+			rtt:      time.Duration(ipcm.u32s[1]) * time.Microsecond,
+			loss:     ipcm.u32s[2],
+			rin:      ipcm.u64s[0],
+			rout:     ipcm.u64s[1],
+		}
+
+		if len(ipcm.u32s) > 3 {
+			m.ext = MeasureExt{
+				MinRtt:    time.Duration(ipcm.u32s[3]) * time.Microsecond,
+				Delivered: ipcm.u64s[2],
+				Inflight:  ipcm.u64s[3],
+				Ecn:       ipcm.u64s[4],
+				Sacked:    ipcm.u64s[5],
+				Timestamp: time.Duration(ipcm.u64s[6]),
 			}
-		case PATTERN:
-			p, err := deserializePattern(ipcm.str, ipcm.u32s[0])
-			if err != nil {
-				continue
+		}
+
+		if len(ipcm.u32s) > 3+extMeasureU32s {
+			m.ext.Agg = Aggregates{
+				Stats:      AggStat(ipcm.u32s[4]),
+				EwmaRtt:    time.Duration(ipcm.u32s[5]) * time.Microsecond,
+				MinRtt:     time.Duration(ipcm.u32s[6]) * time.Microsecond,
+				MaxRtt:     time.Duration(ipcm.u32s[7]) * time.Microsecond,
+				Acks:       ipcm.u32s[8],
+				Lost:       ipcm.u32s[9],
+				BytesAcked: ipcm.u64s[7],
+				Ecn:        ipcm.u64s[8],
 			}
+		}
+
+		i.notify(MEASURE, ipcm.socketId, m)
+	case DROP:
+		i.notify(DROP, ipcm.socketId, DropMsg{
+			socketId: ipcm.socketId,
+			event:    ipcm.str,
+		})
+	case CREATE:
+		c := CreateMsg{
+			socketId: ipcm.socketId,
+			startSeq: ipcm.u32s[0],
+			congAlg:  ipcm.str,
+			withInfo: len(ipcm.u32s) > 1,
+		}
 
-			i.PatternNotify <- PatternMsg{
-				socketId: ipcm.socketId,
-				pattern:  p,
+		if c.withInfo {
+			c.info = CreateInfo{
+				Mss:      ipcm.u32s[1],
+				InitCwnd: ipcm.u32s[2],
+				Events:   flowPattern.EventSet(ipcm.u32s[3]),
+				Fields:   MeasureField(ipcm.u32s[4]),
 			}
+
+			i.peers.setMss(ipcm.socketId, c.info.Mss)
+		} else {
+			c.info.Events = i.impliedEvents(ipcm.socketId)
 		}
+
+		i.notify(CREATE, ipcm.socketId, c)
+	case PATTERN:
+		if ipcm.sequenced {
+			i.ackPattern(ipcm.socketId, ipcm.seq)
+		}
+
+		if ipcm.sequenced && !i.seq.newPattern(ipcm.socketId, ipcm.seq) {
+			return
+		}
+
+		p, err := deserializePattern(ipcm.str, ipcm.u32s[0])
+		if err != nil {
+			i.reportError(ipcm.socketId, &ipcbackend.Error{
+				Kind:  ipcbackend.ErrParse,
+				Where: fmt.Sprintf("ipc.demuxMsg: pattern for socket %d", ipcm.socketId),
+				Err:   err,
+			})
+			return
+		}
+
+		i.notify(PATTERN, ipcm.socketId, PatternMsg{
+			socketId: ipcm.socketId,
+			pattern:  p,
+		})
+	case HELLO:
+		i.peers.set(ipcm.socketId, peerProto{
+			version: uint8(ipcm.u32s[0]),
+			caps:    ipcm.u32s[1],
+		})
+		i.seq.reset(ipcm.socketId)
+	case CLOSE:
+		i.peers.forget(ipcm.socketId)
+		i.seq.reset(ipcm.socketId)
+		i.notify(CLOSE, ipcm.socketId, CloseMsg{
+			socketId: ipcm.socketId,
+		})
+	case AGGREGATE:
+		i.notify(AGGREGATE, ipcm.socketId, AggregateMsg{
+			socketId: ipcm.socketId,
+			cfg: AggregateConfig{
+				Stats: AggStat(ipcm.u32s[0]),
+				Gain:  math.Float32frombits(ipcm.u32s[1]),
+			},
+		})
+	case PATTERNACK:
+		i.retx.acked(ipcm.socketId, ipcm.u32s[0])
 	}
 }
 
 func msgWriter(msg ipcMsg) ([]byte, error) {
-	// header: 6 Bytes
 	switch {
 	case msg.typ == CREATE && len(msg.u32s) == 1 && len(msg.u64s) == 0 && msg.str != "":
 		// + 1 uint32, + string
-		msg.len = 10 + uint8(len(msg.str))
+	case msg.typ == CREATE && len(msg.u32s) == 1+createInfoU32s && len(msg.u64s) == 0 && msg.str != "":
+		// + start sequence, mss, initial cwnd, events, measure fields, + string
 	case msg.typ == DROP && len(msg.u32s) == 0 && len(msg.u64s) == 0 && msg.str != "":
 		// + string
-		msg.len = uint8(6 + len(msg.str))
 	case msg.typ == MEASURE && len(msg.u32s) == 3 && len(msg.u64s) == 2 && msg.str == "":
 		// + 3 uint32, + 2 uint64, no string
-		// 6 + 12 + 16 = 34
-		msg.len = 34
+	case msg.typ == MEASURE && len(msg.u32s) == 3+extMeasureU32s && len(msg.u64s) == 2+extMeasureU64s && msg.str == "":
+		// extended: + min rtt; + delivered, inflight, ecn, sacked, timestamp
+	case msg.typ == MEASURE && len(msg.u32s) == 3+extMeasureU32s+aggMeasureU32s && len(msg.u64s) == 2+extMeasureU64s+aggMeasureU64s && msg.str == "":
+		// extended, + aggregates: stats, ewma, min and max rtt, acks, lost; + bytes acked, ecn
 	case msg.typ == PATTERN && len(msg.u32s) == 1 && len(msg.u64s) == 0 && msg.str != "":
 		// + 1 uint32, + string
-		msg.len = 10 + uint8(len(msg.str))
+	case msg.typ == HELLO && len(msg.u32s) == 2 && len(msg.u64s) == 0 && msg.str == "":
+		// + 2 uint32 (version, capabilities), no string
+	case msg.typ == CLOSE && len(msg.u32s) == 0 && len(msg.u64s) == 0 && msg.str == "":
+		// header only
+	case msg.typ == AGGREGATE && len(msg.u32s) == 2 && len(msg.u64s) == 0 && msg.str == "":
+		// + 2 uint32 (statistics, ewma gain), no string
+	case msg.typ == PATTERNACK && len(msg.u32s) == 1 && len(msg.u64s) == 0 && msg.str == "":
+		// + 1 uint32 (the PATTERN's sequence number), no string
 	default:
 		return nil, fmt.Errorf("Invalid message")
 	}
 
-	buf := new(bytes.Buffer)
-	binary.Write(buf, binary.LittleEndian, uint8(msg.typ))
-	binary.Write(buf, binary.LittleEndian, msg.len)
-	binary.Write(buf, binary.LittleEndian, msg.socketId)
+	bodyLen := 4*len(msg.u32s) + 8*len(msg.u64s) + len(msg.str)
+	hdr, total, err := writeHeader(msg.typ, msg.proto, bodyLen, msg.socketId, msg.seq)
+	if err != nil {
+		return nil, err
+	}
 
+	msg.len = total
+	buf := bytes.NewBuffer(hdr)
 	for _, val := range msg.u32s {
 		binary.Write(buf, binary.LittleEndian, val)
 	}
@@ -225,50 +563,111 @@ func msgWriter(msg ipcMsg) ([]byte, error) {
 
 // Pattern serialization
 
-/* (type, len, value?) event description
- * ----------------------------------------
- * | Event Type | Len (B)  | Uint32?      |
- * | (1 B)      | (1 B)    | (0||32 bits) |
- * ----------------------------------------
- * total: 2 || 6 Bytes
+/* The event count of a PATTERN message has this bit set when rates and
+ * factors are IEEE 754 float32s, which is how they are sent to peers with
+ * CapFloatPattern. Other peers get rates in whole bytes per second and
+ * factors in hundredths, and values that encoding cannot carry exactly are
+ * rejected.
  */
-func serializePatternEvent(ev flowPattern.PatternEvent) (buf []byte, err error) {
-	b := new(bytes.Buffer)
-	binary.Write(b, binary.LittleEndian, uint8(ev.Type))
-	var value uint32
+const patternFloats uint32 = 1 << 31
+
+// the fixed-point scales of the legacy encoding
+const (
+	legacyRateScale   = 1
+	legacyFactorScale = 100
+)
+
+/* (type, len, values) event description
+ * ----------------------------------------------
+ * | Event Type | Len (B)  | Uint32s            |
+ * | (1 B)      | (1 B)    | (0-3 * 32 bits)    |
+ * ----------------------------------------------
+ * total: 2 + 4 * (number of values) Bytes
+ *
+ * REPORT has no value, REPEAT carries (count, block length),
+ * IF carries (condition, block length, rtt threshold in us),
+ * and every other event a single value.
+ */
+func serializePatternEvent(ev flowPattern.PatternEvent, floats bool) (buf []byte, err error) {
+	var values []uint32
 	switch ev.Type {
 	case flowPattern.SETRATEABS:
-		value = uint32(ev.Rate)
+		v, err := encodeFloat(ev, ev.Rate, legacyRateScale, floats)
+		if err != nil {
+			return nil, err
+		}
 
-	case flowPattern.SETCWNDABS:
-		value = ev.Cwnd
+		values = []uint32{v}
 
-	case flowPattern.SETRATEREL:
-		fallthrough
-	case flowPattern.WAITREL:
-		value = uint32(ev.Factor * 100)
+	case flowPattern.SETCWNDABS, flowPattern.ACKINCR:
+		values = []uint32{ev.Cwnd}
+
+	case flowPattern.SETRATEREL, flowPattern.SETCWNDREL, flowPattern.WAITREL:
+		v, err := encodeFloat(ev, ev.Factor, legacyFactorScale, floats)
+		if err != nil {
+			return nil, err
+		}
+
+		values = []uint32{v}
 
 	case flowPattern.WAITABS:
-		value = uint32(ev.Duration.Nanoseconds() / 1e3)
+		values = []uint32{uint32(ev.Duration.Nanoseconds() / 1e3)}
 
 	case flowPattern.REPORT:
-		err = binary.Write(b, binary.LittleEndian, uint8(2))
-		goto ret
+
+	case flowPattern.REPEAT:
+		values = []uint32{ev.Count, ev.Len}
+
+	case flowPattern.IF:
+		values = []uint32{uint32(ev.Cond), ev.Len, uint32(ev.Duration.Nanoseconds() / 1e3)}
+
 	default:
-		err = fmt.Errorf("unknown pattern-event type: %v", ev.Type)
+		return nil, fmt.Errorf("unknown pattern-event type: %v", ev.Type)
 	}
 
-	err = binary.Write(b, binary.LittleEndian, uint8(6))
-	err = binary.Write(b, binary.LittleEndian, value)
-ret:
+	b := new(bytes.Buffer)
+	binary.Write(b, binary.LittleEndian, uint8(ev.Type))
+	binary.Write(b, binary.LittleEndian, uint8(2+4*len(values)))
+	err = binary.Write(b, binary.LittleEndian, values)
 	buf = b.Bytes()
 	return
 }
 
-func serializeSequence(evs []flowPattern.PatternEvent) ([]byte, error) {
+// rates and factors, as the peer parses them
+func encodeFloat(ev flowPattern.PatternEvent, f float32, scale float64, floats bool) (uint32, error) {
+	if floats {
+		return math.Float32bits(f), nil
+	}
+
+	scaled := float64(f) * scale
+	if !(scaled >= 0) || scaled > math.MaxUint32 {
+		return 0, &flowPattern.ValidationError{Event: ev, Reason: flowPattern.Overflow}
+	}
+
+	v := uint32(math.Round(scaled))
+	if decodeFloat(v, scale, false) != f {
+		return 0, &flowPattern.ValidationError{Event: ev, Reason: flowPattern.Imprecise}
+	}
+
+	return v, nil
+}
+
+func decodeFloat(v uint32, scale float64, floats bool) float32 {
+	if floats {
+		return math.Float32frombits(v)
+	}
+
+	return float32(float64(v) / scale)
+}
+
+func serializeSequence(evs []flowPattern.PatternEvent, floats bool) ([]byte, error) {
 	buf := make([]byte, 0)
-	for _, ev := range evs {
-		b, err := serializePatternEvent(ev)
+	for i, ev := range evs {
+		b, err := serializePatternEvent(ev, floats)
+		if verr, ok := err.(*flowPattern.ValidationError); ok {
+			verr.Index = i
+		}
+
 		if err != nil {
 			return nil, err
 		}
@@ -280,6 +679,9 @@ func serializeSequence(evs []flowPattern.PatternEvent) ([]byte, error) {
 }
 
 func deserializePattern(msg string, numEvents uint32) (pat *flowPattern.Pattern, err error) {
+	floats := numEvents&patternFloats != 0
+	numEvents &^= patternFloats
+
 	var evType uint8
 	var evLength uint8
 	buf := bytes.NewBuffer([]byte(msg))
@@ -291,32 +693,51 @@ func deserializePattern(msg string, numEvents uint32) (pat *flowPattern.Pattern,
 			return nil, err
 		}
 
-		if evLength == 2 && flowPattern.PatternEventType(evType) == flowPattern.REPORT {
-			pat = pat.Report()
-			continue
-		} else if evLength == 2 {
+		typ := flowPattern.PatternEventType(evType)
+		numValues, ok := flowPattern.WireValues(typ)
+		if !ok {
 			return nil, fmt.Errorf("could not parse event type %d", evType)
-		} else if evLength != 6 {
+		} else if int(evLength) != 2+4*numValues {
 			return nil, fmt.Errorf("could not parse event %d of length %d", evType, evLength)
 		}
 
-		var evVal uint32
-		err = binary.Read(buf, binary.LittleEndian, &evVal)
+		evVals := make([]uint32, numValues)
+		err = binary.Read(buf, binary.LittleEndian, evVals)
 		if err != nil {
 			return nil, err
 		}
 
-		switch flowPattern.PatternEventType(evType) {
+		switch typ {
+		case flowPattern.REPORT:
+			pat = pat.Report()
 		case flowPattern.SETRATEABS:
-			pat = pat.Rate(float32(evVal) / 100.0)
+			pat = pat.Rate(decodeFloat(evVals[0], legacyRateScale, floats))
 		case flowPattern.SETRATEREL:
-			pat = pat.RelativeRate(float32(evVal) / 100.0)
+			pat = pat.RelativeRate(decodeFloat(evVals[0], legacyFactorScale, floats))
 		case flowPattern.SETCWNDABS:
-			pat = pat.Cwnd(evVal)
+			pat = pat.Cwnd(evVals[0])
 		case flowPattern.WAITREL:
-			pat = pat.WaitRtts(float32(evVal) / 100.0)
+			pat = pat.WaitRtts(decodeFloat(evVals[0], legacyFactorScale, floats))
 		case flowPattern.WAITABS:
-			pat = pat.Wait(time.Duration(evVal) * time.Microsecond)
+			pat = pat.Wait(time.Duration(evVals[0]) * time.Microsecond)
+		case flowPattern.SETCWNDREL:
+			pat = pat.RelativeCwnd(decodeFloat(evVals[0], legacyFactorScale, floats))
+		case flowPattern.ACKINCR:
+			pat = pat.AckIncrease(evVals[0])
+		case flowPattern.REPEAT:
+			// the block's events follow, Compile checks its length
+			pat.Sequence = append(pat.Sequence, flowPattern.PatternEvent{
+				Type:  flowPattern.REPEAT,
+				Count: evVals[0],
+				Len:   evVals[1],
+			})
+		case flowPattern.IF:
+			pat.Sequence = append(pat.Sequence, flowPattern.PatternEvent{
+				Type:     flowPattern.IF,
+				Cond:     flowPattern.Condition(evVals[0]),
+				Len:      evVals[1],
+				Duration: time.Duration(evVals[2]) * time.Microsecond,
+			})
 		}
 	}
 
@@ -1,7 +1,13 @@
 package ipc
 
 import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"math/rand"
+	"reflect"
 	"testing"
+	"testing/quick"
 	"time"
 
 	"ccp/ccpFlow/pattern"
@@ -14,6 +20,7 @@ import (
 type MockBackend struct {
 	ch    chan []byte
 	doLog bool
+	ipcbackend.Health
 }
 
 func NewMockBackend(doLog bool) ipcbackend.Backend {
@@ -72,6 +79,7 @@ func (d *MockBackend) Listen() chan []byte {
 
 func (d *MockBackend) Close() error {
 	close(d.ch)
+	d.CloseErrors()
 	return nil
 }
 
@@ -141,6 +149,130 @@ func TestEncodeMeasureMsg(t *testing.T) {
 	}
 }
 
+func TestEncodeMeasureMsgExt(t *testing.T) {
+	i, err := testSetup(false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	ext := MeasureExt{
+		MinRtt:    testDuration / 2,
+		Delivered: testBigNum * 1000,
+		Inflight:  testBigNum * 10,
+		Ecn:       testBigNum,
+		Sacked:    testBigNum * 2,
+		Timestamp: time.Hour + testDuration,
+	}
+
+	outMsgCh, _ := i.ListenMeasureMsg()
+	for _, c := range []struct {
+		sid      uint32
+		proto    peerProto
+		expected MeasureExt
+	}{
+		// a peer which never said it understands the extended fields gets the basic ones
+		{sid: testNum + 3, proto: peerProto{version: legacyVersion}, expected: MeasureExt{}},
+		{sid: testNum + 4, proto: peerProto{version: ProtoVersion}, expected: MeasureExt{}},
+		{sid: testNum + 5, proto: peerProto{version: ProtoVersion, caps: CapExtMeasure}, expected: ext},
+	} {
+		i.peers.set(c.sid, c.proto)
+		err = i.SendMeasureMsgExt(c.sid, testNum, testDuration, testNum, testBigNum, testBigNum, ext)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		select {
+		case out := <-outMsgCh:
+			if out.SocketId() != c.sid || out.AckNo() != testNum || out.Rout() != testBigNum {
+				t.Errorf("wrong basic fields for %v: %v", c.proto, out)
+			}
+
+			if out.Ext() != c.expected {
+				t.Errorf("wrong extended fields for %v\ngot %v\nexpected %v", c.proto, out.Ext(), c.expected)
+			}
+		case <-time.After(time.Second):
+			t.Error("timed out")
+			return
+		}
+	}
+}
+
+func TestEncodeAggregate(t *testing.T) {
+	i, err := testSetup(false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	cfg := AggregateConfig{Stats: AggEwmaRtt | AggAcks | AggLost, Gain: 0.25}
+	if err = i.SendAggregateMsg(testNum+10, cfg); err == nil {
+		t.Error("expected an error asking a peer without CapAggregate to aggregate")
+	}
+
+	i.peers.set(testNum+11, peerProto{version: ProtoVersion, caps: CapAggregate})
+	aggCh, _ := i.ListenAggregateMsg()
+	if err = i.SendAggregateMsg(testNum+11, cfg); err != nil {
+		t.Error(err)
+		return
+	}
+
+	select {
+	case out := <-aggCh:
+		if out.SocketId() != testNum+11 || out.Config() != cfg {
+			t.Errorf("got %v, expected %v", out.Config(), cfg)
+		}
+	case <-time.After(time.Second):
+		t.Error("timed out")
+		return
+	}
+
+	ext := MeasureExt{
+		MinRtt: testDuration / 2,
+		Agg: Aggregates{
+			Stats:      AggEwmaRtt | AggMinRtt | AggMaxRtt | AggAcks | AggBytesAcked | AggLost | AggEcn,
+			EwmaRtt:    testDuration,
+			MinRtt:     testDuration / 2,
+			MaxRtt:     2 * testDuration,
+			Acks:       testNum,
+			BytesAcked: testBigNum * 1460,
+			Lost:       3,
+			Ecn:        testBigNum,
+		},
+	}
+
+	noAgg := ext
+	noAgg.Agg = Aggregates{}
+
+	outMsgCh, _ := i.ListenMeasureMsg()
+	for _, c := range []struct {
+		sid      uint32
+		proto    peerProto
+		expected MeasureExt
+	}{
+		{sid: testNum + 12, proto: peerProto{version: ProtoVersion, caps: CapExtMeasure}, expected: noAgg},
+		{sid: testNum + 13, proto: peerProto{version: ProtoVersion, caps: CapExtMeasure | CapAggregate}, expected: ext},
+	} {
+		i.peers.set(c.sid, c.proto)
+		err = i.SendMeasureMsgExt(c.sid, testNum, testDuration, testNum, testBigNum, testBigNum, ext)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		select {
+		case out := <-outMsgCh:
+			if out.Ext() != c.expected {
+				t.Errorf("wrong extended fields for %v\ngot %v\nexpected %v", c.proto, out.Ext(), c.expected)
+			}
+		case <-time.After(time.Second):
+			t.Error("timed out")
+			return
+		}
+	}
+}
+
 func TestEncodeCreateMsg(t *testing.T) {
 	i, err := testSetup(true)
 	if err != nil {
@@ -184,6 +316,87 @@ func TestEncodeCreateMsg(t *testing.T) {
 	}
 }
 
+func TestEncodeCreateMsgInfo(t *testing.T) {
+	i, err := testSetup(false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	info := CreateInfo{
+		Mss:      1200,
+		InitCwnd: 4,
+		Events:   pattern.Events(pattern.SETCWNDABS, pattern.WAITREL, pattern.REPORT),
+		Fields:   FieldMinRtt | FieldDelivered,
+	}
+
+	// only the socket this end announced CapCreateInfo on carries the info;
+	// the others get the events their capabilities imply
+	if err = i.SendHelloMsg(testNum + 14); err != nil {
+		t.Error(err)
+		return
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for i.PeerVersion(testNum+14) != ProtoVersion {
+		if time.Now().After(deadline) {
+			t.Error("timed out waiting for negotiation")
+			return
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	i.peers.set(testNum+16, peerProto{version: ProtoVersion, caps: CapPatternCtl})
+
+	outMsgCh, _ := i.ListenCreateMsg()
+	for _, c := range []struct {
+		sid      uint32
+		expected CreateInfo
+	}{
+		{sid: testNum + 14, expected: info},
+		{sid: testNum + 15, expected: CreateInfo{Events: pattern.BasicEvents}},
+		{sid: testNum + 16, expected: CreateInfo{Events: pattern.AllEvents}},
+	} {
+		err = i.SendCreateMsgInfo(c.sid, testNum, testString, info)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		select {
+		case out := <-outMsgCh:
+			if out.SocketId() != c.sid || out.StartSeq() != testNum || out.CongAlg() != testString {
+				t.Errorf("wrong basic fields for %d: %v", c.sid, out)
+			}
+
+			if out.Info() != c.expected {
+				t.Errorf("wrong info for %d\ngot %v\nexpected %v", c.sid, out.Info(), c.expected)
+			}
+		case <-time.After(time.Second):
+			t.Error("timed out")
+			return
+		}
+	}
+
+	// patterns for the flow are checked against the packet size it gave
+	p, err := pattern.NewPattern().Cwnd(1000).WaitRtts(1.0).Compile()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	var verr *pattern.ValidationError
+	err = i.SendPatternMsg(testNum+14, p)
+	if !errors.As(err, &verr) || verr.Reason != pattern.SmallCwnd {
+		t.Errorf("expected a window below the flow's mss to be rejected, got %v", err)
+	}
+
+	if err = i.SendPatternMsg(testNum+15, p); err != nil {
+		t.Error(err)
+	}
+}
+
 func TestEncodeDropMsg(t *testing.T) {
 	i, err := testSetup(true)
 	if err != nil {
@@ -214,6 +427,34 @@ func TestEncodeDropMsg(t *testing.T) {
 	}
 }
 
+func TestEncodeCloseMsg(t *testing.T) {
+	i, err := testSetup(true)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	outMsgCh, _ := i.ListenCloseMsg()
+	err = i.SendCloseMsg(testNum)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	select {
+	case out := <-outMsgCh:
+		if out.SocketId() != testNum {
+			t.Errorf(
+				"wrong message\ngot sid (%v)\nexpected (%v)",
+				out.SocketId(),
+				testNum,
+			)
+		}
+	case <-time.After(time.Second):
+		t.Error("timed out")
+	}
+}
+
 func TestEncodePatternMsg(t *testing.T) {
 	i, err := testSetup(true)
 	if err != nil {
@@ -301,3 +542,487 @@ func TestEncodePatternMsg(t *testing.T) {
 		t.Error("timed out")
 	}
 }
+
+func longPattern(t testing.TB) *pattern.Pattern {
+	p := pattern.NewPattern()
+	for k := 0; k < 50; k++ {
+		p = p.Cwnd(testNum).Wait(testDuration)
+	}
+
+	p, err := p.Report().Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return p
+}
+
+func TestLegacyRejectsLongMsg(t *testing.T) {
+	i, err := testSetup(false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// no HELLO from this peer, so only the legacy format is allowed
+	err = i.SendPatternMsg(testNum+1, longPattern(t))
+	if err == nil {
+		t.Error("expected error sending long pattern in legacy format")
+	}
+}
+
+func TestHelloNegotiation(t *testing.T) {
+	i, err := testSetup(false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	sid := testNum + 2
+	if v := i.PeerVersion(sid); v != legacyVersion {
+		t.Errorf("expected legacy version before HELLO, got %d", v)
+		return
+	}
+
+	err = i.SendHelloMsg(sid)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// HELLO is handled inside demux; wait for it to land
+	deadline := time.Now().Add(time.Second)
+	for i.PeerVersion(sid) != ProtoVersion {
+		if time.Now().After(deadline) {
+			t.Error("timed out waiting for negotiation")
+			return
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	outMsgCh, _ := i.ListenPatternMsg()
+	p := longPattern(t)
+	err = i.SendPatternMsg(sid, p)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	select {
+	case out := <-outMsgCh:
+		if len(out.Pattern().Sequence) != len(p.Sequence) {
+			t.Errorf(
+				"wrong pattern length\ngot %v\nexpected %v",
+				len(out.Pattern().Sequence),
+				len(p.Sequence),
+			)
+		}
+	case <-time.After(time.Second):
+		t.Error("timed out")
+	}
+}
+
+func TestPeerTables(t *testing.T) {
+	a, err := testSetup(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	b, err := testSetup(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	sid := testNum + 26
+	if err = a.SendHelloMsg(sid); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for a.PeerVersion(sid) != ProtoVersion {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for negotiation")
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	// what one Ipc learns is its own
+	if v := b.PeerVersion(sid); v != legacyVersion {
+		t.Errorf("expected another Ipc to still see a legacy peer, got %d", v)
+	}
+
+	// and is forgotten once the flow ends
+	a.Forget(sid)
+	if v := a.PeerVersion(sid); v != legacyVersion {
+		t.Errorf("expected a legacy peer after forgetting it, got %d", v)
+	}
+}
+
+func TestReadHeaderFormats(t *testing.T) {
+	for _, proto := range []peerProto{
+		{version: legacyVersion},
+		{version: ProtoVersion},
+		{version: ProtoVersion, caps: CapLongLen},
+	} {
+		b, err := msgWriter(ipcMsg{
+			typ:      DROP,
+			proto:    proto,
+			socketId: testNum,
+			str:      testString,
+		})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		msg, err := msgReader(b, newPeerTable())
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if msg.typ != DROP ||
+			msg.proto.version != proto.version ||
+			msg.socketId != testNum ||
+			msg.str != testString ||
+			int(msg.len) != len(b) {
+			t.Errorf(
+				"wrong message\ngot (%v, %v, %v, %v, %v)\nexpected (%v, %v, %v, %v, %v)",
+				msg.typ,
+				msg.proto.version,
+				msg.socketId,
+				msg.str,
+				msg.len,
+				DROP,
+				proto.version,
+				testNum,
+				testString,
+				len(b),
+			)
+		}
+	}
+
+	// a 32 bit length is only used when the peer can parse it
+	long := string(make([]byte, 70000))
+	_, err := msgWriter(ipcMsg{
+		typ:   DROP,
+		proto: peerProto{version: ProtoVersion},
+		str:   long,
+	})
+	if err == nil {
+		t.Error("expected error writing 32 bit length to peer without CapLongLen")
+	}
+
+	b, err := msgWriter(ipcMsg{
+		typ:   DROP,
+		proto: peerProto{version: ProtoVersion, caps: CapLongLen},
+		str:   "x" + long,
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if b[0]&longLenFlag == 0 {
+		t.Error("expected 32 bit length header")
+	}
+
+	msg, err := msgReader(b, newPeerTable())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if int(msg.len) != len(b) {
+		t.Errorf("wrong length: got %d, expected %d", msg.len, len(b))
+	}
+}
+
+func TestEncodePatternCtl(t *testing.T) {
+	i, err := testSetup(false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	p, err := pattern.NewPattern().
+		Cwnd(testNum).
+		AckIncrease(1460).
+		Repeat(3, pattern.NewPattern().
+			If(pattern.LOSS, pattern.NewPattern().RelativeCwnd(0.5)).
+			IfRttAbove(testDuration, pattern.NewPattern().Cwnd(testNum)).
+			WaitRtts(1.0)).
+		Report().
+		Compile()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// a peer which never said it can run control flow does not get it
+	i.peers.set(testNum+6, peerProto{version: ProtoVersion, caps: CapLongLen})
+	err = i.SendPatternMsg(testNum+6, p)
+	if err == nil {
+		t.Error("expected error sending control flow to a peer without CapPatternCtl")
+		return
+	}
+
+	outMsgCh, _ := i.ListenPatternMsg()
+	i.peers.set(testNum+7, peerProto{version: ProtoVersion, caps: CapLongLen | CapPatternCtl})
+	err = i.SendPatternMsg(testNum+7, p)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	select {
+	case out := <-outMsgCh:
+		got := out.Pattern().Sequence
+		if len(got) != len(p.Sequence) {
+			t.Errorf("wrong pattern length\ngot %v\nexpected %v", len(got), len(p.Sequence))
+			return
+		}
+
+		for k, ev := range p.Sequence {
+			if got[k] != ev {
+				t.Errorf("wrong event %d\ngot %v\nexpected %v", k, got[k], ev)
+				return
+			}
+		}
+	case <-time.After(time.Second):
+		t.Error("timed out")
+	}
+}
+
+// random patterns the validator accepts, for property tests
+type randPattern []pattern.PatternEvent
+
+func randFloat(r *rand.Rand) float32 {
+	for {
+		f := math.Float32frombits(r.Uint32())
+		if f > 0 && !math.IsInf(float64(f), 1) {
+			return f
+		}
+	}
+}
+
+func (randPattern) Generate(r *rand.Rand, size int) reflect.Value {
+	var p randPattern
+	for k := 0; k < size%32; k++ {
+		ev := pattern.PatternEvent{Type: pattern.PatternEventType(r.Intn(int(pattern.ACKINCR) + 1))}
+		switch ev.Type {
+		case pattern.SETRATEABS:
+			ev.Rate = randFloat(r)
+		case pattern.SETCWNDABS:
+			ev.Cwnd = r.Uint32()%math.MaxUint32 + 1
+		case pattern.ACKINCR:
+			ev.Cwnd = r.Uint32()
+		case pattern.SETRATEREL, pattern.SETCWNDREL, pattern.WAITREL:
+			// small factors are the interesting ones
+			if r.Intn(2) == 0 {
+				ev.Factor = randFloat(r)
+			} else {
+				ev.Factor = r.Float32() / 100
+			}
+		case pattern.WAITABS:
+			ev.Duration = time.Duration(r.Uint32()) * time.Microsecond
+		}
+
+		if ev.Type == pattern.WAITABS && len(p) == 0 {
+			ev.Type = pattern.REPORT
+			ev.Duration = 0
+		}
+
+		p = append(p, ev)
+	}
+
+	return reflect.ValueOf(append(p, pattern.PatternEvent{Type: pattern.REPORT}))
+}
+
+func roundTrip(evs []pattern.PatternEvent, floats bool) ([]pattern.PatternEvent, error) {
+	b, err := serializeSequence(evs, floats)
+	if err != nil {
+		return nil, err
+	}
+
+	numEvents := uint32(len(evs))
+	if floats {
+		numEvents |= patternFloats
+	}
+
+	p, err := deserializePattern(string(b), numEvents)
+	if err != nil {
+		return nil, err
+	}
+
+	return p.Sequence, nil
+}
+
+func TestPatternRoundTrip(t *testing.T) {
+	// peers with CapFloatPattern get every pattern back exactly
+	err := quick.Check(func(p randPattern) bool {
+		out, err := roundTrip(p, true)
+		return err == nil && reflect.DeepEqual(out, []pattern.PatternEvent(p))
+	}, nil)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// legacy peers get it back exactly, or not at all
+	err = quick.Check(func(p randPattern) bool {
+		out, err := roundTrip(p, false)
+		if verr, ok := err.(*pattern.ValidationError); ok {
+			return verr.Reason == pattern.Imprecise || verr.Reason == pattern.Overflow
+		}
+
+		return err == nil && reflect.DeepEqual(out, []pattern.PatternEvent(p))
+	}, nil)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEncodePatternFloats(t *testing.T) {
+	i, err := testSetup(false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	legacy, floats := testNum+8, testNum+9
+	i.peers.set(legacy, peerProto{version: ProtoVersion, caps: CapLongLen})
+	i.peers.set(floats, peerProto{version: ProtoVersion, caps: CapLongLen | CapFloatPattern})
+
+	outMsgCh, _ := i.ListenPatternMsg()
+	for _, c := range []struct {
+		sid uint32
+		p   *pattern.Pattern
+	}{
+		// the rate used to come back 100x too small
+		{sid: legacy, p: pattern.NewPattern().Rate(1.25e6).WaitRtts(0.5).Report()},
+		{sid: floats, p: pattern.NewPattern().Rate(1.25e6).WaitRtts(0.5).Report()},
+		// and factors below 0.01 as 0
+		{sid: floats, p: pattern.NewPattern().Rate(1.25e6).WaitRtts(0.005).Report()},
+	} {
+		p, err := c.p.Compile()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		err = i.SendPatternMsg(c.sid, p)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		select {
+		case out := <-outMsgCh:
+			if !reflect.DeepEqual(out.Pattern().Sequence, p.Sequence) {
+				t.Errorf("peer %d: got %v, expected %v", c.sid, out.Pattern(), p)
+			}
+		case <-time.After(time.Second):
+			t.Error("timed out")
+			return
+		}
+	}
+
+	// the legacy encoding carries neither a factor of 1/8 nor half a byte per
+	// second, nor a rate past its 32 bits
+	for _, c := range []struct {
+		p      *pattern.Pattern
+		index  int
+		reason pattern.Reason
+	}{
+		{pattern.NewPattern().Cwnd(testNum).WaitRtts(0.125), 1, pattern.Imprecise},
+		{pattern.NewPattern().Rate(1.5).WaitRtts(1), 0, pattern.Imprecise},
+		{pattern.NewPattern().Rate(1e10).WaitRtts(1), 0, pattern.Overflow},
+	} {
+		p, err := c.p.Compile()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		err = i.SendPatternMsg(legacy, p)
+		if verr, ok := err.(*pattern.ValidationError); !ok || verr.Reason != c.reason || verr.Index != c.index {
+			t.Errorf("%v: expected %v at event %d, got %v", p, c.reason, c.index, err)
+		}
+	}
+}
+
+func TestPatternTooLong(t *testing.T) {
+	i, err := testSetup(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer i.Close()
+
+	// too long for a legacy message's 8 bit length, not for a framed one
+	p := pattern.NewPattern()
+	for k := 0; k < 50; k++ {
+		p = p.Cwnd(testNum)
+	}
+
+	p, err = p.WaitRtts(1.0).Report().Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	legacy, framed := testNum+27, testNum+28
+	i.peers.set(framed, peerProto{version: ProtoVersion})
+	outMsgCh, _ := i.ListenPatternMsg()
+
+	var verr *pattern.ValidationError
+	err = i.SendPatternMsg(legacy, p)
+	if !errors.As(err, &verr) || verr.Reason != pattern.TooLong {
+		t.Errorf("expected the pattern to be too long for a legacy peer, got %v", err)
+	}
+
+	if err = i.SendPatternMsg(framed, p); err != nil {
+		t.Fatal(err)
+	}
+
+	// let it arrive before the deferred Close
+	select {
+	case out := <-outMsgCh:
+		if !reflect.DeepEqual(out.Pattern().Sequence, p.Sequence) {
+			t.Errorf("got %v, expected %v", out.Pattern(), p)
+		}
+	case <-time.After(time.Second):
+		t.Error("timed out")
+	}
+}
+
+func TestSocketIdOffset(t *testing.T) {
+	for _, proto := range []peerProto{
+		{version: legacyVersion},
+		{version: ProtoVersion},
+		{version: ProtoVersion, caps: CapSeqNo},
+	} {
+		for _, bodyLen := range []int{0, 1 << 16} {
+			if proto.version == legacyVersion && bodyLen > 0 {
+				continue
+			}
+
+			proto.caps |= CapLongLen
+			b, _, err := writeHeader(CLOSE, proto, bodyLen, testNum, 7)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			off, err := socketIdOffset(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if sid := binary.LittleEndian.Uint32(b[off:]); sid != testNum {
+				t.Errorf("%+v, %d bytes: found socket id %d at %d, expected %d", proto, bodyLen, sid, off, testNum)
+			}
+		}
+	}
+}
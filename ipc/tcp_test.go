@@ -0,0 +1,142 @@
+package ipc
+
+import (
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"ccp/ccpFlow/pattern"
+	"ccp/tcpipc"
+)
+
+// forwards connections to addr, until cut
+type tcpProxy struct {
+	ln   net.Listener
+	addr string
+
+	mux   sync.Mutex
+	conns []net.Conn
+}
+
+func newTcpProxy(t *testing.T, addr string) *tcpProxy {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &tcpProxy{ln: ln, addr: addr}
+	go p.accept()
+	return p
+}
+
+func (p *tcpProxy) accept() {
+	for {
+		in, err := p.ln.Accept()
+		if err != nil {
+			return
+		}
+
+		out, err := net.Dial("tcp", p.addr)
+		if err != nil {
+			in.Close()
+			continue
+		}
+
+		p.mux.Lock()
+		p.conns = append(p.conns, in, out)
+		p.mux.Unlock()
+		go io.Copy(in, out)
+		go io.Copy(out, in)
+	}
+}
+
+// cut drops every connection through the proxy, but keeps accepting
+func (p *tcpProxy) cut() {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	for _, c := range p.conns {
+		c.Close()
+	}
+
+	p.conns = nil
+}
+
+func (p *tcpProxy) Close() {
+	p.ln.Close()
+	p.cut()
+}
+
+// sends drops until the CCP hears one, through however many reconnects
+func dropUntilHeard(t *testing.T, dp *Ipc, sid uint32, in chan DropMsg) *DropMsg {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		// fails while reconnecting, or vanishes into a dead connection
+		dp.SendDropMsg(sid, "timeout")
+		select {
+		case d := <-in:
+			return &d
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	t.Fatal("drop never arrived")
+	return nil
+}
+
+func TestTCPReconnect(t *testing.T) {
+	defer func(addr string) { TCPAddr = addr }(TCPAddr)
+	TCPAddr = "127.0.0.1:0"
+
+	ccp, err := SetupCcpListen(TCP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ccp.Close()
+
+	proxy := newTcpProxy(t, ccp.backend.(*tcpipc.TcpIpc).Addr().String())
+	defer proxy.Close()
+
+	dpSid := testNum + 30
+	dp, err := SetupCliTCP(proxy.ln.Addr().String(), dpSid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dp.Close()
+
+	drops, _ := ccp.ListenDropMsg()
+	before := dropUntilHeard(t, dp, dpSid, drops).SocketId()
+
+	out, err := SetupCcpSend(ccp, TCP, before)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+
+	// the datapath comes back on a new connection, as the same socket id
+	proxy.cut()
+	if after := dropUntilHeard(t, dp, dpSid, drops).SocketId(); after != before {
+		t.Fatalf("socket id %d became %d across the reconnect", before, after)
+	}
+
+	// and the flow's sending Ipc reaches it there
+	p, err := pattern.NewPattern().Cwnd(testNum).WaitRtts(1.0).Report().Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	patterns, _ := dp.ListenPatternMsg()
+	if err = out.SendPatternMsg(before, p); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case got := <-patterns:
+		if got.SocketId() != dpSid {
+			t.Errorf("pattern for socket %d, expected %d", got.SocketId(), dpSid)
+		}
+	case <-time.After(time.Second):
+		t.Error("pattern never arrived")
+	}
+}
@@ -0,0 +1,81 @@
+package ipcbackend
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+/* Listening addresses are claimed by locking a file beside them, so a
+ * process never removes another's socket which is still in use, only ones
+ * left behind by processes which have exited, whose locks went with them.
+ */
+
+// the claims this process holds, by address
+var claims = struct {
+	sync.Mutex
+	locks map[string]*os.File
+}{locks: make(map[string]*os.File)}
+
+func lockPath(addr string) string {
+	return addr + ".lock"
+}
+
+// Claim makes addr this process's to listen on until ReleaseListen,
+// failing if a live process already claimed it
+func Claim(addr string) error {
+	claims.Lock()
+	defer claims.Unlock()
+
+	// listening again in the same process replaces the old listener,
+	// as it always has
+	if _, ok := claims.locks[addr]; ok {
+		return nil
+	}
+
+	for {
+		f, err := os.OpenFile(lockPath(addr), os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+
+		if err = tryLock(f); err == errLocked {
+			f.Close()
+			return fmt.Errorf("%s is in use by another process", addr)
+		} else if err != nil {
+			f.Close()
+			return err
+		}
+
+		// the last owner may have removed the lock file
+		// between our opening and locking it
+		held, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return err
+		}
+
+		if cur, err := os.Stat(lockPath(addr)); err == nil && os.SameFile(held, cur) {
+			SetPerm(lockPath(addr))
+			claims.locks[addr] = f
+			return nil
+		}
+
+		f.Close()
+	}
+}
+
+func unclaim(addr string) {
+	claims.Lock()
+	defer claims.Unlock()
+
+	f, ok := claims.locks[addr]
+	if !ok {
+		return
+	}
+
+	// remove the lock file while we still hold it, so nobody else does
+	os.Remove(lockPath(addr))
+	f.Close()
+	delete(claims.locks, addr)
+}
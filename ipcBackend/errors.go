@@ -0,0 +1,150 @@
+package ipcbackend
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/* Health reporting.
+ * A backend's goroutines cannot return their errors to anyone, so they
+ * report them on the channel from Backend.Errors instead, typed so the
+ * consumer can tell a backend which has stopped working from one which
+ * lost or could not parse a message.
+ */
+
+type ErrorKind int
+
+const (
+	// the backend can no longer send or receive
+	ErrClosed ErrorKind = iota
+	// a message could not be parsed
+	ErrParse
+	// messages were lost, because the reader fell behind or one was too big
+	ErrOverrun
+	// the OS refused access
+	ErrPermission
+	// any other failure to send or receive
+	ErrIO
+)
+
+func (k ErrorKind) String() string {
+	switch k {
+	case ErrClosed:
+		return "closed"
+	case ErrParse:
+		return "parse failure"
+	case ErrOverrun:
+		return "overrun"
+	case ErrPermission:
+		return "permission denied"
+	case ErrIO:
+		return "i/o error"
+	default:
+		return fmt.Sprintf("ErrorKind(%d)", int(k))
+	}
+}
+
+type Error struct {
+	Kind ErrorKind
+	// what failed
+	Where string
+	Err   error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s: %v", e.Where, e.Kind, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Fatal reports whether the backend is of no further use
+func (e *Error) Fatal() bool {
+	return e.Kind == ErrClosed || e.Kind == ErrPermission
+}
+
+// NewError classifies err, from where, by its cause
+func NewError(where string, err error) *Error {
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+
+	kind := ErrIO
+	switch {
+	case errors.Is(err, io.EOF),
+		errors.Is(err, net.ErrClosed),
+		errors.Is(err, os.ErrClosed),
+		errors.Is(err, syscall.EBADF):
+		kind = ErrClosed
+	case errors.Is(err, os.ErrPermission):
+		kind = ErrPermission
+	case errors.Is(err, syscall.ENOBUFS):
+		kind = ErrOverrun
+	}
+
+	return &Error{Kind: kind, Where: where, Err: err}
+}
+
+// room for errors the consumer has yet to take
+const healthLen = 16
+
+// Health implements Backend.Errors; backends embed it
+type Health struct {
+	mux    sync.Mutex
+	ch     chan error
+	closed bool
+}
+
+// Errors returns the backend's health channel, closed once the backend is.
+func (h *Health) Errors() chan error {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	return h.errors()
+}
+
+// h.mux must be held
+func (h *Health) errors() chan error {
+	if h.ch == nil {
+		h.ch = make(chan error, healthLen)
+	}
+
+	return h.ch
+}
+
+// Report sends err on the health channel. Rather than hold up the backend,
+// errors nobody is taking are only logged.
+func (h *Health) Report(err *Error) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	if h.closed {
+		return
+	}
+
+	select {
+	case h.errors() <- err:
+	default:
+		log.WithFields(log.Fields{
+			"where": err.Where,
+			"kind":  err.Kind,
+		}).Warn(err.Err)
+	}
+}
+
+// CloseErrors closes the health channel; backends call it from Close
+func (h *Health) CloseErrors() {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	if !h.closed {
+		h.closed = true
+		close(h.errors())
+	}
+}
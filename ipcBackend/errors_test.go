@@ -0,0 +1,50 @@
+package ipcbackend
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"testing"
+)
+
+func TestNewError(t *testing.T) {
+	for _, c := range []struct {
+		err  error
+		kind ErrorKind
+	}{
+		{io.EOF, ErrClosed},
+		{&net.OpError{Op: "read", Err: net.ErrClosed}, ErrClosed},
+		{&os.PathError{Op: "open", Path: "/tmp/ccp-test", Err: os.ErrPermission}, ErrPermission},
+		{fmt.Errorf("something else"), ErrIO},
+		{&Error{Kind: ErrOverrun, Err: io.ErrShortBuffer}, ErrOverrun},
+	} {
+		if e := NewError("test", c.err); e.Kind != c.kind {
+			t.Errorf("%v: got %s, expected %s", c.err, e.Kind, c.kind)
+		}
+	}
+}
+
+func TestHealth(t *testing.T) {
+	var h Health
+
+	// nobody is listening, so the reports past the channel's room are lost
+	for k := 0; k < healthLen+1; k++ {
+		h.Report(&Error{Kind: ErrParse, Where: "test", Err: fmt.Errorf("%d", k)})
+	}
+
+	h.CloseErrors()
+	h.Report(&Error{Kind: ErrClosed, Where: "test", Err: io.EOF})
+
+	n := 0
+	for err := range h.Errors() {
+		if e, ok := err.(*Error); !ok || e.Kind != ErrParse {
+			t.Errorf("unexpected error %v", err)
+		}
+		n++
+	}
+
+	if n != healthLen {
+		t.Errorf("expected %d errors, got %d", healthLen, n)
+	}
+}
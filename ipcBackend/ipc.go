@@ -3,6 +3,8 @@ package ipcbackend
 import (
 	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
 )
 
 type Msg interface {
@@ -16,26 +18,80 @@ type Backend interface {
 
 	SendMsg(msg Msg) error
 	Listen() chan []byte
+	// errors from the backend's goroutines, as *Error
+	Errors() chan error
 
 	Close() error
 }
 
+/* Where the unix socket and shared memory backends put their files:
+ * BaseDir/ccp-<loc>, or BaseDir/ccp-<id>/<loc> for a socket id's own,
+ * with the Namespace after "ccp" if there is one. A CCP and its datapaths
+ * must agree on both, so they default to $CCP_IPC_DIR and
+ * $CCP_IPC_NAMESPACE.
+ */
+var (
+	BaseDir = envOr("CCP_IPC_DIR", "/tmp")
+	// keeps one CCP, and its datapaths, apart from others on the machine
+	Namespace = os.Getenv("CCP_IPC_NAMESPACE")
+	// mode of the files, and the directories holding them;
+	// 0 leaves them to the umask
+	Perm os.FileMode
+)
+
+func envOr(name string, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+
+	return def
+}
+
+func prefix() string {
+	name := "ccp"
+	if Namespace != "" {
+		name += "-" + Namespace
+	}
+
+	return filepath.Join(BaseDir, name)
+}
+
+/* AddressForListen returns where to listen on loc for socket id, and what
+ * to remove once done, which ReleaseListen does. Whatever is already there
+ * is removed, unless the process which made it is still listening.
+ */
 func AddressForListen(loc string, id uint32) (fd string, openFiles string, err error) {
-	err = nil
+	if strings.ContainsRune(Namespace, filepath.Separator) {
+		return "", "", fmt.Errorf("namespace %q contains a path separator", Namespace)
+	}
+
+	if err = os.MkdirAll(BaseDir, 0755); err != nil {
+		return "", "", err
+	}
+
 	if id != 0 {
-		dirName := fmt.Sprintf("/tmp/ccp-%d", id)
-		os.RemoveAll(dirName)
-		err = os.MkdirAll(dirName, 0755)
+		openFiles = fmt.Sprintf("%s-%d", prefix(), id)
+		fd = filepath.Join(openFiles, loc)
+	} else {
+		fd = fmt.Sprintf("%s-%s", prefix(), loc)
+		openFiles = fd
+	}
+
+	if err = Claim(openFiles); err != nil {
+		return "", "", err
+	}
+
+	// stale: its owner is gone
+	os.RemoveAll(openFiles)
+	if id != 0 {
+		if err = os.MkdirAll(openFiles, DirMode()); err == nil {
+			err = SetPerm(openFiles)
+		}
+
 		if err != nil {
+			ReleaseListen(openFiles)
 			return "", "", err
 		}
-
-		fd = fmt.Sprintf("%s/%s", dirName, loc)
-		openFiles = dirName
-	} else {
-		fd = fmt.Sprintf("/tmp/ccp-%s", loc)
-		os.RemoveAll(fd)
-		openFiles = fd
 	}
 
 	return
@@ -43,9 +99,48 @@ func AddressForListen(loc string, id uint32) (fd string, openFiles string, err e
 
 func AddressForSend(loc string, id uint32) (fd string) {
 	if id != 0 {
-		fd = fmt.Sprintf("/tmp/ccp-%d/%s", id, loc)
+		fd = fmt.Sprintf("%s-%d/%s", prefix(), id, loc)
 	} else {
-		fd = fmt.Sprintf("/tmp/ccp-%s", loc)
+		fd = fmt.Sprintf("%s-%s", prefix(), loc)
 	}
 	return
 }
+
+// ReleaseListen removes what AddressForListen returned as openFiles,
+// so another process may listen there
+func ReleaseListen(openFiles string) {
+	os.RemoveAll(openFiles)
+	unclaim(openFiles)
+}
+
+// DirMode is the mode of directories holding the backends' files
+func DirMode() os.FileMode {
+	if Perm == 0 {
+		return 0755
+	}
+
+	// searchable by whoever may read it
+	return Perm | (Perm&0444)>>2
+}
+
+// SetPerm gives path, made by a backend, the mode Perm asks for
+func SetPerm(path string) error {
+	if Perm == 0 {
+		return nil
+	}
+
+	st, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case st.IsDir():
+		return os.Chmod(path, DirMode())
+	case st.Mode()&os.ModeSocket != 0:
+		return os.Chmod(path, Perm)
+	default:
+		// plain files are never run
+		return os.Chmod(path, Perm&^0111)
+	}
+}
@@ -3,7 +3,10 @@ package ipcbackend
 import (
 	"bytes"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"runtime"
 	"testing"
 )
 
@@ -15,7 +18,7 @@ func TestListenAddr(t *testing.T) {
 	}
 
 	defer func() {
-		os.RemoveAll(o)
+		ReleaseListen(o)
 	}()
 
 	if !bytes.Equal([]byte(f), []byte(fmt.Sprintf("/tmp/ccp-2/addr-test"))) {
@@ -23,3 +26,91 @@ func TestListenAddr(t *testing.T) {
 		return
 	}
 }
+
+func TestNamespace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ccp-ns-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldDir, oldNs := BaseDir, Namespace
+	BaseDir, Namespace = dir, "a"
+	defer func() {
+		BaseDir, Namespace = oldDir, oldNs
+	}()
+
+	f, o, err := AddressForListen("addr-test", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ReleaseListen(o)
+
+	if expected := filepath.Join(dir, "ccp-a-2", "addr-test"); f != expected {
+		t.Errorf("got %s, expected %s", f, expected)
+	}
+
+	if s := AddressForSend("addr-test", 2); s != f {
+		t.Errorf("sending to %s, listening on %s", s, f)
+	}
+
+	Namespace = "b"
+	if s := AddressForSend("addr-test", 2); s == f {
+		t.Error("expected namespaces not to share addresses")
+	}
+
+	Namespace = "a/b"
+	if _, _, err = AddressForListen("addr-test", 0); err == nil {
+		t.Error("expected a namespace with a separator to be refused")
+	}
+}
+
+func TestStale(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ccp-stale-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldDir := BaseDir
+	BaseDir = dir
+	defer func() {
+		BaseDir = oldDir
+	}()
+
+	// left behind by a process which has exited
+	stale := filepath.Join(dir, "ccp-stale-test")
+	if err = ioutil.WriteFile(stale, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	f, o, err := AddressForListen("stale-test", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = os.Stat(f); !os.IsNotExist(err) {
+		t.Errorf("expected the stale file to be removed, got %v", err)
+	}
+
+	ReleaseListen(o)
+
+	if runtime.GOOS != "linux" {
+		t.Skip("no file locks")
+	}
+
+	// still held by a live one, here as a lock this process took itself
+	lock, err := os.OpenFile(lockPath(stale), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.Close()
+
+	if err = tryLock(lock); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err = AddressForListen("stale-test", 0); err == nil {
+		t.Error("expected an address in use to be refused")
+	}
+}
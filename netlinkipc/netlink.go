@@ -1,6 +1,8 @@
 package netlinkipc
 
 import (
+	"fmt"
+
 	"ccp/ipcBackend"
 
 	log "github.com/sirupsen/logrus"
@@ -18,6 +20,7 @@ type NetlinkIpc struct {
 
 	err    error
 	killed chan interface{}
+	ipcbackend.Health
 }
 
 func New() ipcbackend.Backend {
@@ -112,6 +115,13 @@ func (n *NetlinkIpc) Listen() chan []byte {
 
 func (n *NetlinkIpc) Close() error {
 	close(n.killed)
+	defer n.CloseErrors()
+
+	// also unblocks a pending Receive in listen()
+	if n.conn != nil {
+		return n.conn.Close()
+	}
+
 	return nil
 }
 
@@ -119,7 +129,6 @@ func (n *NetlinkIpc) listen() {
 	for {
 		select {
 		case <-n.killed:
-			n.conn.Close()
 			close(n.listenCh)
 			return
 		default:
@@ -127,17 +136,41 @@ func (n *NetlinkIpc) listen() {
 
 		msgs, err := n.conn.Receive()
 		if err != nil {
+			select {
+			case <-n.killed:
+				continue
+			default:
+			}
+
+			e := ipcbackend.NewError("netlinkipc.listen", err)
 			log.WithFields(log.Fields{
-				"where": "netlinkipc.listen",
+				"where": e.Where,
+				"kind":  e.Kind,
 			}).Warn(err)
+			n.Report(e)
+			if e.Fatal() {
+				// receiving again would only fail again
+				<-n.killed
+			}
+
 			continue
 		}
 
+		dropped := 0
 		for _, msg := range msgs {
 			select {
 			case n.listenCh <- msg.Data:
 			default: // ok to drop messages
+				dropped++
 			}
 		}
+
+		if dropped > 0 {
+			n.Report(&ipcbackend.Error{
+				Kind:  ipcbackend.ErrOverrun,
+				Where: "netlinkipc.listen",
+				Err:   fmt.Errorf("dropped %d of %d messages", dropped, len(msgs)),
+			})
+		}
 	}
 }
@@ -0,0 +1,351 @@
+package patternExec
+
+import (
+	"time"
+
+	"ccp/ccpFlow/pattern"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/* Executes pattern.Patterns on behalf of a datapath, so that every
+ * datapath gives a pattern the same meaning:
+ *
+ * - the sequence loops until another pattern replaces it
+ * - SETCWNDABS caps the window, and SETRATEABS sets the pacing rate.
+ *   A pattern which never touches the window gets one of rate * rtt from
+ *   its rate events, and a pattern which never sets a rate is not paced.
+ * - SETRATEREL scales the pacing rate, if there is one, and the window,
+ *   unless the pattern touches it. SETCWNDREL scales the window.
+ * - ACKINCR has the datapath grow the window on every new ack, until
+ *   another ACKINCR or the next pattern
+ * - WAITREL waits a multiple of the rtt the datapath last reported,
+ *   or of initialRtt until it has reported one
+ * - REPORT blocks until the datapath has sent a measurement
+ * - REPEAT runs its block Count times, and IF runs its block only if its
+ *   condition holds for what the datapath measured since its last report
+ * - a pattern which goes through its whole sequence, or through
+ *   maxEventsWithoutWait events, without waiting is stopped,
+ *   since it would otherwise spin
+ *
+ * The Executor never blocks or keeps time itself: each call runs the
+ * pattern as far as it can go and says what it is waiting for, so both
+ * event-driven and goroutine-driven datapaths can drive it.
+ */
+
+const maxEventsWithoutWait = 1 << 16
+
+// the rtt WAITREL scales before the datapath knows one
+const initialRtt = 100 * time.Millisecond
+
+// what the datapath measured since its last report
+type Sample struct {
+	// packets lost
+	Lost uint32
+	// the latest rtt sample
+	Rtt time.Duration
+}
+
+type Datapath interface {
+	// congestion window, bytes
+	Cwnd() uint32
+	SetCwnd(cwnd uint32)
+	// bytes to grow the window by on every ack of new data; 0 turns it off
+	SetAckIncrease(inc uint32)
+	// pacing rate, bytes per second; 0 means unpaced
+	SetRate(rate float32)
+	// current time on the datapath's clock
+	Now() time.Duration
+	// what IF conditions are evaluated against
+	Sample() Sample
+	// WaitForReport is called when the pattern reaches a REPORT.
+	// A datapath which has something to report right away sends its
+	// measurement and returns the rtt it reported. Otherwise it returns
+	// ok = false, and calls Executor.Reported once it has sent one.
+	WaitForReport() (rtt time.Duration, ok bool)
+}
+
+type State uint8
+
+const (
+	// no pattern, or the pattern was stopped
+	Stopped State = iota
+	// until the returned time; then call Wake
+	Waiting
+	// until the datapath calls Reported
+	Reporting
+)
+
+// a REPEAT block being run
+type frame struct {
+	start, end int
+	left       uint32
+}
+
+type Executor struct {
+	dp Datapath
+
+	p        *pattern.Pattern
+	idx      int
+	frames   []frame
+	setsCwnd bool
+	// whether the current pass through the sequence has waited at all
+	waited    bool
+	sinceWait int
+
+	state State
+	until time.Duration
+
+	// what the pattern last set, and the rtt it scales by
+	rate    float32
+	ackIncr uint32
+	rtt     time.Duration
+}
+
+// New starts out with the datapath's current rtt estimate
+func New(dp Datapath, rtt time.Duration) *Executor {
+	return &Executor{
+		dp:    dp,
+		state: Stopped,
+		rtt:   rtt,
+	}
+}
+
+func (e *Executor) State() (State, time.Duration) {
+	return e.state, e.until
+}
+
+func (e *Executor) Rtt() time.Duration {
+	return e.rtt
+}
+
+// Install replaces the running pattern with p and starts executing it
+func (e *Executor) Install(p *pattern.Pattern) (State, time.Duration) {
+	e.p = p
+	e.idx = 0
+	e.frames = e.frames[:0]
+	e.waited = false
+	e.sinceWait = 0
+
+	var setsRate bool
+	e.setsCwnd, setsRate = sets(p)
+	if !setsRate && e.rate != 0 {
+		e.setRate(0)
+	}
+
+	if e.ackIncr != 0 {
+		e.setAckIncrease(0)
+	}
+
+	return e.run()
+}
+
+// Wake continues a Waiting pattern once its wait is over.
+// Calls before then, or in any other state, do nothing.
+func (e *Executor) Wake() (State, time.Duration) {
+	if e.state != Waiting || e.dp.Now() < e.until {
+		return e.state, e.until
+	}
+
+	return e.run()
+}
+
+// Reported continues a pattern blocked in a REPORT,
+// once the datapath has sent a measurement with this rtt
+func (e *Executor) Reported(rtt time.Duration) (State, time.Duration) {
+	if e.state != Reporting {
+		return e.state, e.until
+	}
+
+	e.gotRtt(rtt)
+	e.idx++
+	return e.run()
+}
+
+func (e *Executor) Stop() {
+	e.p = nil
+	e.state = Stopped
+}
+
+func (e *Executor) run() (State, time.Duration) {
+	if e.p == nil {
+		e.state = Stopped
+		return e.state, e.until
+	}
+
+	seq := e.p.Sequence
+	for {
+		e.endBlocks()
+		if e.idx >= len(seq) {
+			if !e.waited {
+				return e.spins("pattern never waits, stopping it")
+			}
+
+			e.idx = 0
+			e.frames = e.frames[:0]
+			e.waited = false
+		}
+
+		e.sinceWait++
+		if e.sinceWait > maxEventsWithoutWait {
+			return e.spins("pattern runs too long without waiting, stopping it")
+		}
+
+		ev := seq[e.idx]
+		var wait time.Duration
+		switch ev.Type {
+		case pattern.WAITABS:
+			wait = ev.Duration
+		case pattern.WAITREL:
+			rtt := e.rtt
+			if rtt <= 0 {
+				rtt = initialRtt
+			}
+
+			wait = time.Duration(rtt.Seconds() * float64(ev.Factor) * float64(time.Second))
+		case pattern.REPORT:
+			e.waited = true
+			e.sinceWait = 0
+			rtt, ok := e.dp.WaitForReport()
+			if !ok {
+				e.state = Reporting
+				return e.state, e.until
+			}
+
+			e.gotRtt(rtt)
+			e.idx++
+			continue
+		case pattern.REPEAT:
+			end := e.idx + 1 + int(ev.Len)
+			if ev.Count == 0 {
+				e.idx = end
+				continue
+			}
+
+			e.frames = append(e.frames, frame{start: e.idx + 1, end: end, left: ev.Count})
+			e.idx++
+			continue
+		case pattern.IF:
+			if e.holds(ev) {
+				e.idx++
+			} else {
+				e.idx += 1 + int(ev.Len)
+			}
+
+			continue
+		default:
+			e.set(ev)
+			e.idx++
+			continue
+		}
+
+		e.idx++
+		if wait <= 0 {
+			continue
+		}
+
+		e.waited = true
+		e.sinceWait = 0
+		e.state = Waiting
+		e.until = e.dp.Now() + wait
+		return e.state, e.until
+	}
+}
+
+// loop back into, or leave, the REPEAT blocks which just ended
+func (e *Executor) endBlocks() {
+	for len(e.frames) > 0 {
+		f := &e.frames[len(e.frames)-1]
+		if e.idx < f.end {
+			return
+		}
+
+		f.left--
+		if f.left > 0 {
+			e.idx = f.start
+			return
+		}
+
+		e.frames = e.frames[:len(e.frames)-1]
+	}
+}
+
+func (e *Executor) spins(why string) (State, time.Duration) {
+	log.WithFields(log.Fields{
+		"pattern": e.p,
+	}).Warn(why)
+	e.Stop()
+	return e.state, e.until
+}
+
+func (e *Executor) holds(ev pattern.PatternEvent) bool {
+	s := e.dp.Sample()
+	switch ev.Cond {
+	case pattern.LOSS:
+		return s.Lost > 0
+	case pattern.NOLOSS:
+		return s.Lost == 0
+	case pattern.RTTABOVE:
+		return s.Rtt > ev.Duration
+	default:
+		return false
+	}
+}
+
+func (e *Executor) gotRtt(rtt time.Duration) {
+	if rtt > 0 {
+		e.rtt = rtt
+	}
+}
+
+func (e *Executor) set(ev pattern.PatternEvent) {
+	switch ev.Type {
+	case pattern.SETCWNDABS:
+		e.dp.SetCwnd(ev.Cwnd)
+	case pattern.SETCWNDREL:
+		e.scaleCwnd(ev.Factor)
+	case pattern.ACKINCR:
+		e.setAckIncrease(ev.Cwnd)
+	case pattern.SETRATEABS:
+		e.setRate(ev.Rate)
+		if !e.setsCwnd && e.rtt > 0 {
+			e.dp.SetCwnd(uint32(float64(ev.Rate) * e.rtt.Seconds()))
+		}
+	case pattern.SETRATEREL:
+		if e.rate > 0 {
+			e.setRate(e.rate * ev.Factor)
+		}
+
+		if !e.setsCwnd {
+			e.scaleCwnd(ev.Factor)
+		}
+	}
+}
+
+func (e *Executor) scaleCwnd(factor float32) {
+	e.dp.SetCwnd(uint32(float64(e.dp.Cwnd()) * float64(factor)))
+}
+
+func (e *Executor) setRate(rate float32) {
+	e.rate = rate
+	e.dp.SetRate(rate)
+}
+
+func (e *Executor) setAckIncrease(inc uint32) {
+	e.ackIncr = inc
+	e.dp.SetAckIncrease(inc)
+}
+
+// which of the window and the pacing rate a pattern controls
+func sets(p *pattern.Pattern) (cwnd bool, rate bool) {
+	for _, ev := range p.Sequence {
+		switch ev.Type {
+		case pattern.SETCWNDABS, pattern.SETCWNDREL, pattern.ACKINCR:
+			cwnd = true
+		case pattern.SETRATEABS, pattern.SETRATEREL:
+			rate = true
+		}
+	}
+
+	return
+}
@@ -0,0 +1,246 @@
+package patternExec
+
+import (
+	"testing"
+	"time"
+
+	"ccp/ccpFlow/pattern"
+)
+
+// mock Datapath with a manual clock
+type mockDatapath struct {
+	now     time.Duration
+	cwnd    uint32
+	ackIncr uint32
+	rate    float32
+	sample  Sample
+	reports int
+	// whether WaitForReport can report right away, and with which rtt
+	canReport bool
+	rtt       time.Duration
+}
+
+func (m *mockDatapath) Cwnd() uint32              { return m.cwnd }
+func (m *mockDatapath) SetCwnd(cwnd uint32)       { m.cwnd = cwnd }
+func (m *mockDatapath) SetAckIncrease(inc uint32) { m.ackIncr = inc }
+func (m *mockDatapath) SetRate(rate float32)      { m.rate = rate }
+func (m *mockDatapath) Now() time.Duration        { return m.now }
+func (m *mockDatapath) Sample() Sample            { return m.sample }
+
+func (m *mockDatapath) WaitForReport() (time.Duration, bool) {
+	if !m.canReport {
+		return 0, false
+	}
+
+	m.reports++
+	return m.rtt, true
+}
+
+func compile(t *testing.T, p *pattern.Pattern) *pattern.Pattern {
+	p, err := p.Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return p
+}
+
+func TestWaitRtts(t *testing.T) {
+	dp := &mockDatapath{}
+	e := New(dp, 10*time.Millisecond)
+
+	st, until := e.Install(compile(t, pattern.NewPattern().Cwnd(42).WaitRtts(2.0)))
+	if st != Waiting || until != 20*time.Millisecond {
+		t.Errorf("expected to wait until 20ms, got state %d until %v", st, until)
+		return
+	}
+
+	if dp.cwnd != 42 {
+		t.Errorf("expected cwnd 42, got %d", dp.cwnd)
+		return
+	}
+
+	// a stale wake does nothing
+	dp.cwnd = 0
+	dp.now = 10 * time.Millisecond
+	if st, until = e.Wake(); st != Waiting || until != 20*time.Millisecond || dp.cwnd != 0 {
+		t.Errorf("early wake should be ignored, got state %d until %v cwnd %d", st, until, dp.cwnd)
+		return
+	}
+
+	// the sequence loops
+	dp.now = 20 * time.Millisecond
+	if st, until = e.Wake(); st != Waiting || until != 40*time.Millisecond || dp.cwnd != 42 {
+		t.Errorf("expected to loop, got state %d until %v cwnd %d", st, until, dp.cwnd)
+	}
+}
+
+// before the first report, the wait is in initial rtts
+func TestWaitRttsUnknown(t *testing.T) {
+	dp := &mockDatapath{}
+	e := New(dp, 0)
+
+	st, until := e.Install(compile(t, pattern.NewPattern().Cwnd(42).WaitRtts(1.0)))
+	if st != Waiting || until != initialRtt {
+		t.Errorf("expected to wait until %v, got state %d until %v", initialRtt, st, until)
+		return
+	}
+
+	dp.now = initialRtt
+	if st, until = e.Wake(); st != Waiting || until != 2*initialRtt {
+		t.Errorf("expected to keep looping, got state %d until %v", st, until)
+	}
+}
+
+func TestReport(t *testing.T) {
+	dp := &mockDatapath{}
+	e := New(dp, 10*time.Millisecond)
+
+	st, _ := e.Install(compile(t, pattern.NewPattern().Cwnd(42).WaitRtts(1.0).Report()))
+	dp.now = 10 * time.Millisecond
+	if st, _ = e.Wake(); st != Reporting {
+		t.Errorf("expected to block on the report, got state %d", st)
+		return
+	}
+
+	// the next wait uses the reported rtt
+	st, until := e.Reported(30 * time.Millisecond)
+	if st != Waiting || until != 40*time.Millisecond {
+		t.Errorf("expected to wait until 40ms, got state %d until %v", st, until)
+		return
+	}
+
+	// a datapath which can report right away does not block
+	dp.canReport = true
+	dp.rtt = 5 * time.Millisecond
+	dp.now = 40 * time.Millisecond
+	if st, until = e.Wake(); st != Waiting || until != 45*time.Millisecond || dp.reports != 1 {
+		t.Errorf("expected to report and wait until 45ms, got state %d until %v after %d reports", st, until, dp.reports)
+	}
+}
+
+func TestRate(t *testing.T) {
+	dp := &mockDatapath{cwnd: 10000}
+	e := New(dp, 100*time.Millisecond)
+
+	// a pattern which does not set the window gets one of rate * rtt
+	e.Install(compile(t, pattern.NewPattern().Rate(1e6).WaitRtts(1.0)))
+	if dp.rate != 1e6 || dp.cwnd != 100000 {
+		t.Errorf("expected rate 1e6 and cwnd 100000, got rate %v cwnd %d", dp.rate, dp.cwnd)
+		return
+	}
+
+	e.Install(compile(t, pattern.NewPattern().RelativeRate(0.5).WaitRtts(1.0)))
+	if dp.rate != 5e5 || dp.cwnd != 50000 {
+		t.Errorf("expected rate 5e5 and cwnd 50000, got rate %v cwnd %d", dp.rate, dp.cwnd)
+		return
+	}
+
+	// a pattern which sets the window keeps it, and one without rates is not paced
+	e.Install(compile(t, pattern.NewPattern().Cwnd(42).WaitRtts(1.0)))
+	if dp.rate != 0 || dp.cwnd != 42 {
+		t.Errorf("expected no pacing and cwnd 42, got rate %v cwnd %d", dp.rate, dp.cwnd)
+	}
+}
+
+func TestNeverWaits(t *testing.T) {
+	dp := &mockDatapath{}
+	e := New(dp, 0)
+
+	// which Compile would refuse
+	st, _ := e.Install(&pattern.Pattern{Sequence: []pattern.PatternEvent{
+		{Type: pattern.SETCWNDABS, Cwnd: 42},
+		{Type: pattern.WAITABS},
+	}})
+	if st != Stopped {
+		t.Errorf("expected a pattern which never waits to stop, got state %d", st)
+	}
+}
+
+func TestRepeat(t *testing.T) {
+	dp := &mockDatapath{cwnd: 1000}
+	e := New(dp, 10*time.Millisecond)
+
+	// double the window twice, then hold it
+	e.Install(compile(t, pattern.NewPattern().
+		Repeat(2, pattern.NewPattern().RelativeCwnd(2.0).WaitRtts(1.0)).
+		Wait(time.Second)))
+
+	for _, c := range []struct {
+		cwnd  uint32
+		until time.Duration
+	}{
+		{cwnd: 2000, until: 10 * time.Millisecond},
+		{cwnd: 4000, until: 20 * time.Millisecond},
+		{cwnd: 4000, until: 20*time.Millisecond + time.Second},
+		// the sequence loops, so does the block
+		{cwnd: 8000, until: 30*time.Millisecond + time.Second},
+	} {
+		st, until := e.State()
+		if st != Waiting || until != c.until || dp.cwnd != c.cwnd {
+			t.Errorf("expected cwnd %d until %v, got state %d cwnd %d until %v", c.cwnd, c.until, st, dp.cwnd, until)
+			return
+		}
+
+		dp.now = until
+		e.Wake()
+	}
+}
+
+func TestIf(t *testing.T) {
+	dp := &mockDatapath{cwnd: 1000}
+	e := New(dp, 10*time.Millisecond)
+
+	e.Install(compile(t, pattern.NewPattern().
+		If(pattern.LOSS, pattern.NewPattern().RelativeCwnd(0.5)).
+		IfRttAbove(50*time.Millisecond, pattern.NewPattern().Cwnd(42)).
+		WaitRtts(1.0)))
+	if dp.cwnd != 1000 {
+		t.Errorf("expected no branch taken, got cwnd %d", dp.cwnd)
+		return
+	}
+
+	dp.sample = Sample{Lost: 1, Rtt: 10 * time.Millisecond}
+	dp.now = 10 * time.Millisecond
+	e.Wake()
+	if dp.cwnd != 500 {
+		t.Errorf("expected cwnd cut to 500 on loss, got %d", dp.cwnd)
+		return
+	}
+
+	dp.sample = Sample{Rtt: 100 * time.Millisecond}
+	dp.now = 20 * time.Millisecond
+	e.Wake()
+	if dp.cwnd != 42 {
+		t.Errorf("expected cwnd 42 on high rtt, got %d", dp.cwnd)
+	}
+}
+
+func TestAckIncrease(t *testing.T) {
+	dp := &mockDatapath{}
+	e := New(dp, 10*time.Millisecond)
+
+	e.Install(compile(t, pattern.NewPattern().Cwnd(1460).AckIncrease(1460).WaitRtts(1.0).Report()))
+	if dp.ackIncr != 1460 {
+		t.Errorf("expected an increase of 1460 per ack, got %d", dp.ackIncr)
+		return
+	}
+
+	// the next pattern turns it off
+	e.Install(compile(t, pattern.NewPattern().Cwnd(1460).WaitRtts(1.0)))
+	if dp.ackIncr != 0 {
+		t.Errorf("expected no increase after a new pattern, got %d", dp.ackIncr)
+	}
+}
+
+func TestRepeatNeverWaits(t *testing.T) {
+	dp := &mockDatapath{cwnd: 1000}
+	e := New(dp, 10*time.Millisecond)
+
+	st, _ := e.Install(compile(t, pattern.NewPattern().
+		Repeat(1<<30, pattern.NewPattern().RelativeCwnd(1.0)).
+		WaitRtts(1.0)))
+	if st != Stopped {
+		t.Errorf("expected a long block without waits to stop, got state %d", st)
+	}
+}
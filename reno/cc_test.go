@@ -37,7 +37,7 @@ func TestReno(t *testing.T) {
 
 	ipcMockCh := make(chan *flowPattern.Pattern)
 	mockIpc := &MockSendOnly{ch: ipcMockCh}
-	f.Create(42, mockIpc, 1462, 0, 10)
+	f.Create(42, mockIpc, 1462, 0, 10, ccpFlow.DatapathInfo{})
 	<-ipcMockCh // ignore the first initial cwnd set
 
 	if f.(*Reno).lastAck != 0 || f.(*Reno).sockid != 42 {
@@ -88,3 +88,35 @@ func TestReno(t *testing.T) {
 		return
 	}
 }
+
+func TestRenoHandoff(t *testing.T) {
+	Init()
+	f, err := ccpFlow.GetFlow("reno")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	ipcMockCh := make(chan *flowPattern.Pattern)
+	mockIpc := &MockSendOnly{ch: ipcMockCh}
+
+	// as the ccp resumes a flow switched over from another algorithm
+	f.Create(42, mockIpc, 1462, 1001, 20, ccpFlow.DatapathInfo{})
+	f.(ccpFlow.Resumer).Resume(ccpFlow.Handoff{
+		Cwnd: 20 * 1462,
+		Rtt:  30 * time.Millisecond,
+		Ack:  1000,
+	})
+
+	p := <-ipcMockCh
+	if s := p.String(); s != "cwnd 29240; wait 0.1rtt; report" {
+		t.Errorf("expected the initial cwnd pattern, got %q", s)
+		return
+	}
+
+	h := f.(ccpFlow.Handoffer).Handoff()
+	if h.Cwnd != 20*1462 || h.Rtt != 30*time.Millisecond || h.Ack != 1000 {
+		t.Errorf("wrong handoff %v", h)
+		return
+	}
+}
@@ -25,6 +25,8 @@ type Reno struct {
 
 	sockid uint32
 	ipc    ipc.SendOnly
+	// whose clock the flow runs on
+	dp ccpFlow.DatapathInfo
 }
 
 func (r *Reno) Name() string {
@@ -37,16 +39,18 @@ func (r *Reno) Create(
 	pktsz uint32,
 	startSeq uint32,
 	startCwnd uint32,
+	dp ccpFlow.DatapathInfo,
 ) {
 	r.sockid = socketid
+	r.dp = dp
 	r.ipc = send
 	r.pktSize = pktsz
 	r.ssthresh = 0x7fffffff
 	r.cwndClamp = 2e5 * float32(pktsz)
 	r.initCwnd = float32(pktsz * 10)
 	r.cwnd = float32(pktsz * startCwnd)
-	r.lastDrop = time.Now()
-	r.rtt = time.Since(r.lastDrop)
+	r.lastDrop = r.dp.Now()
+	r.rtt = r.dp.Since(r.lastDrop)
 	if startSeq == 0 {
 		r.lastAck = startSeq
 	} else {
@@ -139,16 +143,16 @@ func (r *Reno) GotMeasurement(m ccpFlow.Measurement) {
 }
 
 func (r *Reno) Drop(ev ccpFlow.DropEvent) {
-	if time.Since(r.lastDrop) <= r.rtt {
+	if r.dp.Since(r.lastDrop) <= r.rtt {
 		return
 	}
 
 	log.WithFields(log.Fields{
-		"time since last drop": time.Since(r.lastDrop),
-		"rtt": r.rtt,
+		"time since last drop": r.dp.Since(r.lastDrop),
+		"rtt":                  r.rtt,
 	}).Info("[reno] got drop")
 
-	r.lastDrop = time.Now()
+	r.lastDrop = r.dp.Now()
 
 	oldCwnd := r.cwnd
 	switch ev {
@@ -192,6 +196,18 @@ func (r *Reno) Drop(ev ccpFlow.DropEvent) {
 	}).Info("[reno] drop")
 }
 
+func (r *Reno) Handoff() ccpFlow.Handoff {
+	return ccpFlow.Handoff{
+		Cwnd: uint32(r.cwnd),
+		Rtt:  r.rtt,
+		Ack:  r.lastAck,
+	}
+}
+
+func (r *Reno) Resume(h ccpFlow.Handoff) {
+	r.rtt = h.Rtt
+}
+
 func (r *Reno) sendPattern(pattern *pattern.Pattern) {
 	err := r.ipc.SendPatternMsg(r.sockid, pattern)
 	if err != nil {
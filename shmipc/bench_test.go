@@ -0,0 +1,54 @@
+package shmipc
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func init() {
+	log.SetLevel(log.InfoLevel)
+	log.SetFormatter(&log.JSONFormatter{
+		TimestampFormat: time.RFC3339Nano,
+	})
+}
+
+// a MEASURE-sized message
+var benchMsg = MockMsg{b: string(make([]byte, 64))}
+
+func BenchmarkShmThroughput(b *testing.B) {
+	os.RemoveAll("/tmp/ccp-shm-bench")
+	in, err := New().SetupListen("shm-bench", 0).SetupFinish()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer in.Close()
+
+	out, err := New().SetupSend("shm-bench", 0).SetupFinish()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer out.Close()
+
+	msgs := in.Listen()
+	done := make(chan interface{})
+	go func() {
+		for k := 0; k < b.N; k++ {
+			<-msgs
+		}
+
+		close(done)
+	}()
+
+	b.ResetTimer()
+	for k := 0; k < b.N; k++ {
+		// the reader is behind; let it catch up
+		for out.SendMsg(benchMsg) != nil {
+			time.Sleep(time.Microsecond)
+		}
+	}
+
+	<-done
+}
@@ -0,0 +1,52 @@
+//go:build linux
+// +build linux
+
+package shmipc
+
+import (
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// not FUTEX_PRIVATE_FLAG: the waiter and waker are in different processes
+const (
+	futexWaitOp = 0
+	futexWakeOp = 1
+)
+
+// mapFile maps size bytes of f, shared with every other process mapping it
+func mapFile(f *os.File, size int) ([]byte, error) {
+	return syscall.Mmap(int(f.Fd()), 0, size, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+}
+
+func unmap(mem []byte) error {
+	return syscall.Munmap(mem)
+}
+
+// futexWait sleeps while *addr is val, for at most timeout
+func futexWait(addr *uint32, val uint32, timeout time.Duration) {
+	ts := syscall.NsecToTimespec(int64(timeout))
+	syscall.Syscall6(
+		syscall.SYS_FUTEX,
+		uintptr(unsafe.Pointer(addr)),
+		futexWaitOp,
+		uintptr(val),
+		uintptr(unsafe.Pointer(&ts)),
+		0,
+		0,
+	)
+}
+
+func futexWake(addr *uint32) {
+	syscall.Syscall6(
+		syscall.SYS_FUTEX,
+		uintptr(unsafe.Pointer(addr)),
+		futexWakeOp,
+		1,
+		0,
+		0,
+		0,
+	)
+}
@@ -0,0 +1,24 @@
+//go:build !linux
+// +build !linux
+
+package shmipc
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+func mapFile(f *os.File, size int) ([]byte, error) {
+	return nil, fmt.Errorf("shared memory ipc only supported on linux")
+}
+
+func unmap(mem []byte) error {
+	return nil
+}
+
+func futexWait(addr *uint32, val uint32, timeout time.Duration) {
+	time.Sleep(timeout)
+}
+
+func futexWake(addr *uint32) {}
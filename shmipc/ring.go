@@ -0,0 +1,148 @@
+package shmipc
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync/atomic"
+	"unsafe"
+
+	"ccp/ipcBackend"
+)
+
+/* A single-producer, single-consumer ring of messages in a shared mapping.
+ *
+ * The ring's header holds the total bytes each end has moved, so each end
+ * only ever writes its own counter. Each message is its length, as a
+ * little-endian uint32, then its bytes, wrapping at the end of the ring.
+ *
+ * 0        4          8      16     24       32          64
+ * | magic | capacity | head | tail | closed | (padding) | data ...
+ */
+
+const (
+	ringMagic     = 0x72706363 // "ccpr"
+	ringHeaderLen = 64
+	// bytes of messages each ring holds
+	ringSize = 1 << 18
+)
+
+// the consumer's doorbell: the producers bump seq after every message,
+// and rings whenever they add a ring.
+// the consumer sets sleeping while it waits on seq.
+//
+// 0     4       8          12
+// | seq | rings | sleeping | (padding) ...
+const bellLen = 64
+
+type ring struct {
+	mem  []byte
+	data []byte
+}
+
+func u32At(mem []byte, off int) *uint32 {
+	return (*uint32)(unsafe.Pointer(&mem[off]))
+}
+
+func u64At(mem []byte, off int) *uint64 {
+	return (*uint64)(unsafe.Pointer(&mem[off]))
+}
+
+func (r *ring) head() *uint64   { return u64At(r.mem, 8) }
+func (r *ring) tail() *uint64   { return u64At(r.mem, 16) }
+func (r *ring) closed() *uint32 { return u32At(r.mem, 24) }
+
+func newRing(mem []byte) *ring {
+	binary.LittleEndian.PutUint32(mem[4:], uint32(len(mem)-ringHeaderLen))
+	atomic.StoreUint32(u32At(mem, 0), ringMagic)
+	return &ring{mem: mem, data: mem[ringHeaderLen:]}
+}
+
+func openRing(mem []byte) (*ring, error) {
+	if len(mem) < ringHeaderLen || atomic.LoadUint32(u32At(mem, 0)) != ringMagic {
+		return nil, fmt.Errorf("not a ring")
+	}
+
+	if c := binary.LittleEndian.Uint32(mem[4:]); int(c) != len(mem)-ringHeaderLen {
+		return nil, fmt.Errorf("ring of %d bytes in a mapping of %d", c, len(mem))
+	}
+
+	return &ring{mem: mem, data: mem[ringHeaderLen:]}, nil
+}
+
+// copy b into the ring at pos, wrapping
+func (r *ring) put(pos uint64, b []byte) {
+	off := int(pos % uint64(len(r.data)))
+	n := copy(r.data[off:], b)
+	copy(r.data, b[n:])
+}
+
+// copy from the ring at pos into b, wrapping
+func (r *ring) get(pos uint64, b []byte) {
+	off := int(pos % uint64(len(r.data)))
+	n := copy(b, r.data[off:])
+	copy(b[n:], r.data)
+}
+
+// write adds msg to the ring, or fails if the consumer is too far behind
+func (r *ring) write(msg []byte) error {
+	need := uint64(4 + len(msg))
+	head := atomic.LoadUint64(r.head())
+	tail := atomic.LoadUint64(r.tail())
+	if free := uint64(len(r.data)) - (head - tail); need > free {
+		return &ipcbackend.Error{
+			Kind:  ipcbackend.ErrOverrun,
+			Where: "shmipc.ring.write",
+			Err:   fmt.Errorf("ring full: %d bytes free, message needs %d", free, need),
+		}
+	}
+
+	var l [4]byte
+	binary.LittleEndian.PutUint32(l[:], uint32(len(msg)))
+	r.put(head, l[:])
+	r.put(head+4, msg)
+
+	// publish the message only once it is all there
+	atomic.StoreUint64(r.head(), head+need)
+	return nil
+}
+
+// read takes the oldest message from the ring, if any
+func (r *ring) read() ([]byte, error) {
+	tail := atomic.LoadUint64(r.tail())
+	head := atomic.LoadUint64(r.head())
+	if head == tail {
+		return nil, nil
+	}
+
+	var l [4]byte
+	r.get(tail, l[:])
+	n := binary.LittleEndian.Uint32(l[:])
+	if uint64(4+n) > head-tail {
+		return nil, fmt.Errorf("corrupt ring: message of %d bytes, %d written", n, head-tail)
+	}
+
+	msg := make([]byte, n)
+	r.get(tail+4, msg)
+	atomic.StoreUint64(r.tail(), tail+4+uint64(n))
+	return msg, nil
+}
+
+func (r *ring) empty() bool {
+	return atomic.LoadUint64(r.head()) == atomic.LoadUint64(r.tail())
+}
+
+type bell struct {
+	mem []byte
+}
+
+func (b *bell) seq() *uint32      { return u32At(b.mem, 0) }
+func (b *bell) rings() *uint32    { return u32At(b.mem, 4) }
+func (b *bell) sleeping() *uint32 { return u32At(b.mem, 8) }
+
+// ring wakes the consumer, if it is waiting
+func (b *bell) ring() {
+	atomic.AddUint32(b.seq(), 1)
+	if atomic.LoadUint32(b.sleeping()) != 0 {
+		futexWake(b.seq())
+	}
+}
@@ -0,0 +1,400 @@
+package shmipc
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"ccp/ipcBackend"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/* A backend over shared memory, so that reporting many flows at a high
+ * rate costs no system call per message.
+ *
+ * A listening backend owns a directory, in the same place a unix socket
+ * backend would put its socket, holding a doorbell file. Every sending
+ * backend adds its own ring file there, so each ring has one producer and
+ * one consumer. The consumer drains every ring, and only sleeps on the
+ * doorbell's futex when all of them are empty; producers only wake it
+ * when it is sleeping.
+ */
+
+const (
+	bellFile   = "bell"
+	ringPrefix = "ring-"
+	// how long the consumer sleeps without a wakeup, in case it missed one
+	maxSleep = 100 * time.Millisecond
+)
+
+// ring files this process made, so their names are unique
+var ringCount uint32
+
+type ShmIpc struct {
+	// listening: the rings, and the doorbell producers ring
+	dir       string
+	bell      *bell
+	rings     map[string]*ring
+	seenRings uint32
+	listenCh  chan []byte
+	done      chan interface{}
+
+	// sending: our ring, and the listener's doorbell
+	sendMux sync.Mutex
+	out     *ring
+	outBell *bell
+
+	openFiles []string
+
+	err    error
+	killed chan interface{}
+	ipcbackend.Health
+}
+
+func New() ipcbackend.Backend {
+	return &ShmIpc{
+		openFiles: make([]string, 0),
+		rings:     make(map[string]*ring),
+		killed:    make(chan interface{}),
+	}
+}
+
+// create a file of size bytes at path, and map it
+func createMapped(path string, size int) ([]byte, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if err = f.Truncate(int64(size)); err == nil {
+		err = ipcbackend.SetPerm(path)
+	}
+
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+
+	mem, err := mapFile(f, size)
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+
+	return mem, nil
+}
+
+func openMapped(path string) ([]byte, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	st, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	return mapFile(f, int(st.Size()))
+}
+
+func (s *ShmIpc) SetupListen(loc string, id uint32) ipcbackend.Backend {
+	if s.err != nil {
+		return s
+	}
+
+	dir, newOpen, err := ipcbackend.AddressForListen(loc, id)
+	if err != nil {
+		s.err = err
+		return s
+	}
+
+	s.openFiles = append(s.openFiles, newOpen)
+	if err = os.MkdirAll(dir, ipcbackend.DirMode()); err == nil {
+		err = ipcbackend.SetPerm(dir)
+	}
+
+	if err != nil {
+		s.err = err
+		return s
+	}
+
+	mem, err := createMapped(filepath.Join(dir, bellFile), bellLen)
+	if err != nil {
+		s.err = err
+		return s
+	}
+
+	s.dir = dir
+	s.bell = &bell{mem: mem}
+	s.listenCh = make(chan []byte)
+	s.done = make(chan interface{})
+	go s.listen()
+	return s
+}
+
+func (s *ShmIpc) SetupSend(loc string, id uint32) ipcbackend.Backend {
+	if s.err != nil {
+		return s
+	}
+
+	dir := ipcbackend.AddressForSend(loc, id)
+	mem, err := openMapped(filepath.Join(dir, bellFile))
+	if err != nil {
+		s.err = err
+		return s
+	}
+
+	if len(mem) < bellLen {
+		unmap(mem)
+		s.err = fmt.Errorf("%s is not a doorbell", filepath.Join(dir, bellFile))
+		return s
+	}
+
+	s.outBell = &bell{mem: mem}
+
+	// make the ring under a name the listener ignores,
+	// so it never sees one half set up
+	name := fmt.Sprintf("%d-%d", os.Getpid(), atomic.AddUint32(&ringCount, 1))
+	tmp := filepath.Join(dir, "."+name)
+	mem, err = createMapped(tmp, ringHeaderLen+ringSize)
+	if err != nil {
+		s.err = err
+		return s
+	}
+
+	s.out = newRing(mem)
+	if err = os.Rename(tmp, filepath.Join(dir, ringPrefix+name)); err != nil {
+		os.Remove(tmp)
+		s.err = err
+		return s
+	}
+
+	atomic.AddUint32(s.outBell.rings(), 1)
+	s.outBell.ring()
+	return s
+}
+
+func (s *ShmIpc) SetupFinish() (ipcbackend.Backend, error) {
+	if s.err != nil {
+		log.WithFields(log.Fields{
+			"err": s.err,
+		}).Error("error setting up IPC")
+		return s, s.err
+	}
+
+	return s, nil
+}
+
+func (s *ShmIpc) SendMsg(msg ipcbackend.Msg) error {
+	buf, err := msg.Serialize()
+	if err != nil {
+		return err
+	}
+
+	// one producer per ring
+	s.sendMux.Lock()
+	defer s.sendMux.Unlock()
+	if s.out == nil {
+		return fmt.Errorf("backend not set up to send")
+	}
+
+	if err = s.out.write(buf); err != nil {
+		return err
+	}
+
+	s.outBell.ring()
+	return nil
+}
+
+func (s *ShmIpc) Listen() chan []byte {
+	msgCh := make(chan []byte)
+
+	go func() {
+		for {
+			select {
+			case <-s.killed:
+				close(msgCh)
+				return
+			case buf := <-s.listenCh:
+				msgCh <- buf
+			}
+		}
+	}()
+
+	return msgCh
+}
+
+func (s *ShmIpc) Close() error {
+	close(s.killed)
+
+	s.sendMux.Lock()
+	if s.out != nil {
+		// the listener removes the ring once it has drained it
+		atomic.StoreUint32(s.out.closed(), 1)
+		s.outBell.ring()
+		unmap(s.out.mem)
+		unmap(s.outBell.mem)
+		s.out = nil
+	}
+	s.sendMux.Unlock()
+
+	if s.bell != nil {
+		// wake listen(), and wait for it to stop reading the rings
+		s.bell.ring()
+		<-s.done
+		for _, r := range s.rings {
+			unmap(r.mem)
+		}
+
+		unmap(s.bell.mem)
+	}
+
+	// remove ring files before returning,
+	// so a process can exit right after closing
+	for _, f := range s.openFiles {
+		ipcbackend.ReleaseListen(f)
+	}
+
+	s.CloseErrors()
+	return nil
+}
+
+// look for rings added since the last scan
+func (s *ShmIpc) scan() {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"where": "shmIpc.scan",
+		}).Warn(err)
+		e := ipcbackend.NewError("shmIpc.scan", err)
+		if os.IsNotExist(err) {
+			// senders can no longer find us
+			e.Kind = ipcbackend.ErrClosed
+		}
+
+		s.Report(e)
+		return
+	}
+
+	for _, f := range files {
+		name := f.Name()
+		if !strings.HasPrefix(name, ringPrefix) {
+			continue
+		}
+
+		if _, ok := s.rings[name]; ok {
+			continue
+		}
+
+		// one bad ring only loses its sender's messages
+		mem, err := openMapped(filepath.Join(s.dir, name))
+		if err != nil {
+			log.WithFields(log.Fields{
+				"where": "shmIpc.scan",
+				"ring":  name,
+			}).Warn(err)
+			s.Report(&ipcbackend.Error{Kind: ipcbackend.ErrIO, Where: "shmIpc.scan " + name, Err: err})
+			continue
+		}
+
+		r, err := openRing(mem)
+		if err != nil {
+			unmap(mem)
+			log.WithFields(log.Fields{
+				"where": "shmIpc.scan",
+				"ring":  name,
+			}).Warn(err)
+			s.Report(&ipcbackend.Error{Kind: ipcbackend.ErrParse, Where: "shmIpc.scan " + name, Err: err})
+			continue
+		}
+
+		s.rings[name] = r
+	}
+}
+
+// drain moves every waiting message to listenCh,
+// returning how many there were
+func (s *ShmIpc) drain() (int, bool) {
+	n := 0
+	for name, r := range s.rings {
+		// check closed first: a producer closes after its last message
+		closed := atomic.LoadUint32(r.closed()) != 0
+		for {
+			msg, err := r.read()
+			if err != nil {
+				log.WithFields(log.Fields{
+					"where": "shmIpc.drain",
+					"ring":  name,
+				}).Warn(err)
+				s.Report(&ipcbackend.Error{Kind: ipcbackend.ErrParse, Where: "shmIpc.drain " + name, Err: err})
+				closed = true
+				break
+			}
+
+			if msg == nil {
+				break
+			}
+
+			n++
+			select {
+			case s.listenCh <- msg:
+			case <-s.killed:
+				return n, false
+			}
+		}
+
+		if closed && r.empty() {
+			unmap(r.mem)
+			os.Remove(filepath.Join(s.dir, name))
+			delete(s.rings, name)
+		}
+	}
+
+	return n, true
+}
+
+func (s *ShmIpc) listen() {
+	defer close(s.done)
+	for {
+		select {
+		case <-s.killed:
+			log.WithFields(log.Fields{
+				"where": "shmIpc.listen.checkKilled",
+			}).Info("killed, closing")
+			return
+		default:
+		}
+
+		if rings := atomic.LoadUint32(s.bell.rings()); rings != s.seenRings {
+			s.seenRings = rings
+			s.scan()
+		}
+
+		seq := atomic.LoadUint32(s.bell.seq())
+		n, ok := s.drain()
+		if !ok {
+			continue
+		}
+
+		if n > 0 {
+			continue
+		}
+
+		// nothing in any ring: sleep, unless a producer wrote since we looked
+		atomic.StoreUint32(s.bell.sleeping(), 1)
+		if atomic.LoadUint32(s.bell.seq()) == seq {
+			futexWait(s.bell.seq(), seq, maxSleep)
+		}
+
+		atomic.StoreUint32(s.bell.sleeping(), 0)
+	}
+}
@@ -0,0 +1,127 @@
+package shmipc
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+// mock message implementing ipcbackend.Msg
+type MockMsg struct {
+	b string
+}
+
+func (m MockMsg) Serialize() ([]byte, error) {
+	return []byte(m.b), nil
+}
+
+func TestRingWrap(t *testing.T) {
+	r := newRing(make([]byte, ringHeaderLen+16))
+
+	// each message takes 4 bytes of length and 5 of payload,
+	// so the ring wraps every other message
+	for k := 0; k < 10; k++ {
+		msg := fmt.Sprintf("msg-%d", k)
+		if err := r.write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := r.write([]byte("full!")); err == nil {
+			t.Fatal("expected a full ring to refuse a message")
+		}
+
+		got, err := r.read()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(got) != msg {
+			t.Fatalf("got %q, expected %q", got, msg)
+		}
+
+		if !r.empty() {
+			t.Fatal("expected the ring to be empty")
+		}
+	}
+}
+
+func TestCommunication(t *testing.T) {
+	os.RemoveAll("/tmp/ccp-shm-test")
+	in, err := New().SetupListen("shm-test", 0).SetupFinish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+
+	msgs := in.Listen()
+
+	// two producers, each with its own ring
+	var outs [2]*ShmIpc
+	for k := range outs {
+		out, err := New().SetupSend("shm-test", 0).SetupFinish()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		outs[k] = out.(*ShmIpc)
+	}
+
+	const n = 1000
+	for k := 0; k < n; k++ {
+		for p, out := range outs {
+			err = out.SendMsg(MockMsg{b: fmt.Sprintf("%d:%d", p, k)})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// messages arrive in order from each producer
+	var next [2]int
+	for got := 0; got < 2*n; got++ {
+		select {
+		case buf := <-msgs:
+			var p, k int
+			if _, err := fmt.Sscanf(string(buf), "%d:%d", &p, &k); err != nil {
+				t.Fatal(err)
+			}
+
+			if k != next[p] {
+				t.Fatalf("producer %d: got message %d, expected %d", p, k, next[p])
+			}
+
+			next[p]++
+		case <-time.After(time.Second):
+			t.Fatalf("timed out after %d messages", got)
+		}
+	}
+
+	// a closed producer's ring goes away once drained
+	outs[0].Close()
+	outs[1].Close()
+	deadline := time.Now().Add(time.Second)
+	for {
+		files, _ := countFiles("/tmp/ccp-shm-test")
+		if files == 1 {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("expected only the doorbell to remain, found %d files", files)
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func countFiles(dir string) (int, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	names, err := f.Readdirnames(-1)
+	return len(names), err
+}
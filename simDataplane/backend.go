@@ -0,0 +1,131 @@
+package simDataplane
+
+import (
+	"sync"
+
+	"ccp/ipc"
+	"ccp/ipcBackend"
+)
+
+/* In-process ipc backends connecting the simulated datapath to the CCP.
+ * Every message still goes through Serialize and the ipc demux, so the
+ * simulator exercises the same wire format as the real datapaths.
+ *
+ * The CCP's end does not deliver immediately: whatever the CCP sends while
+ * handling a message is queued until the engine drains it, so that a flow
+ * algorithm can send any number of patterns from one callback without
+ * blocking on the engine which called it.
+ */
+
+type pendingMsg struct {
+	buf         []byte
+	isPattern   bool
+	isAggregate bool
+}
+
+type ccpBackend struct {
+	mux     sync.Mutex
+	pending []pendingMsg
+
+	listenCh chan []byte
+	closed   bool
+	ipcbackend.Health
+}
+
+func (c *ccpBackend) SetupListen(l string, id uint32) ipcbackend.Backend {
+	return c
+}
+
+func (c *ccpBackend) SetupSend(l string, id uint32) ipcbackend.Backend {
+	return c
+}
+
+func (c *ccpBackend) SetupFinish() (ipcbackend.Backend, error) {
+	return c, nil
+}
+
+func (c *ccpBackend) SendMsg(msg ipcbackend.Msg) error {
+	buf, err := msg.Serialize()
+	if err != nil {
+		return err
+	}
+
+	_, isPattern := msg.(*ipc.PatternMsg)
+	_, isAggregate := msg.(*ipc.AggregateMsg)
+
+	c.mux.Lock()
+	c.pending = append(c.pending, pendingMsg{buf: buf, isPattern: isPattern, isAggregate: isAggregate})
+	c.mux.Unlock()
+	return nil
+}
+
+func (c *ccpBackend) Listen() chan []byte {
+	return c.listenCh
+}
+
+func (c *ccpBackend) Close() error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if !c.closed {
+		c.closed = true
+		close(c.listenCh)
+		c.CloseErrors()
+	}
+
+	return nil
+}
+
+// messages the CCP sent since the last drain
+func (c *ccpBackend) drain() (msgs []pendingMsg) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	msgs = c.pending
+	c.pending = nil
+	return
+}
+
+type dpBackend struct {
+	ccp *ccpBackend
+
+	listenCh chan []byte
+	closed   bool
+	ipcbackend.Health
+}
+
+func (d *dpBackend) SetupListen(l string, id uint32) ipcbackend.Backend {
+	return d
+}
+
+func (d *dpBackend) SetupSend(l string, id uint32) ipcbackend.Backend {
+	return d
+}
+
+func (d *dpBackend) SetupFinish() (ipcbackend.Backend, error) {
+	return d, nil
+}
+
+func (d *dpBackend) SendMsg(msg ipcbackend.Msg) error {
+	buf, err := msg.Serialize()
+	if err != nil {
+		return err
+	}
+
+	d.ccp.listenCh <- buf
+	return nil
+}
+
+func (d *dpBackend) Listen() chan []byte {
+	return d.listenCh
+}
+
+func (d *dpBackend) Close() error {
+	if !d.closed {
+		d.closed = true
+		close(d.listenCh)
+		d.CloseErrors()
+	}
+
+	return nil
+}
@@ -0,0 +1,64 @@
+package simDataplane
+
+import (
+	"container/heap"
+	"time"
+
+	"ccp/ccpFlow/pattern"
+)
+
+type eventType uint8
+
+const (
+	pktArrive eventType = iota
+	ackArrive
+	patternWake
+	patternInstall
+	rtoFire
+)
+
+type event struct {
+	at  time.Duration
+	seq uint64 // breaks ties in scheduling order, which keeps runs deterministic
+	typ eventType
+
+	flow *simFlow
+	pkt  simPacket
+	pat  *pattern.Pattern
+	gen  uint64
+}
+
+type eventQueue []*event
+
+func (q eventQueue) Len() int {
+	return len(q)
+}
+
+func (q eventQueue) Less(i, j int) bool {
+	if q[i].at != q[j].at {
+		return q[i].at < q[j].at
+	}
+
+	return q[i].seq < q[j].seq
+}
+
+func (q eventQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+}
+
+func (q *eventQueue) Push(x interface{}) {
+	*q = append(*q, x.(*event))
+}
+
+func (q *eventQueue) Pop() interface{} {
+	old := *q
+	ev := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return ev
+}
+
+func (n *Network) schedule(ev *event) {
+	ev.seq = n.eventSeq
+	n.eventSeq++
+	heap.Push(&n.events, ev)
+}
@@ -0,0 +1,555 @@
+package simDataplane
+
+import (
+	"time"
+
+	"ccp/ccpFlow"
+	"ccp/ccpFlow/pattern"
+	"ccp/ipc"
+	"ccp/patternExec"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// packets acked after a missing one before it is declared lost
+const dupThresh = 3
+
+const (
+	minRto = 200 * time.Millisecond
+	maxRto = time.Minute
+)
+
+type FlowStats struct {
+	Alg string
+	// bytes handed to the link, including retransmissions
+	SentBytes uint64
+	// bytes cumulatively acknowledged
+	AckedBytes  uint64
+	Retransmits uint64
+	LostPkts    uint64
+	Timeouts    uint64
+	// messages exchanged with the CCP
+	Reports  uint64
+	Drops    uint64
+	Patterns uint64
+	// latest and smallest rtt samples
+	Rtt    time.Duration
+	MinRtt time.Duration
+	// congestion window set by the current pattern, bytes
+	Cwnd uint32
+	// when the last byte was acknowledged, for flows with a size
+	Done       bool
+	FinishedAt time.Duration
+}
+
+// a data packet, or the ack for one
+type simPacket struct {
+	seq    uint64
+	len    uint32
+	sentAt time.Duration
+	idx    uint64 // transmission order, for loss detection
+
+	cumAck uint64 // acks only
+}
+
+// a transmission of seq the sender has not yet seen acknowledged
+type txPkt struct {
+	simPacket
+	acked bool
+	lost  bool
+}
+
+type simFlow struct {
+	n    *Network
+	sid  uint32
+	alg  ccpFlow.Flow
+	mss  uint32
+	size uint64
+
+	// sender
+	cwnd        uint32
+	ackIncr     uint32
+	nextSeq     uint64
+	cumAck      uint64
+	inFlight    uint32
+	outstanding map[uint64]*txPkt
+	sendOrder   []*txPkt
+	retx        []uint64
+	txIdx       uint64
+	rtt         time.Duration
+	// bytes acked, cumulatively or selectively
+	delivered uint64
+
+	inRecovery  bool
+	recoverySeq uint64
+
+	rtoArmed   bool
+	rtoGen     uint64
+	rtoBackoff uint
+
+	// receiver
+	rcvCumAck uint64
+	rcvd      map[uint64]uint32
+
+	// reporting
+	exec *patternExec.Executor
+	// tells current patternWake events from stale ones
+	patGen            uint64
+	waitingReport     bool
+	lastReport        time.Duration
+	reportedAck       uint64
+	sentSinceReport   uint64
+	ackedSinceReport  uint64
+	lostSinceReport   uint32
+	minRttSinceReport time.Duration
+	agg               ipc.Aggregator
+
+	stats FlowStats
+}
+
+func makeSimFlow(n *Network, sid uint32, alg string, size uint64) *simFlow {
+	// until there is a sample, assume the base rtt of the link
+	rtt := 2*n.cfg.Link.Delay + n.link.txTime(n.cfg.Mss)
+	if rtt <= 0 {
+		rtt = time.Millisecond
+	}
+
+	f := &simFlow{
+		n:           n,
+		sid:         sid,
+		mss:         n.cfg.Mss,
+		size:        size,
+		cwnd:        n.cfg.InitCwnd * n.cfg.Mss,
+		outstanding: make(map[uint64]*txPkt),
+		sendOrder:   make([]*txPkt, 0),
+		retx:        make([]uint64, 0),
+		rtt:         rtt,
+		rcvd:        make(map[uint64]uint32),
+		lastReport:  n.now,
+		stats: FlowStats{
+			Alg:  alg,
+			Cwnd: n.cfg.InitCwnd * n.cfg.Mss,
+		},
+	}
+
+	f.exec = patternExec.New(f, rtt)
+	return f
+}
+
+// sender
+
+func (f *simFlow) trySend() {
+	for f.inFlight < f.cwnd {
+		if len(f.retx) > 0 {
+			seq := f.retx[0]
+			f.retx = f.retx[1:]
+			p, ok := f.outstanding[seq]
+			if !ok || !p.lost {
+				// acked since it was declared lost
+				continue
+			}
+
+			f.stats.Retransmits++
+			f.transmit(seq, p.len)
+			continue
+		}
+
+		if f.size != 0 && f.nextSeq >= f.size {
+			return
+		}
+
+		l := uint64(f.mss)
+		if f.size != 0 && f.size-f.nextSeq < l {
+			l = f.size - f.nextSeq
+		}
+
+		f.transmit(f.nextSeq, uint32(l))
+		f.nextSeq += l
+	}
+}
+
+func (f *simFlow) transmit(seq uint64, l uint32) {
+	n := f.n
+	p := &txPkt{simPacket: simPacket{
+		seq:    seq,
+		len:    l,
+		sentAt: n.now,
+		idx:    f.txIdx,
+	}}
+	f.txIdx++
+
+	f.outstanding[seq] = p
+	f.sendOrder = append(f.sendOrder, p)
+	f.inFlight += l
+	f.stats.SentBytes += uint64(l)
+	f.sentSinceReport += uint64(l)
+
+	if arrival, ok := n.link.send(n.now, l); ok {
+		n.schedule(&event{
+			at:   arrival,
+			typ:  pktArrive,
+			flow: f,
+			pkt:  p.simPacket,
+		})
+	}
+
+	if !f.rtoArmed {
+		f.armRto()
+	}
+}
+
+func (f *simFlow) gotAck(a simPacket) {
+	n := f.n
+	f.sampleRtt(n.now - a.sentAt)
+
+	progress := a.cumAck > f.cumAck
+	if progress {
+		f.stats.AckedBytes += a.cumAck - f.cumAck
+		f.cumAck = a.cumAck
+		f.rtoBackoff = 0
+		if f.ackIncr > 0 {
+			f.cwnd += f.ackIncr
+			f.stats.Cwnd = f.cwnd
+		}
+	}
+
+	if p, ok := f.outstanding[a.seq]; ok {
+		if !p.lost {
+			f.inFlight -= p.len
+		}
+
+		p.acked = true
+		f.delivered += uint64(p.len)
+		f.ackedSinceReport += uint64(p.len)
+		delete(f.outstanding, a.seq)
+		f.agg.Ack(n.now-a.sentAt, uint64(p.len))
+	} else {
+		f.agg.Ack(n.now-a.sentAt, 0)
+	}
+
+	f.detectLoss(a.idx)
+
+	if f.inRecovery && f.cumAck >= f.recoverySeq {
+		f.inRecovery = false
+	}
+
+	if f.size != 0 && f.cumAck >= f.size && !f.stats.Done {
+		f.stats.Done = true
+		f.stats.FinishedAt = n.now
+		f.close()
+		return
+	}
+
+	if len(f.outstanding) == 0 {
+		f.disarmRto()
+	} else if progress {
+		f.armRto()
+	}
+
+	if progress && f.waitingReport {
+		f.waitingReport = false
+		f.report()
+		f.patternState(f.exec.Reported(f.rtt))
+	}
+
+	f.trySend()
+}
+
+func (f *simFlow) sampleRtt(rtt time.Duration) {
+	f.rtt = rtt
+	f.stats.Rtt = rtt
+	if f.stats.MinRtt == 0 || rtt < f.stats.MinRtt {
+		f.stats.MinRtt = rtt
+	}
+
+	if f.minRttSinceReport == 0 || rtt < f.minRttSinceReport {
+		f.minRttSinceReport = rtt
+	}
+}
+
+// the link is FIFO, so once a transmission is acked,
+// anything sent dupThresh packets before it that is still unacked was lost.
+func (f *simFlow) detectLoss(ackedIdx uint64) {
+	lost := false
+	for len(f.sendOrder) > 0 {
+		p := f.sendOrder[0]
+		if !p.acked && !p.lost {
+			if p.idx+dupThresh > ackedIdx {
+				break
+			}
+
+			f.markLost(p)
+			lost = true
+		}
+
+		f.sendOrder = f.sendOrder[1:]
+	}
+
+	if lost && !f.inRecovery {
+		f.inRecovery = true
+		f.recoverySeq = f.nextSeq
+		f.drop(ccpFlow.DupAck)
+	}
+}
+
+func (f *simFlow) markLost(p *txPkt) {
+	if cur, ok := f.outstanding[p.seq]; !ok || cur != p {
+		// already superseded by a retransmission
+		return
+	}
+
+	p.lost = true
+	f.inFlight -= p.len
+	f.retx = append(f.retx, p.seq)
+	f.stats.LostPkts++
+	f.lostSinceReport++
+	f.agg.Lost(1)
+}
+
+func (f *simFlow) rto() time.Duration {
+	rto := 2 * f.rtt
+	if rto < minRto {
+		rto = minRto
+	}
+
+	rto <<= f.rtoBackoff
+	if rto > maxRto {
+		rto = maxRto
+	}
+
+	return rto
+}
+
+func (f *simFlow) armRto() {
+	f.rtoGen++
+	f.rtoArmed = true
+	f.n.schedule(&event{
+		at:   f.n.now + f.rto(),
+		typ:  rtoFire,
+		flow: f,
+		gen:  f.rtoGen,
+	})
+}
+
+func (f *simFlow) disarmRto() {
+	f.rtoGen++
+	f.rtoArmed = false
+}
+
+// nothing was acked for an rto: assume everything in flight is lost
+func (f *simFlow) timeout() {
+	f.rtoArmed = false
+	if f.inFlight == 0 && len(f.retx) == 0 {
+		return
+	}
+
+	for _, p := range f.sendOrder {
+		if !p.acked && !p.lost {
+			f.markLost(p)
+		}
+	}
+
+	f.sendOrder = f.sendOrder[:0]
+	f.stats.Timeouts++
+	if f.rtoBackoff < 8 {
+		f.rtoBackoff++
+	}
+
+	f.inRecovery = true
+	f.recoverySeq = f.nextSeq
+	f.drop(ccpFlow.Timeout)
+
+	f.armRto()
+	f.trySend()
+}
+
+// receiver
+
+func (f *simFlow) gotPkt(p simPacket) {
+	n := f.n
+	switch {
+	case p.seq+uint64(p.len) <= f.rcvCumAck:
+		// duplicate
+	case p.seq == f.rcvCumAck:
+		f.rcvCumAck += uint64(p.len)
+		for {
+			l, ok := f.rcvd[f.rcvCumAck]
+			if !ok {
+				break
+			}
+
+			delete(f.rcvd, f.rcvCumAck)
+			f.rcvCumAck += uint64(l)
+		}
+	default:
+		f.rcvd[p.seq] = p.len
+	}
+
+	// ack every packet, carrying the cumulative ack and which packet arrived.
+	// the reverse path is never congested.
+	p.cumAck = f.rcvCumAck
+	n.schedule(&event{
+		at:   n.now + n.cfg.Link.Delay,
+		typ:  ackArrive,
+		flow: f,
+		pkt:  p,
+	})
+}
+
+// communication with the CCP
+
+// the optional measurement fields report fills in
+const measureFields = ipc.FieldMinRtt | ipc.FieldDelivered | ipc.FieldInflight |
+	ipc.FieldSacked | ipc.FieldTimestamp | ipc.FieldAggregates
+
+func (f *simFlow) report() {
+	n := f.n
+	var rin, rout uint64
+	if interval := n.now - f.lastReport; interval > 0 {
+		rin = uint64(float64(f.sentSinceReport) / interval.Seconds())
+		rout = uint64(float64(f.ackedSinceReport) / interval.Seconds())
+	}
+
+	var sacked uint64
+	if f.delivered > f.cumAck {
+		sacked = f.delivered - f.cumAck
+	}
+
+	err := n.dp.SendMeasureMsgExt(f.sid, uint32(f.cumAck), f.rtt, f.lostSinceReport, rin, rout, ipc.MeasureExt{
+		MinRtt:    f.minRttSinceReport,
+		Delivered: f.delivered,
+		Inflight:  uint64(f.inFlight),
+		Sacked:    sacked,
+		Timestamp: n.now,
+		Agg:       f.agg.Report(),
+	})
+	if err == nil {
+		err = n.ccpHandle()
+	}
+
+	if err != nil {
+		log.WithFields(log.Fields{
+			"flowid": f.sid,
+			"where":  "simFlow.report",
+		}).Warn(err)
+	}
+
+	f.stats.Reports++
+	f.lastReport = n.now
+	f.reportedAck = f.cumAck
+	f.sentSinceReport = 0
+	f.ackedSinceReport = 0
+	f.lostSinceReport = 0
+	f.minRttSinceReport = 0
+}
+
+func (f *simFlow) drop(ev ccpFlow.DropEvent) {
+	n := f.n
+	err := n.dp.SendDropMsg(f.sid, string(ev))
+	if err == nil {
+		err = n.ccpHandle()
+	}
+
+	if err != nil {
+		log.WithFields(log.Fields{
+			"flowid": f.sid,
+			"event":  ev,
+			"where":  "simFlow.drop",
+		}).Warn(err)
+	}
+
+	f.stats.Drops++
+}
+
+// every byte was acked: stop the pattern and tell the CCP
+func (f *simFlow) close() {
+	f.exec.Stop()
+	f.waitingReport = false
+	f.disarmRto()
+
+	n := f.n
+	err := n.dp.SendCloseMsg(f.sid)
+	if err == nil {
+		err = n.ccpHandle()
+	}
+
+	if err != nil {
+		log.WithFields(log.Fields{
+			"flowid": f.sid,
+			"where":  "simFlow.close",
+		}).Warn(err)
+	}
+}
+
+// pattern execution: the simulated flow is the executor's Datapath
+
+func (f *simFlow) install(p *pattern.Pattern) {
+	if f.stats.Done {
+		return
+	}
+
+	f.stats.Patterns++
+	f.waitingReport = false
+	f.patternState(f.exec.Install(p))
+}
+
+// wake the pattern up when it asks to be
+func (f *simFlow) patternState(st patternExec.State, until time.Duration) {
+	if st != patternExec.Waiting {
+		return
+	}
+
+	f.patGen++
+	f.n.schedule(&event{
+		at:   until,
+		typ:  patternWake,
+		flow: f,
+		gen:  f.patGen,
+	})
+}
+
+func (f *simFlow) Cwnd() uint32 {
+	return f.cwnd
+}
+
+func (f *simFlow) SetCwnd(cwnd uint32) {
+	// a window below one packet would stall the flow for good
+	if cwnd < f.mss {
+		cwnd = f.mss
+	}
+
+	f.cwnd = cwnd
+	f.stats.Cwnd = cwnd
+	f.trySend()
+}
+
+// the simulator does not pace: rate patterns only shape the window
+func (f *simFlow) SetRate(rate float32) {}
+
+// gotAck applies the increase
+func (f *simFlow) SetAckIncrease(inc uint32) {
+	f.ackIncr = inc
+}
+
+func (f *simFlow) Sample() patternExec.Sample {
+	return patternExec.Sample{
+		Lost: f.lostSinceReport,
+		Rtt:  f.rtt,
+	}
+}
+
+func (f *simFlow) Now() time.Duration {
+	return f.n.now
+}
+
+// report right away if the cumulative ack moved since the last report,
+// otherwise once it does
+func (f *simFlow) WaitForReport() (time.Duration, bool) {
+	if f.cumAck == f.reportedAck {
+		f.waitingReport = true
+		return 0, false
+	}
+
+	f.report()
+	return f.rtt, true
+}
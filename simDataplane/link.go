@@ -0,0 +1,144 @@
+package simDataplane
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+type LinkConfig struct {
+	// bottleneck rate, bytes per second
+	Bandwidth float64
+	// one-way propagation delay; acks see the same delay back
+	Delay time.Duration
+	// drop-tail queue at the bottleneck, bytes
+	Buffer uint32
+
+	// independent per-packet loss probability
+	LossRate float64
+
+	// bursty loss, as a Gilbert-Elliott two state model:
+	// each packet moves good -> bad with probability BurstEnter,
+	// bad -> good with probability BurstExit,
+	// and is lost with probability BurstLoss while in the bad state.
+	BurstEnter float64
+	BurstExit  float64
+	BurstLoss  float64
+}
+
+func (c LinkConfig) validate() error {
+	if c.Bandwidth <= 0 {
+		return fmt.Errorf("link bandwidth must be positive: %v", c.Bandwidth)
+	}
+
+	if c.Delay < 0 {
+		return fmt.Errorf("link delay must not be negative: %v", c.Delay)
+	}
+
+	for _, p := range []float64{c.LossRate, c.BurstEnter, c.BurstExit, c.BurstLoss} {
+		if p < 0 || p > 1 {
+			return fmt.Errorf("loss probability out of range: %v", p)
+		}
+	}
+
+	return nil
+}
+
+type LinkStats struct {
+	// packets and bytes which made it across the link
+	DeliveredPkts  uint64
+	DeliveredBytes uint64
+	// packets dropped at the tail of a full queue
+	QueueDrops uint64
+	// packets lost on the wire, by the random or bursty loss models
+	WireDrops uint64
+	// largest queue occupancy seen, bytes
+	MaxQueue uint32
+}
+
+/* A single bottleneck link shared by every flow.
+ * Packets are serialized at Bandwidth behind whatever is already queued,
+ * then spend Delay on the wire. The queue is not simulated packet by
+ * packet: its occupancy is the backlog implied by busyUntil.
+ */
+type link struct {
+	cfg LinkConfig
+	rng *rand.Rand
+
+	busyUntil time.Duration
+	inBurst   bool
+
+	stats LinkStats
+}
+
+func makeLink(cfg LinkConfig, rng *rand.Rand) *link {
+	return &link{
+		cfg: cfg,
+		rng: rng,
+	}
+}
+
+// bytes waiting to be serialized at time now
+func (l *link) queued(now time.Duration) uint32 {
+	if l.busyUntil <= now {
+		return 0
+	}
+
+	return uint32((l.busyUntil - now).Seconds() * l.cfg.Bandwidth)
+}
+
+func (l *link) txTime(size uint32) time.Duration {
+	return time.Duration(float64(size) / l.cfg.Bandwidth * float64(time.Second))
+}
+
+// whether the wire loses the next packet
+func (l *link) wireLoss() bool {
+	lost := l.cfg.LossRate > 0 && l.rng.Float64() < l.cfg.LossRate
+
+	if l.cfg.BurstEnter > 0 {
+		if l.inBurst {
+			if l.rng.Float64() < l.cfg.BurstExit {
+				l.inBurst = false
+			}
+		} else if l.rng.Float64() < l.cfg.BurstEnter {
+			l.inBurst = true
+		}
+
+		if l.inBurst && l.rng.Float64() < l.cfg.BurstLoss {
+			lost = true
+		}
+	}
+
+	return lost
+}
+
+// enqueue a packet of size bytes at time now.
+// returns when it arrives at the far end, or ok = false if it is lost.
+func (l *link) send(now time.Duration, size uint32) (arrival time.Duration, ok bool) {
+	q := l.queued(now)
+	if q+size > l.cfg.Buffer {
+		l.stats.QueueDrops++
+		return 0, false
+	}
+
+	if q+size > l.stats.MaxQueue {
+		l.stats.MaxQueue = q + size
+	}
+
+	start := now
+	if l.busyUntil > start {
+		start = l.busyUntil
+	}
+
+	l.busyUntil = start + l.txTime(size)
+
+	// the packet still occupies the link if the wire then loses it
+	if l.wireLoss() {
+		l.stats.WireDrops++
+		return 0, false
+	}
+
+	l.stats.DeliveredPkts++
+	l.stats.DeliveredBytes += uint64(size)
+	return l.busyUntil + l.cfg.Delay, true
+}
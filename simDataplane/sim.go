@@ -0,0 +1,334 @@
+package simDataplane
+
+import (
+	"container/heap"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"ccp/ccpFlow"
+	"ccp/ccpFlow/pattern"
+	"ccp/ipc"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/* A deterministic discrete-event simulation of flows sharing one
+ * bottleneck link, controlled over ipc by ccpFlow algorithms.
+ *
+ * The Network plays both the datapath and the CCP's event loop: after
+ * handing a message to the CCP's ipc it waits for the flow's handler to
+ * run before advancing the virtual clock, so every control decision takes
+ * effect at a well-defined virtual time. Algorithms tell the time with the
+ * virtual clock in their DatapathInfo, so as long as they use nothing else,
+ * runs with the same Seed are identical, however fast the host is.
+ */
+
+// how long to wait for the ipc layer to hand up a message, in real time
+const ipcTimeout = time.Second
+
+// the virtual time at which every Network starts, on the clock algorithms
+// see. Not zero, since some algorithms take a zero time to mean unset.
+var simEpoch = time.Unix(1<<30, 0)
+
+// the Network's virtual time, as a ccpFlow.Clock
+type virtualClock struct {
+	n *Network
+}
+
+func (c virtualClock) Now() time.Time {
+	return simEpoch.Add(c.n.now)
+}
+
+type Config struct {
+	Link LinkConfig
+	// seeds the loss models; runs with the same seed are identical
+	Seed int64
+	// payload bytes per packet, defaults to 1460
+	Mss uint32
+	// initial congestion window passed to Flow.Create, in packets; defaults to 10
+	InitCwnd uint32
+	// virtual time between the CCP sending a pattern and the datapath installing it
+	CtlDelay time.Duration
+}
+
+type Network struct {
+	cfg  Config
+	now  time.Duration
+	link *link
+
+	events   eventQueue
+	eventSeq uint64
+
+	flows   map[uint32]*simFlow
+	nextSid uint32
+
+	// the CCP's and the datapath's ends of the in-process ipc
+	ccpEnd *ccpBackend
+	dpEnd  *dpBackend
+	ccp    *ipc.Ipc
+	dp     *ipc.Ipc
+}
+
+func New(cfg Config) (*Network, error) {
+	err := cfg.Link.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Mss == 0 {
+		cfg.Mss = 1460
+	}
+
+	if cfg.InitCwnd == 0 {
+		cfg.InitCwnd = 10
+	}
+
+	n := &Network{
+		cfg:     cfg,
+		link:    makeLink(cfg.Link, rand.New(rand.NewSource(cfg.Seed))),
+		events:  make(eventQueue, 0),
+		flows:   make(map[uint32]*simFlow),
+		nextSid: 1,
+	}
+
+	n.ccpEnd = &ccpBackend{listenCh: make(chan []byte)}
+	n.dpEnd = &dpBackend{ccp: n.ccpEnd, listenCh: make(chan []byte)}
+
+	n.ccp, err = ipc.SetupWithBackend(n.ccpEnd)
+	if err != nil {
+		return nil, err
+	}
+
+	n.dp, err = ipc.SetupWithBackend(n.dpEnd)
+	if err != nil {
+		n.ccp.Close()
+		return nil, err
+	}
+
+	return n, nil
+}
+
+// Now returns the virtual time since the Network was created
+func (n *Network) Now() time.Duration {
+	return n.now
+}
+
+func (n *Network) Link() LinkStats {
+	return n.link.stats
+}
+
+func (n *Network) Flow(sid uint32) (FlowStats, error) {
+	f, ok := n.flows[sid]
+	if !ok {
+		return FlowStats{}, fmt.Errorf("unknown flow %d", sid)
+	}
+
+	return f.stats, nil
+}
+
+/* AddFlow starts a flow at the current virtual time, controlled by the
+ * registered algorithm alg. It sends size bytes, or never finishes if
+ * size is 0. Returns the flow's socket id.
+ */
+func (n *Network) AddFlow(alg string, size uint64) (uint32, error) {
+	if _, err := ccpFlow.GetFlow(alg); err != nil {
+		return 0, err
+	}
+
+	sid := n.nextSid
+	n.nextSid++
+	n.flows[sid] = makeSimFlow(n, sid, alg, size)
+
+	err := n.hello(sid)
+	if err == nil {
+		err = n.dp.SendCreateMsgInfo(sid, 0, alg, ipc.CreateInfo{
+			Mss:      n.cfg.Mss,
+			InitCwnd: n.cfg.InitCwnd,
+			Events:   pattern.AllEvents,
+			Fields:   measureFields,
+		})
+	}
+
+	if err == nil {
+		err = n.ccpHandle()
+	}
+
+	if err != nil {
+		delete(n.flows, sid)
+		return 0, err
+	}
+
+	// start with the initial window until the algorithm's first pattern lands
+	n.flows[sid].trySend()
+	return sid, nil
+}
+
+// Run advances the virtual clock by d, processing every event on the way
+func (n *Network) Run(d time.Duration) {
+	end := n.now + d
+	for len(n.events) > 0 && n.events[0].at <= end {
+		ev := heap.Pop(&n.events).(*event)
+		n.now = ev.at
+		n.handleEvent(ev)
+	}
+
+	n.now = end
+}
+
+func (n *Network) Close() error {
+	n.dp.Close()
+	return n.ccp.Close()
+}
+
+func (n *Network) handleEvent(ev *event) {
+	f := ev.flow
+	switch ev.typ {
+	case pktArrive:
+		f.gotPkt(ev.pkt)
+	case ackArrive:
+		f.gotAck(ev.pkt)
+	case patternWake:
+		if ev.gen == f.patGen {
+			f.patternState(f.exec.Wake())
+		}
+	case patternInstall:
+		f.install(ev.pat)
+	case rtoFire:
+		if ev.gen == f.rtoGen {
+			f.timeout()
+		}
+	}
+}
+
+// announce the datapath's wire protocol, and the CCP's in answer,
+// as a real datapath and CCP would
+func (n *Network) hello(sid uint32) error {
+	err := n.dp.SendHelloMsg(sid)
+	if err == nil {
+		err = waitHello(n.ccp, sid)
+	}
+
+	if err == nil {
+		err = n.ccp.SendHelloMsg(sid)
+	}
+
+	if err == nil {
+		err = n.dpHandle()
+	}
+
+	if err == nil {
+		err = waitHello(n.dp, sid)
+	}
+
+	return err
+}
+
+// ipcs handle HELLO internally; wait for sid's to land on i
+func waitHello(i *ipc.Ipc, sid uint32) error {
+	deadline := time.Now().Add(ipcTimeout)
+	for i.PeerVersion(sid) != ipc.ProtoVersion {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out negotiating protocol for flow %d", sid)
+		}
+
+		time.Sleep(time.Microsecond)
+	}
+
+	return nil
+}
+
+// wait for the CCP's ipc to hand up the message the datapath just sent,
+// run the flow algorithm's handler for it,
+// then deliver whatever the algorithm sent back.
+func (n *Network) ccpHandle() error {
+	select {
+	case cr := <-n.ccp.CreateNotify:
+		f, ok := n.flows[cr.SocketId()]
+		if !ok {
+			return fmt.Errorf("create for unknown flow %d", cr.SocketId())
+		}
+
+		alg, err := ccpFlow.GetFlow(cr.CongAlg())
+		if err != nil {
+			return err
+		}
+
+		f.alg = alg
+		info := cr.Info()
+		dp := ccpFlow.DatapathInfoFromMsg(cr)
+		dp.Clock = virtualClock{n: n}
+		alg.Create(cr.SocketId(), n.ccp, info.Mss, cr.StartSeq(), info.InitCwnd, dp)
+	case m := <-n.ccp.MeasureNotify:
+		f, ok := n.flows[m.SocketId()]
+		if !ok {
+			return fmt.Errorf("measurement for unknown flow %d", m.SocketId())
+		}
+
+		f.alg.GotMeasurement(ccpFlow.MeasurementFromMsg(m))
+	case dr := <-n.ccp.DropNotify:
+		f, ok := n.flows[dr.SocketId()]
+		if !ok {
+			return fmt.Errorf("drop for unknown flow %d", dr.SocketId())
+		}
+
+		f.alg.Drop(ccpFlow.DropEvent(dr.Event()))
+	case cl := <-n.ccp.CloseNotify:
+		f, ok := n.flows[cl.SocketId()]
+		if !ok {
+			return fmt.Errorf("close for unknown flow %d", cl.SocketId())
+		}
+
+		if c, ok := f.alg.(ccpFlow.Closer); ok {
+			c.Close()
+		}
+	case <-time.After(ipcTimeout):
+		return fmt.Errorf("timed out waiting for ccp ipc")
+	}
+
+	return n.dpHandle()
+}
+
+// deliver messages the CCP sent to the datapath
+func (n *Network) dpHandle() error {
+	for _, m := range n.ccpEnd.drain() {
+		n.dpEnd.listenCh <- m.buf
+		if !m.isPattern && !m.isAggregate {
+			continue
+		}
+
+		select {
+		case am := <-n.dp.AggregateNotify:
+			f, ok := n.flows[am.SocketId()]
+			if !ok {
+				log.WithFields(log.Fields{
+					"flowid": am.SocketId(),
+				}).Warn("aggregate for unknown flow")
+				continue
+			}
+
+			// takes effect from the next ack, without the control delay
+			// patterns see, so the first report covers the whole interval
+			f.agg.Configure(am.Config())
+		case pm := <-n.dp.PatternNotify:
+			f, ok := n.flows[pm.SocketId()]
+			if !ok {
+				log.WithFields(log.Fields{
+					"flowid": pm.SocketId(),
+				}).Warn("pattern for unknown flow")
+				continue
+			}
+
+			n.schedule(&event{
+				at:   n.now + n.cfg.CtlDelay,
+				typ:  patternInstall,
+				flow: f,
+				pat:  pm.Pattern(),
+			})
+		case <-time.After(ipcTimeout):
+			return fmt.Errorf("timed out waiting for datapath ipc")
+		}
+	}
+
+	return nil
+}
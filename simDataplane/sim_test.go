@@ -0,0 +1,426 @@
+package simDataplane
+
+import (
+	"testing"
+	"time"
+
+	"ccp/bbr"
+	"ccp/ccpFlow"
+	"ccp/ccpFlow/pattern"
+	"ccp/compound"
+	"ccp/cubic"
+	"ccp/ipc"
+	"ccp/reno"
+	"ccp/vegas"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func init() {
+	log.SetLevel(log.WarnLevel)
+
+	bbr.Init()
+	compound.Init()
+	cubic.Init()
+	vegas.Init()
+	reno.Init()
+	ccpFlow.Register("sim-fixed", func() ccpFlow.Flow { return &fixedFlow{} })
+	ccpFlow.Register("sim-slowstart", func() ccpFlow.Flow { return &slowStartFlow{} })
+	ccpFlow.Register("sim-aggregate", func() ccpFlow.Flow { return &aggregateFlow{} })
+}
+
+// holds cwnd at a fixed number of packets and reports every rtt
+type fixedFlow struct {
+	closed bool
+	last   ccpFlow.Measurement
+	// what Create was given
+	pktsz     uint32
+	startCwnd uint32
+	dp        ccpFlow.DatapathInfo
+}
+
+const fixedCwndPkts = 20
+
+func (f *fixedFlow) Name() string {
+	return "sim-fixed"
+}
+
+func (f *fixedFlow) Create(
+	sockid uint32,
+	send ipc.SendOnly,
+	pktsz uint32,
+	startSeq uint32,
+	startCwnd uint32,
+	dp ccpFlow.DatapathInfo,
+) {
+	f.pktsz = pktsz
+	f.startCwnd = startCwnd
+	f.dp = dp
+
+	p, err := pattern.
+		NewPattern().
+		Cwnd(fixedCwndPkts * pktsz).
+		WaitRtts(1.0).
+		Report().
+		Compile()
+	if err != nil {
+		return
+	}
+
+	send.SendPatternMsg(sockid, p)
+}
+
+func (f *fixedFlow) GotMeasurement(m ccpFlow.Measurement) {
+	f.last = m
+}
+
+func (f *fixedFlow) Drop(ev ccpFlow.DropEvent) {}
+
+func (f *fixedFlow) Close() {
+	f.closed = true
+}
+
+// slow starts in the datapath, from a single pattern
+type slowStartFlow struct {
+	fixedFlow
+}
+
+func (f *slowStartFlow) Name() string {
+	return "sim-slowstart"
+}
+
+func (f *slowStartFlow) Create(
+	sockid uint32,
+	send ipc.SendOnly,
+	pktsz uint32,
+	startSeq uint32,
+	startCwnd uint32,
+	dp ccpFlow.DatapathInfo,
+) {
+	p, err := pattern.
+		NewPattern().
+		Cwnd(2 * pktsz).
+		AckIncrease(pktsz).
+		Wait(time.Hour).
+		Compile()
+	if err != nil {
+		return
+	}
+
+	send.SendPatternMsg(sockid, p)
+}
+
+// a fixed window which reports rarely, relying on the datapath's aggregates
+type aggregateFlow struct {
+	fixedFlow
+	reports []ccpFlow.Measurement
+}
+
+func (f *aggregateFlow) Name() string {
+	return "sim-aggregate"
+}
+
+func (f *aggregateFlow) Create(
+	sockid uint32,
+	send ipc.SendOnly,
+	pktsz uint32,
+	startSeq uint32,
+	startCwnd uint32,
+	dp ccpFlow.DatapathInfo,
+) {
+	if a, ok := send.(ipc.Aggregating); ok {
+		a.SendAggregateMsg(sockid, ipc.AggregateConfig{
+			Stats: ipc.AggMinRtt | ipc.AggMaxRtt | ipc.AggAcks | ipc.AggBytesAcked | ipc.AggLost,
+		})
+	}
+
+	p, err := pattern.
+		NewPattern().
+		Cwnd(fixedCwndPkts * pktsz).
+		WaitRtts(10.0).
+		Report().
+		Compile()
+	if err != nil {
+		return
+	}
+
+	send.SendPatternMsg(sockid, p)
+}
+
+func (f *aggregateFlow) GotMeasurement(m ccpFlow.Measurement) {
+	f.reports = append(f.reports, m)
+}
+
+// 12 Mbit/s, 20 ms rtt, 100 packet buffer
+var testLink = LinkConfig{
+	Bandwidth: 1.5e6,
+	Delay:     10 * time.Millisecond,
+	Buffer:    100 * 1460,
+}
+
+func runFlow(t *testing.T, cfg Config, alg string, d time.Duration) (FlowStats, LinkStats) {
+	n, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	sid, err := n.AddFlow(alg, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n.Run(d)
+	if n.Now() != d {
+		t.Errorf("virtual clock at %v, expected %v", n.Now(), d)
+	}
+
+	st, err := n.Flow(sid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return st, n.Link()
+}
+
+func TestFixedWindowThroughput(t *testing.T) {
+	d := 10 * time.Second
+	st, _ := runFlow(t, Config{Link: testLink}, "sim-fixed", d)
+
+	// 20 packets per ~20ms rtt is well under the bottleneck rate
+	expected := float64(fixedCwndPkts*1460) / (20 * time.Millisecond).Seconds() * d.Seconds()
+	if got := float64(st.AckedBytes); got < 0.9*expected || got > 1.05*expected {
+		t.Errorf("acked %v bytes, expected about %v", got, expected)
+	}
+
+	if st.LostPkts != 0 || st.Drops != 0 {
+		t.Errorf("expected no loss, got %v lost and %v drops", st.LostPkts, st.Drops)
+	}
+
+	if st.Reports == 0 || st.Patterns != 1 {
+		t.Errorf("expected reports and one pattern, got %v reports and %v patterns", st.Reports, st.Patterns)
+	}
+
+	if st.MinRtt < 20*time.Millisecond || st.MinRtt > 25*time.Millisecond {
+		t.Errorf("min rtt %v, expected about 20ms", st.MinRtt)
+	}
+}
+
+func TestAckIncrease(t *testing.T) {
+	st, _ := runFlow(t, Config{Link: testLink}, "sim-slowstart", 100*time.Millisecond)
+
+	// the window doubles every rtt without the CCP sending anything more
+	if st.Patterns != 1 || st.Cwnd < 16*1460 {
+		t.Errorf("expected the window to grow from one pattern, got cwnd %v after %v patterns", st.Cwnd, st.Patterns)
+	}
+}
+
+func TestExtendedMeasurement(t *testing.T) {
+	n, err := New(Config{Link: testLink})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	sid, err := n.AddFlow("sim-fixed", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n.Run(2 * time.Second)
+	st, err := n.Flow(sid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := n.flows[sid].alg.(*fixedFlow).last
+	if m.MinRtt < 20*time.Millisecond || m.MinRtt > m.Rtt {
+		t.Errorf("min rtt %v, expected between 20ms and the rtt %v", m.MinRtt, m.Rtt)
+	}
+
+	if m.Delivered == 0 || m.Delivered > st.AckedBytes || uint64(m.Ack) > m.Delivered {
+		t.Errorf("delivered %v, expected at least the ack %v and at most %v", m.Delivered, m.Ack, st.AckedBytes)
+	}
+
+	if m.Inflight == 0 || m.Inflight > fixedCwndPkts*1460 {
+		t.Errorf("inflight %v, expected within the fixed window", m.Inflight)
+	}
+
+	if m.Timestamp <= 0 || m.Timestamp > n.Now() {
+		t.Errorf("timestamp %v, expected within the run", m.Timestamp)
+	}
+}
+
+func TestAggregates(t *testing.T) {
+	n, err := New(Config{Link: testLink})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	sid, err := n.AddFlow("sim-aggregate", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n.Run(2 * time.Second)
+	st, err := n.Flow(sid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reports := n.flows[sid].alg.(*aggregateFlow).reports
+	if len(reports) < 2 {
+		t.Fatalf("expected a few reports, got %d", len(reports))
+	}
+
+	var acked uint64
+	for _, m := range reports {
+		g := m.Agg
+		if g.Stats&ipc.AggAcks == 0 || g.Acks == 0 {
+			t.Errorf("report without acks: %v", g)
+			continue
+		}
+
+		if g.MinRtt < 20*time.Millisecond || g.MaxRtt < g.MinRtt {
+			t.Errorf("rtt range %v to %v, expected at least the 20ms base rtt", g.MinRtt, g.MaxRtt)
+		}
+
+		if g.EwmaRtt != 0 || g.Ecn != 0 {
+			t.Errorf("got statistics the flow did not ask for: %v", g)
+		}
+
+		acked += g.BytesAcked
+	}
+
+	// every ack between reports is counted once, up to the last report
+	if acked != reports[len(reports)-1].Delivered || acked > st.AckedBytes {
+		t.Errorf("aggregated %v bytes acked, delivered %v", acked, reports[len(reports)-1].Delivered)
+	}
+}
+
+func TestCreateInfo(t *testing.T) {
+	n, err := New(Config{Link: testLink, Mss: 1200, InitCwnd: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	sid, err := n.AddFlow("sim-fixed", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := n.flows[sid].alg.(*fixedFlow)
+	if f.pktsz != 1200 || f.startCwnd != 4 {
+		t.Errorf("created with %d byte packets and %d packet window, expected the datapath's 1200 and 4", f.pktsz, f.startCwnd)
+	}
+
+	if f.dp.Events != pattern.AllEvents || f.dp.Fields&ipc.FieldDelivered == 0 || f.dp.Fields&ipc.FieldEcn != 0 {
+		t.Errorf("wrong datapath info %+v", f.dp)
+	}
+
+	// algorithms tell the time by the virtual clock
+	n.Run(time.Second)
+	if now := f.dp.Now(); !now.Equal(simEpoch.Add(time.Second)) {
+		t.Errorf("datapath clock at %v, expected %v", now, simEpoch.Add(time.Second))
+	}
+}
+
+func TestDeterministic(t *testing.T) {
+	cfg := Config{
+		Link: LinkConfig{
+			Bandwidth:  1.5e6,
+			Delay:      10 * time.Millisecond,
+			Buffer:     30 * 1460,
+			LossRate:   0.01,
+			BurstEnter: 0.001,
+			BurstExit:  0.2,
+			BurstLoss:  0.5,
+		},
+		Seed: 42,
+	}
+
+	// reno and cubic time their reactions to drops
+	for _, alg := range []string{"vegas", "reno", "cubic"} {
+		first, firstLink := runFlow(t, cfg, alg, 20*time.Second)
+		second, secondLink := runFlow(t, cfg, alg, 20*time.Second)
+		if first != second || firstLink != secondLink {
+			t.Errorf("%s: runs differ\nfirst (%+v, %+v)\nsecond (%+v, %+v)", alg, first, firstLink, second, secondLink)
+		}
+
+		if first.LostPkts == 0 || first.Retransmits == 0 || first.Drops == 0 {
+			t.Errorf("%s: expected losses to be detected and repaired: %+v", alg, first)
+		}
+	}
+}
+
+func TestBufferOverflow(t *testing.T) {
+	cfg := Config{
+		Link: LinkConfig{
+			Bandwidth: 1.5e6,
+			Delay:     10 * time.Millisecond,
+			Buffer:    10 * 1460,
+		},
+		InitCwnd: 100,
+	}
+
+	// a 100 packet window into a 10 packet buffer must overflow, and the
+	// sender must still get everything across
+	n, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	size := uint64(2e6)
+	sid, err := n.AddFlow("sim-fixed", size)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n.Run(30 * time.Second)
+	st, _ := n.Flow(sid)
+	if n.Link().QueueDrops == 0 {
+		t.Error("expected the queue to overflow")
+	}
+
+	if !st.Done || st.AckedBytes != size {
+		t.Errorf("expected %v bytes to be delivered: %+v", size, st)
+	}
+
+	if !n.flows[sid].alg.(*fixedFlow).closed {
+		t.Error("expected the flow algorithm to be closed")
+	}
+}
+
+func TestAlgorithms(t *testing.T) {
+	for _, alg := range []string{"reno", "cubic", "vegas", "compound", "bbr"} {
+		st, _ := runFlow(t, Config{Link: testLink}, alg, 30*time.Second)
+		if st.AckedBytes == 0 || st.Reports == 0 || st.Patterns == 0 {
+			t.Errorf("%s: flow made no progress: %+v", alg, st)
+		}
+	}
+}
+
+func TestUnknownAlgorithm(t *testing.T) {
+	n, err := New(Config{Link: testLink})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	if _, err := n.AddFlow("no-such-alg", 0); err == nil {
+		t.Error("expected error adding flow with unknown algorithm")
+	}
+}
+
+func TestBadLink(t *testing.T) {
+	if _, err := New(Config{}); err == nil {
+		t.Error("expected error for zero bandwidth link")
+	}
+
+	if _, err := New(Config{Link: LinkConfig{Bandwidth: 1, LossRate: 2}}); err == nil {
+		t.Error("expected error for loss rate above 1")
+	}
+}
@@ -0,0 +1,742 @@
+package tcpipc
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"ccp/ipcBackend"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/* A stream backend, so that a CCP can control datapaths on other hosts
+ * or in other containers. Each message is framed by its length, as a
+ * little-endian uint32.
+ *
+ * The CCP listens, and every datapath connection has its own socket id
+ * namespace: the CCP sees each (connection, socket id) pair as a socket
+ * id of its own, and the per-flow sending backends translate back.
+ * The backend does not parse messages, so it is told where their socket
+ * id is.
+ *
+ * A datapath's backend reconnects when its connection drops. It starts
+ * every connection with a frame holding its connection id, random but the
+ * same across reconnects, so the CCP gives its flows the socket ids they
+ * had, and carries on with them. A datapath which stays away for
+ * forgetAfter is forgotten, along with its socket ids.
+ */
+
+// SocketIdOffset returns where a message keeps its socket id
+type SocketIdOffset func(msg []byte) (int, error)
+
+// frames above this are taken to be a broken stream
+const maxFrameLen = 1 << 20
+
+// the reconnect backoff of a datapath's backend
+const (
+	minBackoff = 100 * time.Millisecond
+	maxBackoff = 5 * time.Second
+)
+
+// how long the CCP keeps a disconnected datapath's socket ids
+const forgetAfter = time.Minute
+
+// the frame starting each connection: the datapath's connection id
+const helloLen = 8
+
+func writeFrame(w io.Writer, msg []byte) error {
+	frame := make([]byte, 4+len(msg))
+	binary.LittleEndian.PutUint32(frame, uint32(len(msg)))
+	copy(frame[4:], msg)
+	_, err := w.Write(frame)
+	return err
+}
+
+func readFrame(r *bufio.Reader) ([]byte, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+
+	l := binary.LittleEndian.Uint32(hdr[:])
+	if l > maxFrameLen {
+		return nil, &ipcbackend.Error{
+			Kind:  ipcbackend.ErrOverrun,
+			Where: "tcpipc.readFrame",
+			Err:   fmt.Errorf("frame of %d bytes exceeds limit of %d", l, maxFrameLen),
+		}
+	}
+
+	msg := make([]byte, l)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+// CCP side
+
+// a datapath, over however many connections it makes
+type dpConn struct {
+	id uint64
+	// frames must not interleave. also guards conn,
+	// which is nil while the datapath is away
+	wmux sync.Mutex
+	conn net.Conn
+	// the CCP's socket id for each of the datapath's
+	ids map[uint32]uint32
+}
+
+type route struct {
+	c     *dpConn
+	local uint32
+}
+
+type server struct {
+	ln    net.Listener
+	sidAt SocketIdOffset
+	// messages from every connection, with the CCP's socket ids
+	msgs   chan []byte
+	closed chan interface{}
+	// the listening backend's
+	health *ipcbackend.Health
+
+	mux    sync.Mutex
+	nextId uint32
+	routes map[uint32]route
+	// by connection id
+	conns       map[uint64]*dpConn
+	forgetAfter time.Duration
+}
+
+// the listening servers, by the address they were asked to listen on,
+// which is how the per-flow sending backends find them
+var servers = struct {
+	sync.Mutex
+	byAddr map[string]*server
+}{byAddr: make(map[string]*server)}
+
+func (s *server) accept() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			select {
+			case <-s.closed:
+			default:
+				log.WithFields(log.Fields{
+					"where": "tcpipc.accept",
+				}).Warn(err)
+				// no more datapaths can connect
+				s.health.Report(&ipcbackend.Error{
+					Kind:  ipcbackend.ErrClosed,
+					Where: "tcpipc.accept",
+					Err:   err,
+				})
+			}
+
+			return
+		}
+
+		go s.read(conn)
+	}
+}
+
+// the datapath with connection id id, now connected over conn
+func (s *server) attach(id uint64, conn net.Conn) *dpConn {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	c, ok := s.conns[id]
+	if !ok {
+		c = &dpConn{id: id, ids: make(map[uint32]uint32)}
+		s.conns[id] = c
+	}
+
+	c.wmux.Lock()
+	defer c.wmux.Unlock()
+	if c.conn != nil {
+		// the datapath gave up on its old connection before we noticed
+		c.conn.Close()
+	}
+
+	c.conn = conn
+	log.WithFields(log.Fields{
+		"remote":    conn.RemoteAddr(),
+		"reconnect": ok,
+	}).Info("datapath connected")
+	return c
+}
+
+func (s *server) read(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	hello, err := readFrame(r)
+	if err == nil && len(hello) != helloLen {
+		err = fmt.Errorf("connection id of %d bytes", len(hello))
+	}
+
+	if err != nil {
+		conn.Close()
+		select {
+		case <-s.closed:
+		default:
+			log.WithFields(log.Fields{
+				"remote": conn.RemoteAddr(),
+				"err":    err,
+			}).Warn("datapath did not say who it is")
+			s.health.Report(&ipcbackend.Error{
+				Kind:  ipcbackend.ErrParse,
+				Where: fmt.Sprintf("tcpipc.read %v", conn.RemoteAddr()),
+				Err:   err,
+			})
+		}
+
+		return
+	}
+
+	c := s.attach(binary.LittleEndian.Uint64(hello), conn)
+	defer s.drop(c, conn)
+
+	for {
+		msg, err := readFrame(r)
+		if err != nil {
+			select {
+			case <-s.closed:
+			default:
+				log.WithFields(log.Fields{
+					"remote": conn.RemoteAddr(),
+					"err":    err,
+				}).Info("datapath disconnected")
+				s.reportConnError(conn, err)
+			}
+
+			return
+		}
+
+		off, err := s.sidAt(msg)
+		if err == nil && off+4 > len(msg) {
+			err = fmt.Errorf("message of %d bytes too short", len(msg))
+		}
+
+		if err != nil {
+			log.WithFields(log.Fields{
+				"remote": conn.RemoteAddr(),
+				"err":    err,
+			}).Warn("no socket id in message")
+			s.health.Report(&ipcbackend.Error{
+				Kind:  ipcbackend.ErrParse,
+				Where: fmt.Sprintf("tcpipc.read %v", conn.RemoteAddr()),
+				Err:   err,
+			})
+			continue
+		}
+
+		local := binary.LittleEndian.Uint32(msg[off:])
+		binary.LittleEndian.PutUint32(msg[off:], s.globalId(c, local))
+
+		select {
+		case s.msgs <- msg:
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+// a datapath leaving is no error, but losing its connection otherwise
+// is, though not one which stops the others
+func (s *server) reportConnError(conn net.Conn, err error) {
+	if errors.Is(err, io.EOF) {
+		return
+	}
+
+	e := ipcbackend.NewError(fmt.Sprintf("tcpipc.read %v", conn.RemoteAddr()), err)
+	if e.Kind != ipcbackend.ErrOverrun {
+		e.Kind = ipcbackend.ErrIO
+	}
+
+	s.health.Report(e)
+}
+
+// the CCP's socket id for a datapath's
+func (s *server) globalId(c *dpConn, local uint32) uint32 {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if id, ok := c.ids[local]; ok {
+		return id
+	}
+
+	// 0 is never a flow
+	s.nextId++
+	if s.nextId == 0 {
+		s.nextId++
+	}
+
+	id := s.nextId
+	c.ids[local] = id
+	s.routes[id] = route{c: c, local: local}
+	return id
+}
+
+// conn, one of c's connections, closed. c keeps its socket ids
+// for forgetAfter, in case it comes back.
+func (s *server) drop(c *dpConn, conn net.Conn) {
+	conn.Close()
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	c.wmux.Lock()
+	defer c.wmux.Unlock()
+	if c.conn != conn {
+		// already reconnected
+		return
+	}
+
+	c.conn = nil
+	time.AfterFunc(s.forgetAfter, func() { s.forget(c) })
+}
+
+// forget c, unless it came back
+func (s *server) forget(c *dpConn) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	c.wmux.Lock()
+	away := c.conn == nil
+	c.wmux.Unlock()
+	if !away || s.conns[c.id] != c {
+		return
+	}
+
+	delete(s.conns, c.id)
+	for _, id := range c.ids {
+		delete(s.routes, id)
+	}
+}
+
+func (s *server) send(id uint32, msg []byte) error {
+	s.mux.Lock()
+	r, ok := s.routes[id]
+	s.mux.Unlock()
+	if !ok {
+		return fmt.Errorf("no datapath connection for socket %d", id)
+	}
+
+	off, err := s.sidAt(msg)
+	if err != nil {
+		return err
+	}
+
+	if off+4 > len(msg) {
+		return fmt.Errorf("no socket id in message")
+	}
+
+	binary.LittleEndian.PutUint32(msg[off:], r.local)
+
+	r.c.wmux.Lock()
+	defer r.c.wmux.Unlock()
+	if r.c.conn == nil {
+		return fmt.Errorf("datapath of socket %d is reconnecting", id)
+	}
+
+	return writeFrame(r.c.conn, msg)
+}
+
+func (s *server) close() {
+	close(s.closed)
+	s.ln.Close()
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	for _, c := range s.conns {
+		c.wmux.Lock()
+		if c.conn != nil {
+			c.conn.Close()
+		}
+		c.wmux.Unlock()
+	}
+}
+
+// TcpIpc is the CCP's end: listening for datapaths, or sending to one flow
+type TcpIpc struct {
+	sidAt SocketIdOffset
+
+	// listening
+	addr string
+	srv  *server
+	// sending to the socket id sid of the server at addr
+	route *server
+	sid   uint32
+
+	err    error
+	killed chan interface{}
+	ipcbackend.Health
+}
+
+func New(sidAt SocketIdOffset) ipcbackend.Backend {
+	return &TcpIpc{
+		sidAt:  sidAt,
+		killed: make(chan interface{}),
+	}
+}
+
+// SetupListen listens on the TCP address l
+func (t *TcpIpc) SetupListen(l string, id uint32) ipcbackend.Backend {
+	if t.err != nil {
+		return t
+	}
+
+	servers.Lock()
+	defer servers.Unlock()
+	if _, ok := servers.byAddr[l]; ok {
+		t.err = fmt.Errorf("already listening on %s", l)
+		return t
+	}
+
+	ln, err := net.Listen("tcp", l)
+	if err != nil {
+		t.err = err
+		return t
+	}
+
+	t.addr = l
+	t.srv = &server{
+		ln:          ln,
+		sidAt:       t.sidAt,
+		msgs:        make(chan []byte),
+		closed:      make(chan interface{}),
+		health:      &t.Health,
+		routes:      make(map[uint32]route),
+		conns:       make(map[uint64]*dpConn),
+		forgetAfter: forgetAfter,
+	}
+
+	servers.byAddr[l] = t.srv
+	go t.srv.accept()
+	return t
+}
+
+// SetupSend sends to socket id on the connection it came from,
+// through the backend listening on l
+func (t *TcpIpc) SetupSend(l string, id uint32) ipcbackend.Backend {
+	if t.err != nil {
+		return t
+	}
+
+	servers.Lock()
+	defer servers.Unlock()
+	srv, ok := servers.byAddr[l]
+	if !ok {
+		t.err = fmt.Errorf("not listening on %s", l)
+		return t
+	}
+
+	t.route = srv
+	t.sid = id
+	return t
+}
+
+func (t *TcpIpc) SetupFinish() (ipcbackend.Backend, error) {
+	if t.err != nil {
+		log.WithFields(log.Fields{
+			"err": t.err,
+		}).Error("error setting up IPC")
+	}
+
+	return t, t.err
+}
+
+// Addr is the address the backend listens on, once it does
+func (t *TcpIpc) Addr() net.Addr {
+	if t.srv == nil {
+		return nil
+	}
+
+	return t.srv.ln.Addr()
+}
+
+func (t *TcpIpc) SendMsg(msg ipcbackend.Msg) error {
+	if t.route == nil {
+		return fmt.Errorf("backend not set up to send")
+	}
+
+	buf, err := msg.Serialize()
+	if err != nil {
+		return err
+	}
+
+	return t.route.send(t.sid, buf)
+}
+
+func (t *TcpIpc) Listen() chan []byte {
+	msgCh := make(chan []byte)
+	if t.srv == nil {
+		close(msgCh)
+		return msgCh
+	}
+
+	go func() {
+		for {
+			select {
+			case <-t.killed:
+				close(msgCh)
+				return
+			case buf := <-t.srv.msgs:
+				// nobody may be reading any more
+				select {
+				case msgCh <- buf:
+				case <-t.killed:
+					close(msgCh)
+					return
+				}
+			}
+		}
+	}()
+
+	return msgCh
+}
+
+// Close stops listening, and drops every datapath's connection.
+// Sending backends leave the connection to the listening one.
+func (t *TcpIpc) Close() error {
+	close(t.killed)
+	if t.srv != nil {
+		servers.Lock()
+		delete(servers.byAddr, t.addr)
+		servers.Unlock()
+		t.srv.close()
+	}
+
+	t.CloseErrors()
+	return nil
+}
+
+// datapath side
+
+// Client is a datapath's end, connected to the CCP
+type Client struct {
+	addr string
+	// which datapath this is, to the CCP
+	id uint64
+
+	mux  sync.Mutex
+	conn net.Conn
+
+	msgs   chan []byte
+	err    error
+	killed chan interface{}
+	ipcbackend.Health
+}
+
+func NewClient() ipcbackend.Backend {
+	return &Client{
+		id:     connId(),
+		msgs:   make(chan []byte),
+		killed: make(chan interface{}),
+	}
+}
+
+// a connection id no other datapath is likely to pick
+func connId() uint64 {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return uint64(time.Now().UnixNano())
+	}
+
+	return binary.LittleEndian.Uint64(b[:])
+}
+
+// connect to the CCP at l, saying who we are
+func (c *Client) connect(l string) (net.Conn, error) {
+	conn, err := net.Dial("tcp", l)
+	if err != nil {
+		return nil, err
+	}
+
+	var hello [helloLen]byte
+	binary.LittleEndian.PutUint64(hello[:], c.id)
+	if err = writeFrame(conn, hello[:]); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+func (c *Client) dial(l string) {
+	if c.err != nil || c.conn != nil {
+		return
+	}
+
+	conn, err := c.connect(l)
+	if err != nil {
+		c.err = err
+		return
+	}
+
+	c.addr = l
+	c.conn = conn
+	go c.read(conn)
+}
+
+// SetupListen connects to the CCP at l, if SetupSend did not already
+func (c *Client) SetupListen(l string, id uint32) ipcbackend.Backend {
+	c.dial(l)
+	return c
+}
+
+// SetupSend connects to the CCP at l, if SetupListen did not already
+func (c *Client) SetupSend(l string, id uint32) ipcbackend.Backend {
+	c.dial(l)
+	return c
+}
+
+func (c *Client) SetupFinish() (ipcbackend.Backend, error) {
+	if c.err != nil {
+		log.WithFields(log.Fields{
+			"err": c.err,
+		}).Error("error setting up IPC")
+	}
+
+	return c, c.err
+}
+
+func (c *Client) SendMsg(msg ipcbackend.Msg) error {
+	buf, err := msg.Serialize()
+	if err != nil {
+		return err
+	}
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.conn == nil {
+		return fmt.Errorf("reconnecting to %s", c.addr)
+	}
+
+	return writeFrame(c.conn, buf)
+}
+
+func (c *Client) read(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	for {
+		msg, err := readFrame(r)
+		if err != nil {
+			select {
+			case <-c.killed:
+				return
+			default:
+			}
+
+			log.WithFields(log.Fields{
+				"addr": c.addr,
+				"err":  err,
+			}).Warn("lost connection to ccp, reconnecting")
+			e := ipcbackend.NewError("tcpipc.Client.read", err)
+			if e.Kind != ipcbackend.ErrOverrun {
+				// not for good: we reconnect
+				e.Kind = ipcbackend.ErrIO
+			}
+
+			c.Report(e)
+			conn, r = c.reconnect(conn)
+			if conn == nil {
+				return
+			}
+
+			continue
+		}
+
+		select {
+		case c.msgs <- msg:
+		case <-c.killed:
+			return
+		}
+	}
+}
+
+// redial until connected, or closed
+func (c *Client) reconnect(old net.Conn) (net.Conn, *bufio.Reader) {
+	c.mux.Lock()
+	c.conn = nil
+	c.mux.Unlock()
+	old.Close()
+
+	backoff := minBackoff
+	for {
+		select {
+		case <-c.killed:
+			return nil, nil
+		case <-time.After(backoff):
+		}
+
+		conn, err := c.connect(c.addr)
+		if err != nil {
+			if backoff *= 2; backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+
+			continue
+		}
+
+		c.mux.Lock()
+		select {
+		case <-c.killed:
+			c.mux.Unlock()
+			conn.Close()
+			return nil, nil
+		default:
+		}
+
+		c.conn = conn
+		c.mux.Unlock()
+
+		log.WithFields(log.Fields{
+			"addr": c.addr,
+		}).Info("reconnected to ccp")
+		return conn, bufio.NewReader(conn)
+	}
+}
+
+func (c *Client) Listen() chan []byte {
+	msgCh := make(chan []byte)
+
+	go func() {
+		for {
+			select {
+			case <-c.killed:
+				close(msgCh)
+				return
+			case buf := <-c.msgs:
+				// nobody may be reading any more
+				select {
+				case msgCh <- buf:
+				case <-c.killed:
+					close(msgCh)
+					return
+				}
+			}
+		}
+	}()
+
+	return msgCh
+}
+
+func (c *Client) Close() error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	close(c.killed)
+	if c.conn != nil {
+		c.conn.Close()
+	}
+
+	c.CloseErrors()
+	return nil
+}
@@ -0,0 +1,226 @@
+package tcpipc
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+// mock message implementing ipcbackend.Msg: a socket id, then a payload
+type MockMsg struct {
+	sid uint32
+	b   string
+}
+
+func (m MockMsg) Serialize() ([]byte, error) {
+	buf := make([]byte, 4+len(m.b))
+	binary.LittleEndian.PutUint32(buf, m.sid)
+	copy(buf[4:], m.b)
+	return buf, nil
+}
+
+func sidAtStart(msg []byte) (int, error) {
+	return 0, nil
+}
+
+func recv(t *testing.T, ch chan []byte) (uint32, string) {
+	select {
+	case buf := <-ch:
+		return binary.LittleEndian.Uint32(buf), string(buf[4:])
+	case <-time.After(time.Second):
+		t.Fatal("timed out")
+		return 0, ""
+	}
+}
+
+func listen(t *testing.T) (*TcpIpc, string) {
+	back, err := New(sidAtStart).SetupListen("127.0.0.1:0", 0).SetupFinish()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return back.(*TcpIpc), back.(*TcpIpc).Addr().String()
+}
+
+func dial(t *testing.T, addr string) *Client {
+	back, err := NewClient().SetupSend(addr, 0).SetupListen(addr, 0).SetupFinish()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return back.(*Client)
+}
+
+func TestNamespaces(t *testing.T) {
+	ccp, addr := listen(t)
+	defer ccp.Close()
+	in := ccp.Listen()
+
+	a := dial(t, addr)
+	defer a.Close()
+	b := dial(t, addr)
+	defer b.Close()
+
+	// both datapaths use socket id 1
+	if err := a.SendMsg(MockMsg{sid: 1, b: "a"}); err != nil {
+		t.Fatal(err)
+	}
+
+	idA, got := recv(t, in)
+	if got != "a" {
+		t.Fatalf("got %q, expected a", got)
+	}
+
+	if err := b.SendMsg(MockMsg{sid: 1, b: "b"}); err != nil {
+		t.Fatal(err)
+	}
+
+	idB, got := recv(t, in)
+	if got != "b" {
+		t.Fatalf("got %q, expected b", got)
+	}
+
+	if idA == idB || idA == 0 || idB == 0 {
+		t.Fatalf("expected distinct socket ids, got %d and %d", idA, idB)
+	}
+
+	// replies go back to the right datapath, with its own socket id
+	for _, c := range []struct {
+		id  uint32
+		cli *Client
+		b   string
+	}{
+		{id: idA, cli: a, b: "to a"},
+		{id: idB, cli: b, b: "to b"},
+	} {
+		out, err := New(sidAtStart).SetupSend("127.0.0.1:0", c.id).SetupFinish()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err = out.SendMsg(MockMsg{sid: c.id, b: c.b}); err != nil {
+			t.Fatal(err)
+		}
+
+		sid, got := recv(t, c.cli.Listen())
+		if sid != 1 || got != c.b {
+			t.Errorf("got (%d, %q), expected (1, %q)", sid, got, c.b)
+		}
+
+		out.Close()
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	ccp, addr := listen(t)
+	defer ccp.Close()
+	in := ccp.Listen()
+
+	cli := dial(t, addr)
+	defer cli.Close()
+
+	if err := cli.SendMsg(MockMsg{sid: 1, b: "before"}); err != nil {
+		t.Fatal(err)
+	}
+
+	before, _ := recv(t, in)
+
+	out, err := New(sidAtStart).SetupSend("127.0.0.1:0", before).SetupFinish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+
+	cli.mux.Lock()
+	old := cli.conn
+	cli.mux.Unlock()
+
+	// drop the datapath from the CCP's end
+	ccp.srv.mux.Lock()
+	for _, c := range ccp.srv.conns {
+		c.wmux.Lock()
+		c.conn.Close()
+		c.wmux.Unlock()
+	}
+	ccp.srv.mux.Unlock()
+
+	// the datapath reconnects, keeping its socket ids
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		cli.mux.Lock()
+		reconnected := cli.conn != nil && cli.conn != old
+		cli.mux.Unlock()
+		if reconnected {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("never reconnected")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err = cli.SendMsg(MockMsg{sid: 1, b: "after"}); err != nil {
+		t.Fatal(err)
+	}
+
+	after, got := recv(t, in)
+	if got != "after" || after != before {
+		t.Errorf("got (%d, %q), expected (%d, after)", after, got, before)
+	}
+
+	// and the flow's sending backend reaches it again
+	if err = out.SendMsg(MockMsg{sid: before, b: "back"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if sid, got := recv(t, cli.Listen()); sid != 1 || got != "back" {
+		t.Errorf("got (%d, %q), expected (1, back)", sid, got)
+	}
+}
+
+func TestForget(t *testing.T) {
+	ccp, addr := listen(t)
+	defer ccp.Close()
+	in := ccp.Listen()
+
+	ccp.srv.mux.Lock()
+	ccp.srv.forgetAfter = 10 * time.Millisecond
+	ccp.srv.mux.Unlock()
+
+	cli := dial(t, addr)
+	if err := cli.SendMsg(MockMsg{sid: 1, b: "hi"}); err != nil {
+		t.Fatal(err)
+	}
+
+	id, _ := recv(t, in)
+	cli.Close()
+
+	// a datapath which stays away loses its socket ids
+	deadline := time.Now().Add(time.Second)
+	for {
+		ccp.srv.mux.Lock()
+		_, ok := ccp.srv.routes[id]
+		ccp.srv.mux.Unlock()
+		if !ok {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("datapath never forgotten")
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	out, err := New(sidAtStart).SetupSend("127.0.0.1:0", id).SetupFinish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+
+	if err = out.SendMsg(MockMsg{sid: id, b: "gone"}); err == nil {
+		t.Error("expected sending to a forgotten datapath to fail")
+	}
+}
@@ -129,11 +129,11 @@ func renoCcp(killed chan interface{}, ready chan interface{}) {
 			return
 		case cr := <-createCh:
 			log.Info("got create")
-			ipCh, err := ipc.SetupCcpSend(ipc.UNIX, cr.SocketId())
+			ipCh, err := ipc.SetupCcpSend(com, ipc.UNIX, cr.SocketId())
 			if err != nil {
 				log.WithFields(log.Fields{"flowid": cr.SocketId()}).Error("Error creating ccp->socket ipc channel for flow")
 			}
-			r.Create(40000, ipCh, 1462, 0, 10)
+			r.Create(40000, ipCh, 1462, 0, 10, ccpFlow.DatapathInfo{})
 		case ack := <-ackCh:
 			log.Info("got ack")
 			r.GotMeasurement(ccpFlow.Measurement{
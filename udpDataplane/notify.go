@@ -6,10 +6,14 @@ import (
 	"ccp/ccpFlow"
 	"ccp/ccpFlow/pattern"
 	"ccp/ipc"
+	"ccp/patternExec"
 
 	log "github.com/sirupsen/logrus"
 )
 
+// measurement timestamps count from here, on the monotonic clock
+var clockStart = time.Now()
+
 type notifyAck struct {
 	ack uint32
 	rtt time.Duration
@@ -20,24 +24,26 @@ type notifyDrop struct {
 	ev      string
 }
 
-func (sock *Sock) ipcListen(patternCh chan ipc.PatternMsg, measureMsgs chan notifyAck) {
+func (sock *Sock) ipcListen(
+	patternCh chan ipc.PatternMsg,
+	aggregateCh chan ipc.AggregateMsg,
+	measureMsgs chan notifyAck,
+) {
 	patternChanged := make(chan *pattern.Pattern)
-	go func() {
-		stopPattern := make(chan interface{})
-		for newPattern := range patternChanged {
-			select {
-			case stopPattern <- struct{}{}:
-			default:
-			}
-
-			go sock.doPattern(newPattern, measureMsgs, stopPattern)
-		}
-	}()
+	go sock.runPatterns(patternChanged, measureMsgs)
 
 	for {
 		select {
 		case pmsg := <-patternCh:
 			patternChanged <- pmsg.Pattern()
+		case amsg := <-aggregateCh:
+			log.WithFields(log.Fields{
+				"name":  sock.name,
+				"stats": amsg.Config().Stats,
+			}).Info("aggregating")
+			sock.mux.Lock()
+			sock.agg.Configure(amsg.Config())
+			sock.mux.Unlock()
 		case <-sock.closed:
 			close(patternChanged)
 			return
@@ -59,11 +65,21 @@ func (sock *Sock) setupIpc() error {
 		return err
 	}
 
+	aggregateSet, err := sock.ipc.ListenAggregateMsg()
+	if err != nil {
+		return err
+	}
+
 	measureMsgWaiter := make(chan notifyAck)
 	go sock.doNotify(measureMsgWaiter)
-	go sock.ipcListen(patternSet, measureMsgWaiter)
+	go sock.ipcListen(patternSet, aggregateSet, measureMsgWaiter)
 
-	sock.ipc.SendCreateMsg(sock.port, 0, "reno")
+	sock.ipc.SendCreateMsgInfo(sock.port, 0, "reno", ipc.CreateInfo{
+		Mss:      PACKET_SIZE,
+		InitCwnd: sock.cwnd / PACKET_SIZE,
+		Events:   pattern.AllEvents,
+		Fields:   measureFields,
+	})
 	return nil
 }
 
@@ -118,80 +134,171 @@ func (sock *Sock) doNotify(measureMsg chan notifyAck) {
 	}
 }
 
-func (sock *Sock) doNonWaitPatternEvent(ev pattern.PatternEvent, currRtt time.Duration) {
-	var cwnd uint32
-	switch ev.Type {
-	case pattern.REPORT:
-		fallthrough
-	case pattern.WAITREL:
-		fallthrough
-	case pattern.WAITABS:
-		return
-
-	case pattern.SETRATEABS:
-		// set cwnd = rate * rtt
-		cwnd = uint32(float64(ev.Rate) * currRtt.Seconds())
+// the socket, as the pattern executor sees it
+type sockDatapath struct {
+	sock *Sock
+}
 
-	case pattern.SETCWNDABS:
-		cwnd = ev.Cwnd
+func (d sockDatapath) Cwnd() uint32 {
+	d.sock.mux.Lock()
+	defer d.sock.mux.Unlock()
+	return d.sock.cwnd
+}
 
-	case pattern.SETRATEREL:
-		cwnd = uint32(float64(sock.cwnd) * float64(ev.Factor))
-	}
+func (d sockDatapath) SetCwnd(cwnd uint32) {
+	d.sock.mux.Lock()
+	d.sock.cwnd = cwnd
+	d.sock.mux.Unlock()
 
 	log.WithFields(log.Fields{
 		"cwnd": cwnd,
 	}).Info("set cwnd")
-	sock.mux.Lock()
-	sock.cwnd = cwnd
-	sock.mux.Unlock()
+	d.sock.paceKick()
 }
 
-func (sock *Sock) doPattern(p *pattern.Pattern, measureMsgs chan notifyAck, stopPattern chan interface{}) {
-	// infinitely loop through events in the sequence
-	var currRtt time.Duration
-	for {
-		for _, ev := range p.Sequence {
-			wait := time.Duration(0)
-			switch ev.Type {
-			case pattern.WAITABS:
-				wait = ev.Duration
-			case pattern.WAITREL:
-				wait = time.Duration(currRtt.Seconds()*float64(ev.Factor)*1e6) * time.Microsecond
-
-			case pattern.REPORT:
-				select {
-				case meas := <-measureMsgs:
-					currRtt = meas.rtt
-					writeMeasureMsg(sock.name, sock.port, sock.ipc, meas.ack, meas.rtt)
-					continue
-				case <-stopPattern:
-					return
-				}
+func (d sockDatapath) SetRate(rate float32) {
+	d.sock.mux.Lock()
+	d.sock.pacer.setRate(float64(rate), time.Now())
+	d.sock.mux.Unlock()
 
-			default:
-				sock.doNonWaitPatternEvent(ev, currRtt)
-				continue
-			}
+	log.WithFields(log.Fields{
+		"pacingRate": rate,
+	}).Info("set pacing rate")
+	d.sock.paceKick()
+}
 
-			select {
-			case <-time.After(wait):
-				continue
-			case <-stopPattern:
+// handleAck applies the increase
+func (d sockDatapath) SetAckIncrease(inc uint32) {
+	d.sock.mux.Lock()
+	d.sock.ackIncr = inc
+	d.sock.mux.Unlock()
+}
+
+func (d sockDatapath) Sample() patternExec.Sample {
+	d.sock.mux.Lock()
+	defer d.sock.mux.Unlock()
+	return patternExec.Sample{
+		Lost: d.sock.lostSinceReport,
+		Rtt:  d.sock.lastRtt,
+	}
+}
+
+func (d sockDatapath) Now() time.Duration {
+	return time.Since(clockStart)
+}
+
+// runPatterns reports once the next ack arrives
+func (d sockDatapath) WaitForReport() (time.Duration, bool) {
+	return 0, false
+}
+
+// execute the latest pattern from the CCP until the socket closes
+func (sock *Sock) runPatterns(patterns chan *pattern.Pattern, measureMsgs chan notifyAck) {
+	dp := sockDatapath{sock: sock}
+	exec := patternExec.New(dp, 0)
+	st, until := exec.State()
+	for {
+		var wake <-chan time.Time
+		var reports chan notifyAck
+		switch st {
+		case patternExec.Waiting:
+			wake = time.After(until - dp.Now())
+		case patternExec.Reporting:
+			reports = measureMsgs
+		}
+
+		select {
+		case p, ok := <-patterns:
+			if !ok {
 				return
 			}
+
+			log.WithFields(log.Fields{
+				"name":    sock.name,
+				"pattern": p,
+			}).Info("new pattern")
+			st, until = exec.Install(p)
+		case <-wake:
+			st, until = exec.Wake()
+		case meas := <-reports:
+			rin, rout, lost, ext := sock.measure()
+			writeMeasureMsg(sock.name, sock.port, sock.ipc, meas.ack, meas.rtt, lost, rin, rout, ext)
+			st, until = exec.Reported(meas.rtt)
 		}
 	}
 }
 
+// counters a report's rates are measured against
+type rateSample struct {
+	sent      uint64
+	delivered uint64
+	sendAt    time.Time
+	ackAt     time.Time
+}
+
+// bytes per second
+func rate(bytes uint64, dt time.Duration) uint64 {
+	if dt <= 0 {
+		return 0
+	}
+
+	return uint64(float64(bytes) / dt.Seconds())
+}
+
+// the optional measurement fields measure fills in
+const measureFields = ipc.FieldMinRtt | ipc.FieldDelivered | ipc.FieldInflight |
+	ipc.FieldSacked | ipc.FieldTimestamp | ipc.FieldAggregates
+
+/* The measurement as of now, starting a new report interval.
+ * The sending rate covers the bytes sent between the last transmissions
+ * before the previous report and before this one, and the delivery rate
+ * the bytes acked between the corresponding ack arrivals, so neither
+ * depends on when the pattern happens to report.
+ * The udp datapath never sees ECN marks, so never aggregates any.
+ */
+func (sock *Sock) measure() (rin uint64, rout uint64, lost uint32, ext ipc.MeasureExt) {
+	sock.mux.Lock()
+	defer sock.mux.Unlock()
+
+	cur := rateSample{
+		sent:      sock.sentBytes,
+		delivered: sock.inFlight.deliveredBytes(),
+		sendAt:    sock.lastSendAt,
+		ackAt:     sock.lastAckAt,
+	}
+
+	prev := sock.lastReport
+	rin = rate(cur.sent-prev.sent, cur.sendAt.Sub(prev.sendAt))
+	rout = rate(cur.delivered-prev.delivered, cur.ackAt.Sub(prev.ackAt))
+
+	ext = ipc.MeasureExt{
+		MinRtt:    sock.reportMinRtt,
+		Delivered: cur.delivered,
+		Inflight:  uint64(sock.inFlight.size()),
+		Sacked:    sock.inFlight.sackedBytes(),
+		Timestamp: time.Since(clockStart),
+		Agg:       sock.agg.Report(),
+	}
+
+	sock.lastReport = cur
+	sock.reportMinRtt = 0
+	lost = sock.lostSinceReport
+	sock.lostSinceReport = 0
+	return
+}
+
 func writeMeasureMsg(
 	name string,
 	id uint32,
 	out *ipc.Ipc,
 	ack uint32,
 	rtt time.Duration,
+	lost uint32,
+	rin uint64,
+	rout uint64,
+	ext ipc.MeasureExt,
 ) {
-	err := out.SendMeasureMsg(id, ack, rtt, 0, 0, 0)
+	err := out.SendMeasureMsgExt(id, ack, rtt, lost, rin, rout, ext)
 	if err != nil {
 		log.WithFields(log.Fields{"ack": ack, "name": name, "id": id, "where": "notify.writeMeasureMsg"}).Warn(err)
 		return
@@ -0,0 +1,61 @@
+package udpDataplane
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMeasureRates(t *testing.T) {
+	start := time.Now()
+	sock := &Sock{
+		inFlight:   makeWindow(),
+		lastReport: rateSample{sendAt: start, ackAt: start},
+	}
+
+	// 10 packets sent over 100ms
+	for i := 0; i < 10; i++ {
+		sock.inFlight.addPkt(start.Add(time.Duration(i)*10*time.Millisecond), &Packet{
+			SeqNo:   uint32(i * 1460),
+			Flag:    ACK,
+			Length:  1460,
+			Payload: []byte{},
+		})
+	}
+
+	sock.sentBytes = 10 * 1460
+	sock.lostSinceReport = 2
+	sock.lastSendAt = start.Add(100 * time.Millisecond)
+
+	// the first 5 acked over 50ms
+	sock.lastAckAt = start.Add(50 * time.Millisecond)
+	_, _, err := sock.inFlight.rcvdPkt(sock.lastAckAt, &Packet{
+		AckNo: 5 * 1460,
+		Flag:  ACK,
+		Sack:  make([]bool, 16),
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	rin, rout, lost, ext := sock.measure()
+	if rin != 146000 || rout != 146000 {
+		t.Errorf("expected rin = rout = 146000 B/s, got rin %d, rout %d", rin, rout)
+		return
+	}
+
+	if ext.Delivered != 5*1460 {
+		t.Errorf("expected %d bytes delivered, got %d", 5*1460, ext.Delivered)
+		return
+	}
+
+	if lost != 2 {
+		t.Errorf("expected 2 packets lost, got %d", lost)
+	}
+
+	// nothing happened since the last report
+	rin, rout, lost, _ = sock.measure()
+	if rin != 0 || rout != 0 || lost != 0 {
+		t.Errorf("expected no rates or losses over an empty interval, got rin %d, rout %d, lost %d", rin, rout, lost)
+	}
+}
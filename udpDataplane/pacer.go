@@ -0,0 +1,83 @@
+package udpDataplane
+
+import (
+	"time"
+)
+
+// how many packets the pacer lets out back to back after an idle period
+const pacingBurstPkts = 2
+
+/* Token bucket spacing out data packets at the pacing rate.
+ * Tokens are bytes, and accrue at rate up to a bucket of pacingBurstPkts
+ * packets. A rate of 0 means the sender is only limited by its cwnd.
+ */
+type pacer struct {
+	rate   float64 // bytes per second
+	tokens float64
+	last   time.Time
+}
+
+func (p *pacer) setRate(rate float64, now time.Time) {
+	p.refill(now)
+	if p.rate <= 0 && rate > 0 {
+		// start pacing with a full bucket, as after any idle period
+		p.tokens = p.burst()
+	}
+
+	p.rate = rate
+}
+
+func (p *pacer) burst() float64 {
+	return pacingBurstPkts * PACKET_SIZE
+}
+
+func (p *pacer) refill(now time.Time) {
+	if p.rate > 0 {
+		p.tokens += p.rate * now.Sub(p.last).Seconds()
+	}
+
+	if p.tokens > p.burst() {
+		p.tokens = p.burst()
+	}
+
+	p.last = now
+}
+
+// how long until a packet of size bytes may be sent
+func (p *pacer) wait(size uint32, now time.Time) time.Duration {
+	if p.rate <= 0 {
+		return 0
+	}
+
+	p.refill(now)
+	if p.tokens >= float64(size) {
+		return 0
+	}
+
+	return time.Duration((float64(size) - p.tokens) / p.rate * float64(time.Second))
+}
+
+// a packet of size bytes was sent
+func (p *pacer) sent(size uint32) {
+	if p.rate <= 0 {
+		return
+	}
+
+	p.tokens -= float64(size)
+}
+
+// how long the sender must wait before its next data packet
+func (sock *Sock) paceWait() time.Duration {
+	sock.mux.Lock()
+	defer sock.mux.Unlock()
+
+	return sock.pacer.wait(PACKET_SIZE, time.Now())
+}
+
+// try sending again once the pacer allows it
+func (sock *Sock) paceKick() {
+	select {
+	case sock.shouldTx <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,56 @@
+package udpDataplane
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPacerSpacing(t *testing.T) {
+	now := time.Now()
+	p := &pacer{}
+	if w := p.wait(PACKET_SIZE, now); w != 0 {
+		t.Errorf("expected an unpaced sender to never wait, got %v", w)
+		return
+	}
+
+	// one packet per millisecond
+	p.setRate(PACKET_SIZE*1000, now)
+
+	// the initial burst goes out back to back
+	for i := 0; i < pacingBurstPkts; i++ {
+		if w := p.wait(PACKET_SIZE, now); w != 0 {
+			t.Errorf("expected packet %d of the burst to go immediately, waited %v", i, w)
+			return
+		}
+
+		p.sent(PACKET_SIZE)
+	}
+
+	if w := p.wait(PACKET_SIZE, now); w != time.Millisecond {
+		t.Errorf("expected to wait 1ms after the burst, got %v", w)
+		return
+	}
+
+	now = now.Add(time.Millisecond)
+	if w := p.wait(PACKET_SIZE, now); w != 0 {
+		t.Errorf("expected to send after waiting, got %v", w)
+		return
+	}
+
+	p.sent(PACKET_SIZE)
+
+	// an idle period refills no more than the burst
+	now = now.Add(time.Second)
+	for i := 0; i < pacingBurstPkts; i++ {
+		if w := p.wait(PACKET_SIZE, now); w != 0 {
+			t.Errorf("expected packet %d after idle to go immediately, waited %v", i, w)
+			return
+		}
+
+		p.sent(PACKET_SIZE)
+	}
+
+	if w := p.wait(PACKET_SIZE, now); w == 0 {
+		t.Error("expected the bucket to be capped at the burst size")
+	}
+}
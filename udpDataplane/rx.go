@@ -87,7 +87,9 @@ func (sock *Sock) handleAck(rcvd *Packet) {
 		return
 	}
 
-	lastAcked, rtt, err := sock.inFlight.rcvdPkt(time.Now(), rcvd)
+	now := time.Now()
+	delivered := sock.inFlight.deliveredBytes()
+	lastAcked, rtt, err := sock.inFlight.rcvdPkt(now, rcvd)
 	if err != nil {
 		// there were no packets in flight
 		// so we got an ack to a packet we didn't send
@@ -99,6 +101,20 @@ func (sock *Sock) handleAck(rcvd *Packet) {
 		}).Panic("unknown packet")
 	}
 
+	sock.lastAckAt = now
+
+	// rcvdPkt reports a minute when this ack carried no rtt samples
+	sample := time.Duration(0)
+	if rtt < time.Minute {
+		sample = rtt
+		sock.lastRtt = rtt
+		if sock.reportMinRtt == 0 || rtt < sock.reportMinRtt {
+			sock.reportMinRtt = rtt
+		}
+	}
+
+	sock.agg.Ack(sample, sock.inFlight.deliveredBytes()-delivered)
+
 	if lastAcked == sock.lastAckedSeqNo && sock.nextSeqNo > lastAcked {
 		sock.dupAckCnt++
 		log.WithFields(log.Fields{
@@ -119,6 +135,8 @@ func (sock *Sock) handleAck(rcvd *Packet) {
 				"sock.lastAcked": lastAcked,
 			}).Debug("drop detected")
 			sock.inFlight.drop(lastAcked, rcvd)
+			sock.lostSinceReport++
+			sock.agg.Lost(1)
 			select {
 			case sock.notifyDrops <- notifyDrop{ev: "3xdupack", lastAck: lastAcked}:
 			default:
@@ -135,6 +153,10 @@ func (sock *Sock) handleAck(rcvd *Packet) {
 		sock.dupAckCnt = 0
 	}
 
+	if lastAcked > sock.lastAckedSeqNo {
+		sock.cwnd += sock.ackIncr
+	}
+
 	sock.lastAckedSeqNo = lastAcked
 	select {
 	case sock.shouldTx <- struct{}{}:
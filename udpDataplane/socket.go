@@ -28,7 +28,11 @@ type Sock struct {
 	readBuf     []byte // TODO make it a ring buffer
 
 	// sender
-	cwnd           uint32
+	cwnd uint32
+	// bytes the window grows by on every new ack
+	ackIncr        uint32
+	pacer          pacer
+	paceTimer      *time.Timer
 	lastAckedSeqNo uint32
 	dupAckCnt      uint8
 	nextSeqNo      uint32
@@ -41,6 +45,21 @@ type Sock struct {
 	// communication with CCP
 	ackNotifyThresh uint32
 	ipc             *ipc.Ipc
+	// smallest rtt sample since the last report
+	reportMinRtt time.Duration
+	// latest rtt sample
+	lastRtt time.Duration
+	// drops detected since the last report
+	lostSinceReport uint32
+	// statistics the algorithm asked for over each report interval
+	agg ipc.Aggregator
+	// bytes sent, including retransmissions, and when the latest one was
+	sentBytes  uint64
+	lastSendAt time.Time
+	// when the latest ack arrived
+	lastAckAt time.Time
+	// the counters as of the last report
+	lastReport rateSample
 
 	// synchronization
 	shouldTx    chan interface{}
@@ -214,6 +233,7 @@ func makeConnClient(ip string, port string) (conn *net.UDPConn, err error) {
 }
 
 func mkSocket(conn *net.UDPConn, name string) (*Sock, error) {
+	now := time.Now()
 	s := &Sock{
 		name: name,
 
@@ -235,6 +255,9 @@ func mkSocket(conn *net.UDPConn, name string) (*Sock, error) {
 		// ccp communication
 		ackNotifyThresh: PACKET_SIZE * 10, // ~ 10 pkts
 		// ipc initialized later
+		lastReport: rateSample{sendAt: now, ackAt: now},
+		lastSendAt: now,
+		lastAckAt:  now,
 
 		// synchronization
 		shouldTx:    make(chan interface{}, 1),
@@ -245,6 +268,9 @@ func mkSocket(conn *net.UDPConn, name string) (*Sock, error) {
 		closed:      make(chan interface{}),
 	}
 
+	s.paceTimer = time.AfterFunc(time.Hour, s.paceKick)
+	s.paceTimer.Stop()
+
 	addr := s.conn.LocalAddr().String()
 	spl := strings.Split(addr, ":")
 	lport, err := strconv.Atoi(spl[1])
@@ -367,6 +393,15 @@ func (sock *Sock) Close() error {
 		}).Warn(err)
 	}
 
+	// tell the CCP it can forget this flow
+	err = sock.ipc.SendCloseMsg(sock.port)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"name":  sock.name,
+			"where": "closing.sendClose",
+		}).Warn(err)
+	}
+
 	sock.ipc.Close()
 	return nil
 }
@@ -65,6 +65,19 @@ func dummyCcp(ccp *ipc.Ipc) {
 		}
 	}()
 
+	go func() {
+		ch, err := ccp.ListenCloseMsg()
+		if err != nil {
+			log.Error(err)
+			return
+		}
+		for m := range ch {
+			log.WithFields(log.Fields{
+				"msg": m,
+			}).Info("got msg")
+		}
+	}()
+
 	go func() {
 		ackCh, err := ccp.ListenMeasureMsg()
 		if err != nil {
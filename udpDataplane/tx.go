@@ -42,8 +42,12 @@ func (sock *Sock) nextPacket() (*Packet, error) {
 		Payload: payl,
 	}
 
+	now := time.Now()
+	sock.pacer.sent(uint32(pkt.Length))
+	sock.sentBytes += uint64(pkt.Length)
+	sock.lastSendAt = now
 	if seq == sock.nextSeqNo {
-		sock.inFlight.addPkt(time.Now(), pkt)
+		sock.inFlight.addPkt(now, pkt)
 		sock.nextSeqNo += uint32(pkt.Length)
 	}
 	return pkt, nil
@@ -97,6 +101,10 @@ func (sock *Sock) tx() {
 
 				sock.dupAckCnt = 0
 				sock.inFlight.timeout()
+				sock.mux.Lock()
+				sock.lostSinceReport++
+				sock.agg.Lost(1)
+				sock.mux.Unlock()
 				select {
 				case sock.notifyDrops <- notifyDrop{ev: "timeout", lastAck: firstUnacked}:
 				default:
@@ -110,10 +118,18 @@ func (sock *Sock) tx() {
 
 func (sock *Sock) doTx() {
 	sent := false
+	// the pacer held us back; the pace timer sends again, ack included
+	paced := false
 	sock.mux.Lock()
 	cwnd := sock.cwnd
 	sock.mux.Unlock()
 	for sock.inFlight.size() < cwnd {
+		if wait := sock.paceWait(); wait > 0 {
+			sock.paceTimer.Reset(wait)
+			paced = true
+			break
+		}
+
 		pkt, err := sock.nextPacket()
 		if err != nil {
 			log.WithFields(log.Fields{
@@ -138,7 +154,7 @@ func (sock *Sock) doTx() {
 	}
 
 	// send an ACK
-	if !sent {
+	if !sent && !paced {
 		pkt, err := sock.nextAck()
 		if err != nil {
 			return
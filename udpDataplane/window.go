@@ -18,6 +18,12 @@ type window struct {
 	mux   sync.RWMutex
 	pkts  map[uint32]windowEntry
 	order []uint32
+
+	// sender side
+	// bytes acknowledged over the window's lifetime
+	delivered uint64
+	// packets selectively acknowledged above the cumulative ack, and their lengths
+	sacked map[uint32]uint16
 }
 
 func (w *window) getOrder() (ord []uint32) {
@@ -31,8 +37,9 @@ func (w *window) getOrder() (ord []uint32) {
 
 func makeWindow() *window {
 	return &window{
-		pkts:  make(map[uint32]windowEntry),
-		order: make([]uint32, 0),
+		pkts:   make(map[uint32]windowEntry),
+		order:  make([]uint32, 0),
+		sacked: make(map[uint32]uint16),
 	}
 }
 
@@ -122,6 +129,7 @@ func (w *window) rcvdPkt(
 		if seq < p.AckNo {
 			rtts = append(rtts, t.Sub(w.pkts[seq].t))
 			seqNo = seq + uint32(w.pkts[seq].p.Length)
+			w.delivered += uint64(w.pkts[seq].p.Length)
 			delete(w.pkts, seq)
 			continue
 		}
@@ -131,13 +139,25 @@ func (w *window) rcvdPkt(
 
 	w.order = w.order[ind:]
 
+	// sacked packets the cumulative ack has now covered
+	for seq := range w.sacked {
+		if seq < p.AckNo {
+			delete(w.sacked, seq)
+		}
+	}
+
 	// handle SACKs
 	removeVals := make([]uint32, 0)
 	for i, v := range p.Sack {
 		if v {
 			seq := p.AckNo + uint32(1460*(i+1))
-			e := w.pkts[seq]
+			e, ok := w.pkts[seq]
 			rtts = append(rtts, t.Sub(e.t))
+			if ok {
+				w.delivered += uint64(e.p.Length)
+				w.sacked[seq] = e.p.Length
+			}
+
 			delete(w.pkts, seq)
 			removeVals = append(removeVals, seq)
 		}
@@ -224,6 +244,29 @@ func (w *window) size() uint32 {
 	return sz
 }
 
+// sender side
+// bytes acknowledged, cumulatively or selectively, over the window's lifetime
+func (w *window) deliveredBytes() uint64 {
+	w.mux.RLock()
+	defer w.mux.RUnlock()
+
+	return w.delivered
+}
+
+// sender side
+// bytes selectively acknowledged above the cumulative ack
+func (w *window) sackedBytes() uint64 {
+	w.mux.RLock()
+	defer w.mux.RUnlock()
+
+	sz := uint64(0)
+	for _, l := range w.sacked {
+		sz += uint64(l)
+	}
+
+	return sz
+}
+
 func (w *window) start() (uint32, error) {
 	w.mux.RLock()
 	defer w.mux.RUnlock()
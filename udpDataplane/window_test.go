@@ -301,6 +301,18 @@ func TestRecvSack(t *testing.T) {
 		t.Errorf("wrong order\nexpected [2920 5840 11680 13140]\ngot %v", w.order)
 		return
 	}
+
+	// 2 packets cumulatively acked, and 4 of the sacked ones were in flight
+	if d := w.deliveredBytes(); d != 6*1460 {
+		t.Errorf("wrong delivered bytes\nexpected %d\ngot %d", 6*1460, d)
+		return
+	}
+
+	if s := w.sackedBytes(); s != 4*1460 {
+		t.Errorf("wrong sacked bytes\nexpected %d\ngot %d", 4*1460, s)
+		return
+	}
+
 	for i, v := range w.order {
 		switch i {
 		case 0:
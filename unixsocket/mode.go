@@ -0,0 +1,108 @@
+package unixsocket
+
+import (
+	"fmt"
+	"strings"
+)
+
+/* How a backend's sockets are addressed, and what kind they are.
+ * The loc given to SetupListen and SetupSend selects the mode:
+ * "[seqpacket:][@]name", as Loc builds it. Both ends must agree.
+ */
+
+type Mode uint8
+
+const (
+	// named in Linux's abstract namespace instead of by a file,
+	// so there is nothing to clean up after a crash
+	Abstract Mode = 1 << iota
+	// SOCK_SEQPACKET connections instead of datagrams,
+	// so a sender learns when its listener goes away
+	SeqPacket
+)
+
+const (
+	abstractPrefix = "@"
+	packetPrefix   = "seqpacket:"
+)
+
+var modeNames = []struct {
+	m    Mode
+	name string
+}{
+	{Abstract, "abstract"},
+	{SeqPacket, "seqpacket"},
+}
+
+// ParseMode parses a comma-separated list of "abstract" and "seqpacket";
+// empty is datagrams named by files
+func ParseMode(s string) (Mode, error) {
+	var m Mode
+	if s == "" {
+		return m, nil
+	}
+
+	for _, part := range strings.Split(s, ",") {
+		found := false
+		for _, n := range modeNames {
+			if strings.TrimSpace(part) == n.name {
+				m |= n.m
+				found = true
+			}
+		}
+
+		if !found {
+			return 0, fmt.Errorf("unknown unix socket mode %q", part)
+		}
+	}
+
+	return m, nil
+}
+
+func (m Mode) String() string {
+	var parts []string
+	for _, n := range modeNames {
+		if m&n.m != 0 {
+			parts = append(parts, n.name)
+		}
+	}
+
+	return strings.Join(parts, ",")
+}
+
+// Loc is loc, to be set up in mode m
+func Loc(loc string, m Mode) string {
+	if m&Abstract != 0 {
+		loc = abstractPrefix + loc
+	}
+
+	if m&SeqPacket != 0 {
+		loc = packetPrefix + loc
+	}
+
+	return loc
+}
+
+// parseLoc undoes Loc
+func parseLoc(loc string) (string, Mode) {
+	var m Mode
+	if strings.HasPrefix(loc, packetPrefix) {
+		m |= SeqPacket
+		loc = loc[len(packetPrefix):]
+	}
+
+	if strings.HasPrefix(loc, abstractPrefix) {
+		m |= Abstract
+		loc = loc[len(abstractPrefix):]
+	}
+
+	return loc, m
+}
+
+func (m Mode) network() string {
+	if m&SeqPacket != 0 {
+		return "unixpacket"
+	}
+
+	return "unixgram"
+}
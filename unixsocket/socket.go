@@ -1,16 +1,30 @@
 package unixsocket
 
 import (
+	"fmt"
+	"io"
 	"net"
-	"os"
+	"runtime"
+	"sync"
+	"syscall"
 
 	"ccp/ipcBackend"
 
 	log "github.com/sirupsen/logrus"
 )
 
+// messages above this are truncated, and reported as overruns.
+// batches, the largest messages, fit.
+const maxMsgLen = 1 << 16
+
 type SocketIpc struct {
-	in  *net.UnixConn
+	// datagrams
+	in *net.UnixConn
+	// SOCK_SEQPACKET connections, and those accepted
+	ln    *net.UnixListener
+	mux   sync.Mutex
+	conns map[*net.UnixConn]bool
+
 	out *net.UnixConn
 
 	openFiles []string
@@ -19,64 +33,104 @@ type SocketIpc struct {
 
 	err    error
 	killed chan interface{}
+	ipcbackend.Health
 }
 
 func New() ipcbackend.Backend {
-	return &SocketIpc{openFiles: make([]string, 0)}
+	return &SocketIpc{
+		openFiles: make([]string, 0),
+		conns:     make(map[*net.UnixConn]bool),
+		killed:    make(chan interface{}),
+	}
+}
+
+// the address of name, for socket id; listening there
+// first takes it over from anyone who left it behind
+func (s *SocketIpc) address(name string, id uint32, m Mode, listen bool) (*net.UnixAddr, error) {
+	if m&Abstract != 0 {
+		if runtime.GOOS != "linux" {
+			return nil, fmt.Errorf("abstract unix sockets are only supported on linux")
+		}
+
+		// no file, but the same name one would have,
+		// so namespaces still keep CCPs apart
+		return &net.UnixAddr{Name: abstractPrefix + ipcbackend.AddressForSend(name, id), Net: m.network()}, nil
+	}
+
+	if !listen {
+		return &net.UnixAddr{Name: ipcbackend.AddressForSend(name, id), Net: m.network()}, nil
+	}
+
+	fd, newOpen, err := ipcbackend.AddressForListen(name, id)
+	if err != nil {
+		return nil, err
+	}
+
+	s.openFiles = append(s.openFiles, newOpen)
+	return &net.UnixAddr{Name: fd, Net: m.network()}, nil
 }
 
+// SetupListen listens on loc, in the Mode Loc gave it
 func (s *SocketIpc) SetupListen(loc string, id uint32) ipcbackend.Backend {
 	if s.err != nil {
 		return s
 	}
 
-	var addr *net.UnixAddr
-	fd, newOpen, err := ipcbackend.AddressForListen(loc, id)
+	name, m := parseLoc(loc)
+	addr, err := s.address(name, id, m, true)
 	if err != nil {
 		s.err = err
 		return s
 	}
 
-	s.openFiles = append(s.openFiles, newOpen)
+	s.listenCh = make(chan []byte)
+	if m&SeqPacket != 0 {
+		s.ln, err = net.ListenUnix(addr.Net, addr)
+		if err == nil {
+			go s.accept()
+		}
+	} else {
+		s.in, err = net.ListenUnixgram(addr.Net, addr)
+		if err == nil {
+			go s.listen()
+		}
+	}
 
-	addr, err = net.ResolveUnixAddr("unixgram", fd)
-	if err != nil {
-		s.err = err
-		return s
+	if err == nil && m&Abstract == 0 {
+		err = ipcbackend.SetPerm(addr.Name)
 	}
 
-	so, err := net.ListenUnixgram("unixgram", addr)
 	if err != nil {
 		s.err = err
-		return s
 	}
 
-	s.in = so
-	s.killed = make(chan interface{})
-	s.listenCh = make(chan []byte)
-	go s.listen()
 	return s
 }
 
+// SetupSend sends to loc, in the Mode Loc gave it
 func (s *SocketIpc) SetupSend(loc string, id uint32) ipcbackend.Backend {
 	if s.err != nil {
 		return s
 	}
 
-	fd := ipcbackend.AddressForSend(loc, id)
-	addr, err := net.ResolveUnixAddr("unixgram", fd)
+	name, m := parseLoc(loc)
+	addr, err := s.address(name, id, m, false)
 	if err != nil {
 		s.err = err
 		return s
 	}
 
-	out, err := net.DialUnix("unixgram", nil, addr)
+	out, err := net.DialUnix(addr.Net, nil, addr)
 	if err != nil {
 		s.err = err
 		return s
 	}
 
 	s.out = out
+	if m&SeqPacket != 0 {
+		go s.watchPeer(out)
+	}
+
 	return s
 }
 
@@ -125,24 +179,70 @@ func (s *SocketIpc) Listen() chan []byte {
 
 func (s *SocketIpc) Close() error {
 	close(s.killed)
+	if s.out != nil {
+		s.out.Close()
+	}
+
+	// unblock a pending read in listen() or accept()
+	if s.in != nil {
+		s.in.Close()
+	}
+
+	if s.ln != nil {
+		s.ln.Close()
+	}
+
+	s.mux.Lock()
+	for c := range s.conns {
+		c.Close()
+	}
+	s.mux.Unlock()
+
+	// remove socket files before returning,
+	// so a process can exit right after closing
+	for _, f := range s.openFiles {
+		ipcbackend.ReleaseListen(f)
+	}
+
+	s.CloseErrors()
 	return nil
 }
 
+func (s *SocketIpc) killedYet() bool {
+	select {
+	case <-s.killed:
+		return true
+	default:
+		return false
+	}
+}
+
+// read one message from c into buf, returning a copy of it
+func (s *SocketIpc) read(c *net.UnixConn, buf []byte, where string) ([]byte, error) {
+	n, _, flags, _, err := c.ReadMsgUnix(buf, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if flags&syscall.MSG_TRUNC != 0 {
+		return nil, &ipcbackend.Error{
+			Kind:  ipcbackend.ErrOverrun,
+			Where: where,
+			Err:   fmt.Errorf("message truncated to %d bytes", n),
+		}
+	}
+
+	msg := make([]byte, n)
+	copy(msg, buf[:n])
+	return msg, nil
+}
+
 func (s *SocketIpc) listen() {
-	buf := make([]byte, 2048)
-	writePos := 0
+	buf := make([]byte, maxMsgLen)
 	for {
 		select {
 		case _, ok := <-s.killed:
 			if !ok {
-				if s.in != nil {
-					s.in.Close()
-				}
-
-				for _, f := range s.openFiles {
-					os.RemoveAll(f)
-				}
-
 				close(s.listenCh)
 
 				log.WithFields(log.Fields{
@@ -153,16 +253,131 @@ func (s *SocketIpc) listen() {
 		default:
 		}
 
-		ring := append(buf[writePos:], buf[:writePos]...)
-		n, err := s.in.Read(ring)
+		msg, err := s.read(s.in, buf, "socketIpc.listenMsg.read")
 		if err != nil {
+			if s.killedYet() {
+				continue
+			}
+
+			e := ipcbackend.NewError("socketIpc.listenMsg.read", err)
+			if e.Kind != ipcbackend.ErrOverrun {
+				log.WithFields(log.Fields{
+					"where": e.Where,
+					"kind":  e.Kind,
+				}).Warn(err)
+			}
+
+			s.Report(e)
+			if e.Fatal() {
+				// reading again would only fail again
+				<-s.killed
+			}
+
+			continue
+		}
+
+		select {
+		case s.listenCh <- msg:
+		case <-s.killed:
+		}
+	}
+}
+
+// accept SOCK_SEQPACKET connections, until closed
+func (s *SocketIpc) accept() {
+	for {
+		c, err := s.ln.AcceptUnix()
+		if err != nil {
+			if s.killedYet() {
+				return
+			}
+
+			e := ipcbackend.NewError("socketIpc.accept", err)
 			log.WithFields(log.Fields{
-				"where": "socketIpc.listenMsg.read",
+				"where": e.Where,
+				"kind":  e.Kind,
 			}).Warn(err)
+			s.Report(e)
+			if e.Fatal() {
+				return
+			}
+
 			continue
 		}
 
-		writePos = (writePos + n) % len(buf)
-		s.listenCh <- ring[:n]
+		s.mux.Lock()
+		if s.killedYet() {
+			s.mux.Unlock()
+			c.Close()
+			return
+		}
+
+		s.conns[c] = true
+		s.mux.Unlock()
+		go s.readConn(c)
 	}
 }
+
+// read messages from a connection until its peer closes it
+func (s *SocketIpc) readConn(c *net.UnixConn) {
+	defer func() {
+		s.mux.Lock()
+		delete(s.conns, c)
+		s.mux.Unlock()
+		c.Close()
+	}()
+
+	buf := make([]byte, maxMsgLen)
+	for {
+		msg, err := s.read(c, buf, "socketIpc.readConn")
+		if err != nil {
+			if s.killedYet() {
+				return
+			}
+
+			e := ipcbackend.NewError("socketIpc.readConn", err)
+			if e.Kind == ipcbackend.ErrOverrun {
+				s.Report(e)
+				continue
+			}
+
+			// one sender leaving is no error, though losing it otherwise is
+			if err != io.EOF {
+				e.Kind = ipcbackend.ErrIO
+				s.Report(e)
+			}
+
+			log.WithFields(log.Fields{
+				"where": "socketIpc.readConn",
+				"err":   err,
+			}).Info("peer disconnected")
+			return
+		}
+
+		select {
+		case s.listenCh <- msg:
+		case <-s.killed:
+			return
+		}
+	}
+}
+
+// listeners never write back, so a read on a sending connection
+// returns only once the listener has gone
+func (s *SocketIpc) watchPeer(c *net.UnixConn) {
+	var buf [1]byte
+	_, err := c.Read(buf[:])
+	if s.killedYet() {
+		return
+	}
+
+	if err == nil {
+		err = fmt.Errorf("unexpected message from listener")
+	}
+
+	s.Report(&ipcbackend.Error{
+		Kind:  ipcbackend.ErrClosed,
+		Where: "socketIpc.watchPeer",
+		Err:   err,
+	})
+}
@@ -4,8 +4,12 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"runtime"
+	"strings"
 	"testing"
 	"time"
+
+	"ccp/ipcBackend"
 )
 
 // mock message implementing ipcbackend.Msg
@@ -106,3 +110,118 @@ func writer(ready chan interface{}, done chan error) {
 
 	done <- nil
 }
+
+func TestTruncated(t *testing.T) {
+	back, err := New().SetupListen("trunc-test", 0).SetupFinish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer back.Close()
+
+	addr, err := net.ResolveUnixAddr("unixgram", "/tmp/ccp-trunc-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := net.DialUnix("unixgram", nil, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+
+	// bigger than the backend reads
+	if _, err = out.Write(make([]byte, maxMsgLen+1)); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-back.Errors():
+		if e, ok := err.(*ipcbackend.Error); !ok || e.Kind != ipcbackend.ErrOverrun {
+			t.Errorf("expected an overrun, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("timed out")
+	}
+}
+
+func TestParseMode(t *testing.T) {
+	for _, s := range []string{"", "abstract", "seqpacket", "abstract,seqpacket"} {
+		m, err := ParseMode(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if m.String() != s {
+			t.Errorf("parsed %q as %q", s, m)
+		}
+
+		if name, lm := parseLoc(Loc("ccp-in", m)); name != "ccp-in" || lm != m {
+			t.Errorf("%q: got (%s, %q)", s, name, lm)
+		}
+	}
+
+	if _, err := ParseMode("stream"); err == nil {
+		t.Error("expected an unknown mode to be refused")
+	}
+}
+
+// send a message bigger than the old 2KB limit from one backend to another
+func roundTrip(t *testing.T, m Mode) (listener, sender ipcbackend.Backend) {
+	listener, err := New().SetupListen(Loc("mode-test", m), 0).SetupFinish()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sender, err = New().SetupSend(Loc("mode-test", m), 0).SetupFinish()
+	if err != nil {
+		listener.Close()
+		t.Fatal(err)
+	}
+
+	msg := strings.Repeat("x", 4096)
+	msgs := listener.Listen()
+	if err = sender.SendMsg(MockMsg{b: msg}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case buf := <-msgs:
+		if string(buf) != msg {
+			t.Errorf("got %d bytes, expected %d", len(buf), len(msg))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out")
+	}
+
+	return
+}
+
+func TestAbstract(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("abstract sockets are linux only")
+	}
+
+	listener, sender := roundTrip(t, Abstract)
+	defer sender.Close()
+	defer listener.Close()
+
+	if _, err := os.Stat(ipcbackend.AddressForSend("mode-test", 0)); !os.IsNotExist(err) {
+		t.Errorf("expected no socket file, got %v", err)
+	}
+}
+
+func TestSeqPacket(t *testing.T) {
+	listener, sender := roundTrip(t, SeqPacket)
+	defer sender.Close()
+
+	// the sender learns its listener has gone
+	listener.Close()
+	select {
+	case err := <-sender.Errors():
+		if e, ok := err.(*ipcbackend.Error); !ok || e.Kind != ipcbackend.ErrClosed {
+			t.Errorf("expected the listener to be closed, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("timed out")
+	}
+}
@@ -35,6 +35,7 @@ func (v *Vegas) Create(
 	pktsz uint32,
 	startSeq uint32,
 	startCwnd uint32,
+	dp ccpFlow.DatapathInfo,
 ) {
 	v.sockid = socketid
 	v.ipc = send
@@ -73,6 +74,11 @@ func (v *Vegas) GotMeasurement(m ccpFlow.Measurement) {
 		v.baseRTT = RTT
 	}
 
+	// the smallest sample over the interval, if the datapath reports it
+	if minRTT := float32(m.MinRtt.Seconds()); minRTT > 0 && minRTT < v.baseRTT {
+		v.baseRTT = minRTT
+	}
+
 	inQueue := (v.cwnd * (RTT - v.baseRTT)) / (RTT * float32(v.pktSize))
 	if inQueue <= v.alpha {
 		v.cwnd += float32(v.pktSize)
@@ -138,6 +144,18 @@ func (v *Vegas) newPattern() {
 	}
 }
 
+func (v *Vegas) Handoff() ccpFlow.Handoff {
+	return ccpFlow.Handoff{
+		Cwnd: uint32(v.cwnd),
+		Ack:  v.lastAck,
+	}
+}
+
+// the carried over rtt bounds the base rtt until vegas measures a lower one
+func (v *Vegas) Resume(h ccpFlow.Handoff) {
+	v.baseRTT = float32(h.Rtt.Seconds())
+}
+
 func Init() {
 	ccpFlow.Register("vegas", func() ccpFlow.Flow {
 		return &Vegas{}